@@ -1,28 +1,29 @@
 package smugmug
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
+	"path"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type requestsHandler interface {
-	get(string, interface{}) error
+	get(context.Context, string, interface{}) error
 }
 
 // userAlbums returns the list of albums belonging to the suer
-func (w *Worker) userAlbums() ([]album, error) {
-	uri := w.userAlbumsURI()
-	return w.albums(uri)
+func (w *Worker) userAlbums(ctx context.Context) ([]album, error) {
+	uri := w.userAlbumsURI(ctx)
+	return w.albums(ctx, uri)
 }
 
 // currentUser returns the nickname of the authenticated user
-func (w *Worker) currentUser() (string, error) {
+func (w *Worker) currentUser(ctx context.Context) (string, error) {
 	var u currentUser
-	if err := w.req.get("/api/v2!authuser", &u); err != nil {
+	if err := w.req.get(ctx, "/api/v2!authuser", &u); err != nil {
 		return "", err
 	}
 	return u.Response.User.NickName, nil
@@ -30,21 +31,21 @@ func (w *Worker) currentUser() (string, error) {
 
 // userAlbumsURI returns the URI of the first page of the user albums. It's intended to be used
 // as argument for a call to albums()
-func (w *Worker) userAlbumsURI() string {
+func (w *Worker) userAlbumsURI(ctx context.Context) string {
 	var u user
 	path := fmt.Sprintf("/api/v2/user/%s", w.cfg.username)
-	w.req.get(path, &u)
+	w.req.get(ctx, path, &u)
 	return u.Response.User.Uris.UserAlbums.URI
 }
 
 // albums make multiple calls to obtain the full list of user albums. It calls the albums endpoint
 // unless the "NextPage" value in the response is empty
-func (w *Worker) albums(firstURI string) ([]album, error) {
+func (w *Worker) albums(ctx context.Context, firstURI string) ([]album, error) {
 	uri := firstURI
 	var albums []album
 	for uri != "" {
 		var a albumsResponse
-		if err := w.req.get(uri, &a); err != nil {
+		if err := w.req.get(ctx, uri, &a); err != nil {
 			return albums, fmt.Errorf("Error getting albums from %s. Error: %v", uri, err)
 		}
 		albums = append(albums, a.Response.Album...)
@@ -55,17 +56,18 @@ func (w *Worker) albums(firstURI string) ([]album, error) {
 
 // albumImages make multiple calls to obtain all images of an album. It calls the album images
 // endpoint unless the "NextPage" value in the response is empty
-func (w *Worker) albumImages(firstURI string, albumPath string) ([]albumImage, error) {
+func (w *Worker) albumImages(ctx context.Context, firstURI string, albumPath, albumKey string) ([]albumImage, error) {
 	uri := firstURI
 	var images []albumImage
 	for uri != "" {
 		var a albumImagesResponse
-		if err := w.req.get(uri, &a); err != nil {
+		if err := w.req.get(ctx, uri, &a); err != nil {
 			return images, fmt.Errorf("Error getting album images from %s. Error: %v", uri, err)
 		}
-		// Loop over response in inject the albumPath and then append to the images
+		// Loop over response in inject the albumPath and albumKey and then append to the images
 		for _, i := range a.Response.AlbumImage {
 			i.AlbumPath = albumPath
+			i.AlbumKey = albumKey
 			if err := i.buildFilename(w.filenameTmpl); err != nil {
 				return nil, fmt.Errorf("Cannot build image filename: %v", err)
 			}
@@ -77,88 +79,297 @@ func (w *Worker) albumImages(firstURI string, albumPath string) ([]albumImage, e
 	return images, nil
 }
 
-func (w *Worker) imageTimestamp(img albumImage) time.Time {
+// albumImage returns the image with the given key of the album with the given key and path
+func (w *Worker) albumImage(ctx context.Context, albumKey, imageKey, albumPath string) (albumImage, error) {
+	var r albumImageResponse
+	if err := w.req.get(ctx, fmt.Sprintf("/api/v2/album/%s/image/%s", albumKey, imageKey), &r); err != nil {
+		return albumImage{}, fmt.Errorf("Cannot get the image: %v", err)
+	}
+	image := r.Response.AlbumImage
+	image.AlbumPath = albumPath
+	image.AlbumKey = albumKey
+	if err := image.buildFilename(w.filenameTmpl); err != nil {
+		return albumImage{}, fmt.Errorf("Cannot build image filename: %v", err)
+	}
+	return image, nil
+}
+
+// highlightImageKey returns the ImageKey of the album cover image, or an empty string if the album
+// doesn't have one
+func (w *Worker) highlightImageKey(ctx context.Context, a album) string {
+	if a.Uris.HighlightImage.URI == "" {
+		return ""
+	}
+	var h highlightImageResponse
+	if err := w.req.get(ctx, a.Uris.HighlightImage.URI, &h); err != nil {
+		log.WithField(fieldAlbum, a.URLPath).WithError(err).Debug("Cannot get highlight image")
+		return ""
+	}
+	return h.Response.Image.ImageKey
+}
+
+// buildAlbumMetadata collects the album settings and its images, in the album order. The album
+// password is included only if store.album_password is enabled, since album.json is saved in clear
+func (w *Worker) buildAlbumMetadata(ctx context.Context, a album, images []albumImage) albumMetadata {
+	m := albumMetadata{
+		AlbumKey:       a.AlbumKey,
+		Name:           a.Name,
+		Description:    a.Description,
+		Keywords:       a.Keywords,
+		Date:           a.Date,
+		Privacy:        a.Privacy,
+		SecurityType:   a.SecurityType,
+		PasswordHint:   a.PasswordHint,
+		SortMethod:     a.SortMethod,
+		SortDirection:  a.SortDirection,
+		URLName:        a.URLName,
+		URLPath:        a.URLPath,
+		HighlightImage: w.highlightImageKey(ctx, a),
+		Images:         make([]albumImageMetadata, 0, len(images)),
+	}
+	if w.cfg.AlbumPassword {
+		m.Password = a.Password
+	}
+	for _, i := range images {
+		m.Images = append(m.Images, albumImageMetadata{
+			ImageKey:         i.ImageKey,
+			FileName:         i.FileName,
+			LocalName:        i.Name(),
+			Title:            i.Title,
+			Caption:          i.Caption,
+			Keywords:         i.Keywords,
+			DateTimeOriginal: i.DateTimeOriginal,
+			ArchivedMD5:      i.ArchivedMD5,
+			ArchivedSize:     i.ArchivedSize,
+			IsVideo:          i.IsVideo,
+		})
+	}
+	return m
+}
+
+// saveAlbumMetadata writes the album.json file in the given album folder
+func (w *Worker) saveAlbumMetadata(ctx context.Context, a album, images []albumImage, folder string) error {
+	dest := path.Join(folder, albumMetadataFilename)
+	log.WithFields(log.Fields{fieldAlbum: a.URLPath, fieldFile: dest}).Debug("Saving album metadata")
+	return writeJSON(w.store, dest, w.buildAlbumMetadata(ctx, a, images))
+}
+
+// comments make multiple calls to obtain all comments of an album or an image. It calls the
+// comments endpoint unless the "NextPage" value in the response is empty
+func (w *Worker) comments(ctx context.Context, firstURI string) ([]comment, error) {
+	uri := firstURI
+	var comments []comment
+	for uri != "" {
+		var c commentsResponse
+		if err := w.req.get(ctx, uri, &c); err != nil {
+			return comments, fmt.Errorf("Error getting comments from %s. Error: %v", uri, err)
+		}
+		comments = append(comments, c.Response.Comment...)
+		uri = c.Response.Pages.NextPage
+	}
+	return comments, nil
+}
+
+// saveAlbumComments writes the comments of the album and of its images to the comments.json file
+// in the given album folder
+func (w *Worker) saveAlbumComments(ctx context.Context, a album, images []albumImage, folder string) error {
+	c := albumComments{
+		Images: make(map[string][]comment),
+	}
+
+	var err error
+	if a.Uris.AlbumComments.URI != "" {
+		if c.Album, err = w.comments(ctx, a.Uris.AlbumComments.URI); err != nil {
+			return err
+		}
+	}
+	for _, i := range images {
+		if i.Uris.ImageComments.Uri == "" {
+			continue
+		}
+		imgComments, err := w.comments(ctx, i.Uris.ImageComments.Uri)
+		if err != nil {
+			return err
+		}
+		if len(imgComments) > 0 {
+			c.Images[i.ImageKey] = imgComments
+		}
+	}
+
+	dest := path.Join(folder, albumCommentsFilename)
+	log.WithFields(log.Fields{fieldAlbum: a.URLPath, fieldFile: dest}).Debug("Saving album comments")
+	return writeJSON(w.store, dest, c)
+}
+
+func (w *Worker) imageTimestamp(ctx context.Context, img albumImage) time.Time {
 	var i imageMetadataResponse
-	if err := w.req.get(img.Uris.ImageMetadata.Uri, &i); err != nil {
+	if err := w.req.get(ctx, img.Uris.ImageMetadata.Uri, &i); err != nil {
 		return time.Time{}
 	}
 	return i.Response.DateTimeCreated
 }
 
-// saveImages calls saveImage or saveVideo to save a list of album images to the given folder
-func (w *Worker) saveImages(images []albumImage, folder string) {
+// saveImages calls saveImage or saveVideo to save a list of album images to the given folder.
+// It stops when the context is canceled
+func (w *Worker) saveImages(ctx context.Context, images []albumImage, folder string) {
 	for _, image := range images {
+		if ctx.Err() != nil {
+			return
+		}
+		var err error
 		if image.IsVideo {
-			if err := w.saveVideo(image, folder); err != nil {
-				log.Warnf("Error: %v", err)
-			}
-			continue
+			err = w.saveVideo(ctx, image, folder)
+		} else {
+			err = w.saveImage(ctx, image, folder)
 		}
-		if err := w.saveImage(image, folder); err != nil {
-			log.Warnf("Error: %v", err)
+		if err != nil {
+			dest := path.Join(folder, image.Name())
+			if ctx.Err() != nil {
+				imageLog(image).WithField(fieldFile, dest).Info("Download aborted")
+				return
+			}
+			w.fileDone(fileFailed, image, dest, image.knownSize(), err)
+			imageLog(image).WithField(fieldFile, dest).WithError(err).Warn("Cannot save the file")
 		}
 	}
 }
 
 // saveImage saves an image to the given folder unless its name is empty
-func (w *Worker) saveImage(image albumImage, folder string) error {
+func (w *Worker) saveImage(ctx context.Context, image albumImage, folder string) error {
 	if image.Name() == "" {
 		return errors.New("Unable to find valid image filename, skipping..")
 	}
-	dest := fmt.Sprintf("%s/%s", folder, image.Name())
-	log.Debug(image.ArchivedUri)
+	dest := path.Join(folder, image.Name())
+	imageLog(image).WithField(fieldFile, dest).Debugf("Archived URI %s", image.ArchivedUri)
 
-	ok, err := w.downloadFn(dest, image.ArchivedUri, image.ArchivedSize)
+	url, meta, err := w.imageFile(ctx, &image)
 	if err != nil {
 		return err
 	}
+	return w.saveFile(ctx, image, dest, url, meta)
+}
 
-	if w.cfg.UseMetadataTimes && (ok || w.cfg.ForceMetadataTimes) {
-		return w.setChTime(image, dest)
+// saveVideo saves a video to the given folder unless its name is empty. A video still under
+// processing is deferred, to be checked again at the end of the run
+func (w *Worker) saveVideo(ctx context.Context, image albumImage, folder string) error {
+	if image.Name() == "" {
+		return errors.New("Unable to find valid video filename, skipping..")
 	}
+	dest := path.Join(folder, image.Name())
 
-	return nil
+	if image.Processing {
+		w.deferVideo(image, folder)
+		return nil
+	}
+
+	url, meta, err := w.imageFile(ctx, &image)
+	if err != nil {
+		return err
+	}
+	return w.saveFile(ctx, image, dest, url, meta)
 }
 
-// saveVideo saves a video to the given folder unless its name is empty od is still under processing
-func (w *Worker) saveVideo(image albumImage, folder string) error {
-	if image.Name() == "" {
-		return errors.New("Unable to find valid video filename, skipping..")
+// imageFile returns the download URL and the description of the file of an image or a video.
+// For videos, the largest video is retrieved and saved in the image, so that it's retrieved once
+func (w *Worker) imageFile(ctx context.Context, image *albumImage) (string, FileMeta, error) {
+	if !image.IsVideo {
+		return image.ArchivedUri, FileMeta{
+			Size:      image.ArchivedSize,
+			MD5:       image.ArchivedMD5,
+			ImageKey:  image.ImageKey,
+			UploadKey: image.UploadKey,
+		}, nil
+	}
+
+	if image.video == nil {
+		var v albumVideo
+		imageLog(*image).Debugf("Getting the largest video %s", image.Uris.LargestVideo.Uri)
+		if err := w.req.get(ctx, image.Uris.LargestVideo.Uri, &v); err != nil {
+			return "", FileMeta{}, fmt.Errorf("Cannot get URI for video %+v. Error: %v", *image, err)
+		}
+		image.video = &v
 	}
-	dest := fmt.Sprintf("%s/%s", folder, image.Name())
+	return image.video.Response.LargestVideo.Url, FileMeta{
+		Size:      image.video.Response.LargestVideo.Size,
+		MD5:       image.video.Response.LargestVideo.MD5,
+		ImageKey:  image.ImageKey,
+		UploadKey: image.UploadKey,
+	}, nil
+}
 
-	if image.Processing { // Skip videos if under processing
-		return fmt.Errorf("Skipping video %s because under processing, %#v\n", image.Name(), image)
+// saveFile downloads the given url to dest, skipping the download if a file with the same size
+// (and MD5, if known) already exists, or if the storage can link an existing copy of it. The
+// modification time is retrieved before the download, so that the backend can set it while
+// writing the file. When versions are enabled, an existing different file is moved to the versions
+// folder before downloading the new one
+func (w *Worker) saveFile(ctx context.Context, image albumImage, dest, url string, meta FileMeta) error {
+	fi, err := w.store.Stat(dest)
+	if err == nil && sameFile(fi, meta) {
+		imageLog(image).WithFields(log.Fields{fieldFile: dest, fieldBytes: meta.Size}).Debug("File exists with same size")
+		outcome := fileSkipped
+		if w.cfg.ForceMetadataTimes {
+			retimed, err := w.setChTime(ctx, image, dest)
+			if err != nil {
+				return err
+			}
+			if retimed {
+				outcome = fileRetimed
+			}
+		}
+		w.fileDone(outcome, image, dest, meta.Size, nil)
+		return nil
+	}
+	if !w.checkQuota(meta.Size) {
+		imageLog(image).WithFields(log.Fields{fieldFile: dest, fieldBytes: meta.Size}).Debug("Not downloading because of the quota")
+		w.fileDone(fileOverQuota, image, dest, meta.Size, nil)
+		return nil
+	}
+	if err == nil && !fi.IsDir && w.versions != nil {
+		if err := w.versions.keep(dest, fi, time.Now()); err != nil {
+			return err
+		}
 	}
 
-	var v albumVideo
-	log.Debug("(saveVideo) getting ", image.Uris.LargestVideo.Uri)
-	if err := w.req.get(image.Uris.LargestVideo.Uri, &v); err != nil {
-		return fmt.Errorf("Cannot get URI for video %+v. Error: %v", image, err)
+	if l, ok := w.store.(linker); ok {
+		linked, err := l.Link(dest, meta)
+		if err != nil {
+			return err
+		}
+		if linked {
+			w.fileDone(fileSkipped, image, dest, meta.Size, nil)
+			return nil
+		}
 	}
 
-	ok, err := w.downloadFn(dest, v.Response.LargestVideo.Url, v.Response.LargestVideo.Size)
-	if err != nil {
+	if w.cfg.UseMetadataTimes {
+		meta.ModTime = w.imageTime(ctx, image)
+	}
+	if err := w.downloadFn(ctx, image, dest, url, meta); err != nil {
 		return err
 	}
+	w.downloaded += meta.Size
+	metricDownloadedBytes.add(float64(meta.Size))
+	w.fileDone(fileDownloaded, image, dest, meta.Size, nil)
+	return nil
+}
 
-	if w.cfg.UseMetadataTimes && (ok || w.cfg.ForceMetadataTimes) {
-		return w.setChTime(image, dest)
+// setChTime sets the modification time of the existing file to the creation time of the image.
+// It returns false if the creation time is unknown
+func (w *Worker) setChTime(ctx context.Context, image albumImage, dest string) (bool, error) {
+	if created := w.imageTime(ctx, image); !created.IsZero() {
+		imageLog(image).WithField(fieldFile, dest).Debugf("Setting chtime %v", created)
+		return true, w.store.Chtimes(dest, created)
 	}
 
-	return nil
+	return false, nil
 }
 
-func (w *Worker) setChTime(image albumImage, dest string) error {
+// imageTime returns the creation time of the image, or the zero time if unknown
+func (w *Worker) imageTime(ctx context.Context, image albumImage) time.Time {
 	// Try first with the date in the image, to avoid making an additional call
 	created, err := time.Parse(time.RFC3339, image.DateTimeOriginal)
 	if err != nil || created.IsZero() {
-		created = w.imageTimestamp(image)
-	}
-	if !created.IsZero() {
-		log.Debugf("Setting chtime %v for %s", created, dest)
-		return os.Chtimes(dest, time.Now(), created)
+		created = w.imageTimestamp(ctx, image)
 	}
-
-	return nil
+	return created
 }
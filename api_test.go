@@ -1,6 +1,11 @@
 package smugmug
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -8,7 +13,7 @@ type albumMockHandler struct {
 	called int
 }
 
-func (c *albumMockHandler) get(url string, obj interface{}) error {
+func (c *albumMockHandler) get(_ context.Context, url string, obj interface{}) error {
 	defer func() { c.called++ }()
 	a := obj.(*albumsResponse)
 	a.Response.Album = []album{
@@ -27,7 +32,7 @@ func TestGetAlbums(t *testing.T) {
 	w := &Worker{
 		req: &albumMockHandler{},
 	}
-	albums, err := w.albums("someurl")
+	albums, err := w.albums(context.Background(), "someurl")
 	if err != nil {
 		t.Errorf("Unexpected error %v", err)
 	}
@@ -43,7 +48,7 @@ type albumImages struct {
 	called int
 }
 
-func (c *albumImages) get(url string, obj interface{}) error {
+func (c *albumImages) get(_ context.Context, url string, obj interface{}) error {
 	defer func() { c.called++ }()
 	a := obj.(*albumImagesResponse)
 	a.Response.AlbumImage = []albumImage{
@@ -64,7 +69,7 @@ func TestGetAlbumImages(t *testing.T) {
 		req:          &albumImages{},
 		filenameTmpl: tmpl,
 	}
-	albums, err := w.albumImages("someurl", "myAlbumPath")
+	albums, err := w.albumImages(context.Background(), "someurl", "myAlbumPath", "myAlbumKey")
 	if err != nil {
 		t.Errorf("Unexpected error %v", err)
 	}
@@ -75,3 +80,118 @@ func TestGetAlbumImages(t *testing.T) {
 		t.Errorf("Want 4, got %d", len(albums))
 	}
 }
+
+type commentsMockHandler struct {
+	called int
+}
+
+func (c *commentsMockHandler) get(_ context.Context, url string, obj interface{}) error {
+	defer func() { c.called++ }()
+	a := obj.(*commentsResponse)
+	a.Response.Comment = []comment{
+		{Name: "author", Text: "nice!", Rating: 5},
+	}
+	if c.called == 0 {
+		a.Response.Pages.NextPage = "something"
+		return nil
+	}
+	a.Response.Pages.NextPage = ""
+	return nil
+}
+
+func TestGetComments(t *testing.T) {
+	w := &Worker{
+		req: &commentsMockHandler{},
+	}
+	comments, err := w.comments(context.Background(), "someurl")
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if w.req.(*commentsMockHandler).called != 2 {
+		t.Errorf("Called, want 2, got %d", w.req.(*commentsMockHandler).called)
+	}
+	if len(comments) != 2 {
+		t.Errorf("Want 2, got %d", len(comments))
+	}
+	if comments[0].Text != "nice!" || comments[0].Rating != 5 {
+		t.Errorf("Unexpected comment %+v", comments[0])
+	}
+}
+
+// albumCommentsMockHandler returns the comments of each URL, failing for the unknown ones
+type albumCommentsMockHandler struct {
+	comments map[string][]comment
+	calls    []string
+}
+
+func (c *albumCommentsMockHandler) get(_ context.Context, url string, obj interface{}) error {
+	c.calls = append(c.calls, url)
+	comments, ok := c.comments[url]
+	if !ok {
+		return errors.New("500 Internal Server Error")
+	}
+	obj.(*commentsResponse).Response.Comment = comments
+	return nil
+}
+
+func TestSaveAlbumComments(t *testing.T) {
+	h := &albumCommentsMockHandler{comments: map[string][]comment{
+		"/album/comments":  {{Name: "author", Text: "great album", Rating: 4}},
+		"/image1/comments": {{Name: "other", Date: "2021-06-01T10:00:00Z", Text: "nice!"}},
+		"/image2/comments": {},
+	}}
+	store := newMemStorage()
+	w := &Worker{req: h, store: store}
+
+	var a album
+	a.Uris.AlbumComments.URI = "/album/comments"
+	images := make([]albumImage, 4)
+	for n, key := range []string{"image1", "image2", "image3", "image4"} {
+		images[n].ImageKey = key
+	}
+	images[0].Uris.ImageComments.Uri = "/image1/comments"
+	images[1].Uris.ImageComments.Uri = "/image2/comments"
+	// image3 has no comments URI, while the call of image4 fails
+	images[3].Uris.ImageComments.Uri = "/image4/comments"
+
+	// A failed call stops the album comments, without saving the file
+	if err := w.saveAlbumComments(context.Background(), a, images, "album"); err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if _, err := store.Stat("album/" + albumCommentsFilename); !os.IsNotExist(err) {
+		t.Fatalf("want no comments file, got %v", err)
+	}
+
+	h.calls = nil
+	if err := w.saveAlbumComments(context.Background(), a, images[:3], "album"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"/album/comments", "/image1/comments", "/image2/comments"}; !reflect.DeepEqual(h.calls, want) {
+		t.Fatalf("calls: want %v, got %v", want, h.calls)
+	}
+	var c albumComments
+	if err := json.Unmarshal(store.content("album/"+albumCommentsFilename), &c); err != nil {
+		t.Fatalf("cannot decode the comments: %v", err)
+	}
+	want := albumComments{
+		Album:  h.comments["/album/comments"],
+		Images: map[string][]comment{"image1": h.comments["/image1/comments"]},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("want %+v, got %+v", want, c)
+	}
+}
+
+func TestBuildAlbumMetadataPassword(t *testing.T) {
+	a := album{AlbumKey: "album1", Password: "secret", PasswordHint: "hint"}
+
+	w := &Worker{cfg: &Conf{}}
+	if m := w.buildAlbumMetadata(context.Background(), a, nil); m.Password != "" || m.PasswordHint != "hint" {
+		t.Fatalf("want only the password hint, got %q and %q", m.Password, m.PasswordHint)
+	}
+
+	w.cfg.AlbumPassword = true
+	if m := w.buildAlbumMetadata(context.Background(), a, nil); m.Password != "secret" {
+		t.Fatalf("want the password, got %q", m.Password)
+	}
+}
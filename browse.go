@@ -0,0 +1,411 @@
+package smugmug
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSearchResults is the max number of items returned by a search
+const maxSearchResults = 500
+
+// browser serves the content of a backup over HTTP. It exposes HTML pages to browse the albums,
+// a search page and a JSON API
+type browser struct {
+	destination string
+	thumbsDir   string
+	catalog     *catalog
+	tree        *folderNode
+	nodes       map[string]*folderNode
+	items       map[string]*catalogItem // By path
+	tmpl        *template.Template
+	mux         *http.ServeMux
+
+	mu         sync.Mutex
+	thumbLocks map[string]*sync.Mutex // By path, to generate each thumbnail once
+}
+
+// Serve starts a local HTTP server, listening on addr, to browse and search the backup saved in
+// destination. The backup is indexed at startup. Thumbnails are generated on demand and cached
+// in the same folder used by the site command
+func Serve(destination, addr string) error {
+	b, err := newBrowser(destination, filepath.Join(destination, "_site", thumbsFolder))
+	if err != nil {
+		return err
+	}
+	log.Infof("Found %d albums, browse them at http://%s/", len(b.catalog.albums), addr)
+	return http.ListenAndServe(addr, b)
+}
+
+func newBrowser(destination, thumbsDir string) (*browser, error) {
+	c, err := loadCatalog(destination)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the backup in %s: %v", destination, err)
+	}
+
+	tmpl, err := template.New("page").Parse(sitePageTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &browser{
+		destination: destination,
+		thumbsDir:   thumbsDir,
+		catalog:     c,
+		tree:        buildFolderTree(c),
+		nodes:       make(map[string]*folderNode),
+		items:       make(map[string]*catalogItem),
+		tmpl:        tmpl,
+		mux:         http.NewServeMux(),
+		thumbLocks:  make(map[string]*sync.Mutex),
+	}
+
+	var index func(n *folderNode)
+	index = func(n *folderNode) {
+		b.nodes[n.Path] = n
+		for _, c := range n.Children {
+			index(c)
+		}
+	}
+	index(b.tree)
+	for _, a := range c.albums {
+		for _, i := range a.Items {
+			b.items[i.Path()] = i
+		}
+	}
+
+	b.mux.HandleFunc("/", b.handleIndex)
+	b.mux.HandleFunc("/browse/", b.handleBrowse)
+	b.mux.HandleFunc("/search", b.handleSearch)
+	b.mux.HandleFunc("/media/", b.handleMedia)
+	b.mux.HandleFunc("/thumbs/", b.handleThumb)
+	b.mux.HandleFunc("/api/albums", b.handleAPIAlbums)
+	b.mux.HandleFunc("/api/albums/", b.handleAPIAlbum)
+	b.mux.HandleFunc("/api/search", b.handleAPISearch)
+
+	return b, nil
+}
+
+func (b *browser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("%s %s", r.Method, r.URL)
+	b.mux.ServeHTTP(w, r)
+}
+
+func (b *browser) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/browse/", http.StatusFound)
+}
+
+func (b *browser) handleBrowse(w http.ResponseWriter, r *http.Request) {
+	n, ok := b.nodes[strings.Trim(strings.TrimPrefix(r.URL.Path, "/browse/"), "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := sitePage{Title: n.Name, SearchAction: "/search"}
+	for p := path.Dir(n.Path); n.Path != ""; p = path.Dir(p) {
+		if p == "." {
+			p = ""
+		}
+		parent := b.nodes[p]
+		page.Breadcrumbs = append([]siteLink{{Name: parent.Name, Href: browseURL(p)}}, page.Breadcrumbs...)
+		if p == "" {
+			break
+		}
+	}
+
+	for _, c := range n.Children {
+		link := siteLink{Name: c.Name, Href: browseURL(c.Path)}
+		if cover := c.cover(); cover != nil {
+			link.Thumb = thumbURL(cover)
+		}
+		page.Folders = append(page.Folders, link)
+	}
+
+	if n.Album != nil {
+		page.Description = n.Album.Description
+		page.Comments = n.Album.Comments
+		for _, i := range n.Album.Items {
+			page.Items = append(page.Items, b.pageItem(i, false))
+		}
+	}
+
+	b.render(w, page)
+}
+
+func (b *browser) handleSearch(w http.ResponseWriter, r *http.Request) {
+	results, err := b.search(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := sitePage{
+		Title:        fmt.Sprintf("Search: %d results", len(results)),
+		SearchAction: "/search",
+		Query:        r.URL.Query().Get("q"),
+		Breadcrumbs:  []siteLink{{Name: b.tree.Name, Href: browseURL("")}},
+	}
+	for _, i := range results {
+		page.Items = append(page.Items, b.pageItem(i, true))
+	}
+	b.render(w, page)
+}
+
+func (b *browser) handleMedia(w http.ResponseWriter, r *http.Request) {
+	i, ok := b.items[strings.TrimPrefix(r.URL.Path, "/media/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(b.destination, filepath.FromSlash(i.Path())))
+}
+
+func (b *browser) handleThumb(w http.ResponseWriter, r *http.Request) {
+	i, ok := b.items[strings.TrimPrefix(r.URL.Path, "/thumbs/")]
+	if !ok || i.IsVideo {
+		http.NotFound(w, r)
+		return
+	}
+	src := filepath.Join(b.destination, filepath.FromSlash(i.Path()))
+	dest := filepath.Join(b.thumbsDir, filepath.FromSlash(i.Path())+".jpg")
+	if err := b.makeThumbnail(i.Path(), src, dest); err != nil {
+		log.Debugf("Cannot create thumbnail for %s: %v", src, err)
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, dest)
+}
+
+// makeThumbnail creates the thumbnail of the item with the given path. Concurrent requests for the
+// same thumbnail wait for the first one, instead of generating it again
+func (b *browser) makeThumbnail(p, src, dest string) error {
+	b.mu.Lock()
+	l, ok := b.thumbLocks[p]
+	if !ok {
+		l = &sync.Mutex{}
+		b.thumbLocks[p] = l
+	}
+	b.mu.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+	return makeThumbnail(src, dest)
+}
+
+type apiAlbum struct {
+	Path        string    `json:"path"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Keywords    string    `json:"keywords"`
+	Date        time.Time `json:"date"`
+	ItemsCount  int       `json:"items_count"`
+	URL         string    `json:"url"`
+	Items       []apiItem `json:"items,omitempty"`
+	Comments    []comment `json:"comments,omitempty"`
+}
+
+type apiItem struct {
+	Album    string    `json:"album"`
+	ImageKey string    `json:"image_key"`
+	Name     string    `json:"name"`
+	Title    string    `json:"title"`
+	Caption  string    `json:"caption"`
+	Keywords string    `json:"keywords"`
+	Date     time.Time `json:"date"`
+	Size     int64     `json:"size"`
+	IsVideo  bool      `json:"is_video"`
+	URL      string    `json:"url"`
+	Comments []comment `json:"comments,omitempty"`
+}
+
+func (b *browser) handleAPIAlbums(w http.ResponseWriter, r *http.Request) {
+	albums := make([]apiAlbum, 0, len(b.catalog.albums))
+	for _, a := range b.catalog.albums {
+		albums = append(albums, newAPIAlbum(a, false))
+	}
+	writeJSONResponse(w, albums)
+}
+
+func (b *browser) handleAPIAlbum(w http.ResponseWriter, r *http.Request) {
+	n, ok := b.nodes[strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/albums/"), "/")]
+	if !ok || n.Album == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSONResponse(w, newAPIAlbum(n.Album, true))
+}
+
+func (b *browser) handleAPISearch(w http.ResponseWriter, r *http.Request) {
+	results, err := b.search(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := make([]apiItem, 0, len(results))
+	for _, i := range results {
+		items = append(items, newAPIItem(i))
+	}
+	writeJSONResponse(w, items)
+}
+
+// search returns the items matching the query parameters:
+//
+//   - q: words that must all be found in the item name, title, caption or keywords, or in the
+//     album name
+//   - from, to: dates (YYYY-MM-DD) limiting the items date, both inclusive
+func (b *browser) search(query url.Values) ([]*catalogItem, error) {
+	words := strings.Fields(strings.ToLower(query.Get("q")))
+
+	var from, to time.Time
+	var err error
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse("2006-01-02", v); err != nil {
+			return nil, fmt.Errorf("Invalid from date: %v", err)
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse("2006-01-02", v); err != nil {
+			return nil, fmt.Errorf("Invalid to date: %v", err)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+
+	var results []*catalogItem
+	for _, a := range b.catalog.albums {
+		for _, i := range a.Items {
+			if !from.IsZero() && i.Date.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !i.Date.Before(to) {
+				continue
+			}
+			text := strings.ToLower(strings.Join([]string{i.Name, i.Title, i.Caption, i.Keywords, a.Name}, " "))
+			match := true
+			for _, w := range words {
+				if !strings.Contains(text, w) {
+					match = false
+					break
+				}
+			}
+			if match {
+				results = append(results, i)
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Date.Before(results[j].Date) })
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+	return results, nil
+}
+
+func (b *browser) pageItem(i *catalogItem, withAlbum bool) siteItem {
+	item := siteItem{
+		Name:     i.Name,
+		Href:     mediaURL(i),
+		Title:    i.Title,
+		Caption:  i.Caption,
+		IsVideo:  i.IsVideo,
+		Comments: i.Comments,
+	}
+	if !i.Date.IsZero() {
+		item.Date = i.Date.Format("2006-01-02 15:04")
+	}
+	if !i.IsVideo {
+		item.Thumb = thumbURL(i)
+	}
+	if withAlbum {
+		item.Album = &siteLink{Name: i.album.Name, Href: browseURL(i.album.Path)}
+	}
+	return item
+}
+
+func (b *browser) render(w http.ResponseWriter, page sitePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := b.tmpl.Execute(w, page); err != nil {
+		log.WithError(err).Error("Cannot render page")
+	}
+}
+
+func newAPIAlbum(a *catalogAlbum, withItems bool) apiAlbum {
+	res := apiAlbum{
+		Path:        a.Path,
+		Name:        a.Name,
+		Description: a.Description,
+		Keywords:    a.Keywords,
+		Date:        a.Date,
+		ItemsCount:  len(a.Items),
+		URL:         browseURL(a.Path),
+	}
+	if withItems {
+		res.Comments = a.Comments
+		res.Items = make([]apiItem, 0, len(a.Items))
+		for _, i := range a.Items {
+			res.Items = append(res.Items, newAPIItem(i))
+		}
+	}
+	return res
+}
+
+func newAPIItem(i *catalogItem) apiItem {
+	return apiItem{
+		Album:    i.album.Path,
+		ImageKey: i.ImageKey,
+		Name:     i.Name,
+		Title:    i.Title,
+		Caption:  i.Caption,
+		Keywords: i.Keywords,
+		Date:     i.Date,
+		Size:     i.Size,
+		IsVideo:  i.IsVideo,
+		URL:      mediaURL(i),
+		Comments: i.Comments,
+	}
+}
+
+func writeJSONResponse(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		log.WithError(err).Error("Cannot encode response")
+	}
+}
+
+func browseURL(p string) string {
+	if p == "" || p == "." {
+		return "/browse/"
+	}
+	return "/browse/" + escapePath(p) + "/"
+}
+
+func mediaURL(i *catalogItem) string {
+	return "/media/" + escapePath(i.Path())
+}
+
+func thumbURL(i *catalogItem) string {
+	return "/thumbs/" + escapePath(i.Path())
+}
+
+// escapePath escapes each element of a slash separated path to be used in a URL
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
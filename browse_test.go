@@ -0,0 +1,150 @@
+package smugmug
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestBrowser(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	albumDir := filepath.Join(dest, "Folder", "My Album")
+
+	writeTestImage(t, filepath.Join(albumDir, "a.png"), 400, 400)
+	writeTestImage(t, filepath.Join(albumDir, "b.png"), 10, 10)
+	err := writeJSON(newLocalStorage(dest), "Folder/My Album/"+albumMetadataFilename, albumMetadata{
+		Name: "Holidays",
+		Images: []albumImageMetadata{
+			{ImageKey: "keyA", LocalName: "a.png", Title: "Beach", Caption: "Sunset at the beach", DateTimeOriginal: "2019-08-01T20:00:00Z"},
+			{ImageKey: "keyB", LocalName: "b.png", Keywords: "mountain; snow", DateTimeOriginal: "2020-01-10T10:00:00Z"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumbsDir := t.TempDir()
+	b, err := newBrowser(dest, thumbsDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	get := func(url string, wantStatus int) []byte {
+		t.Helper()
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s: want status %d, got %d", url, wantStatus, resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	page := get("/browse/Folder/My%20Album/", http.StatusOK)
+	if !strings.Contains(string(page), "Sunset at the beach") {
+		t.Fatalf("album page doesn't contain the caption:\n%s", page)
+	}
+
+	get("/media/Folder/My%20Album/a.png", http.StatusOK)
+	get("/thumbs/Folder/My%20Album/a.png", http.StatusOK)
+	get("/media/Folder/My%20Album/album.json", http.StatusNotFound)
+
+	// Concurrent requests for a missing thumbnail
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/thumbs/Folder/My%20Album/b.png")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("want status 200, got %d", resp.StatusCode)
+				return
+			}
+			if _, err := jpeg.Decode(resp.Body); err != nil {
+				errs <- fmt.Errorf("invalid thumbnail: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(thumbsDir, "Folder", "My Album"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("want the 2 thumbnails only, got %d files", len(files))
+	}
+	get("/browse/unknown/", http.StatusNotFound)
+
+	var albums []apiAlbum
+	if err := json.Unmarshal(get("/api/albums", http.StatusOK), &albums); err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 || albums[0].Name != "Holidays" || albums[0].ItemsCount != 2 {
+		t.Fatalf("unexpected albums %+v", albums)
+	}
+
+	var album apiAlbum
+	if err := json.Unmarshal(get("/api/albums/Folder/My%20Album", http.StatusOK), &album); err != nil {
+		t.Fatal(err)
+	}
+	if len(album.Items) != 2 || album.Items[0].ImageKey != "keyA" {
+		t.Fatalf("unexpected album %+v", album)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"q=beach", []string{"keyA"}},
+		{"q=SNOW+mountain", []string{"keyB"}},
+		{"q=holidays", []string{"keyA", "keyB"}},
+		{"from=2020-01-01", []string{"keyB"}},
+		{"to=2019-08-01", []string{"keyA"}},
+		{"q=beach&from=2020-01-01", nil},
+	}
+	for _, tt := range tests {
+		var items []apiItem
+		if err := json.Unmarshal(get("/api/search?"+tt.query, http.StatusOK), &items); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != len(tt.want) {
+			t.Fatalf("%s: want %v, got %+v", tt.query, tt.want, items)
+		}
+		for i := range tt.want {
+			if items[i].ImageKey != tt.want[i] {
+				t.Fatalf("%s: want %v, got %+v", tt.query, tt.want, items)
+			}
+		}
+	}
+
+	get("/api/search?from=yesterday", http.StatusBadRequest)
+}
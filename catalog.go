@@ -0,0 +1,252 @@
+package smugmug
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true,
+	".tif": true, ".tiff": true, ".heic": true, ".dng": true, ".cr2": true, ".nef": true, ".arw": true,
+}
+
+var videoExtensions = map[string]bool{
+	".mp4": true, ".mov": true, ".m4v": true, ".avi": true, ".mkv": true, ".webm": true, ".mts": true,
+}
+
+// catalog is an index of the content of a backup. It's built reading the destination folder and
+// the album.json and comments.json files saved with the albums
+type catalog struct {
+	root   string
+	albums []*catalogAlbum // Sorted by path
+}
+
+type catalogAlbum struct {
+	Path        string // Slash separated, relative to the backup root
+	Name        string
+	Description string
+	Keywords    string
+	Date        time.Time
+	Cover       *catalogItem
+	Comments    []comment
+	Items       []*catalogItem
+}
+
+type catalogItem struct {
+	album *catalogAlbum
+
+	ImageKey string
+	Name     string // Name of the file in the album folder
+	Title    string
+	Caption  string
+	Keywords string
+	Date     time.Time
+	Size     int64
+	IsVideo  bool
+	Comments []comment
+}
+
+// Path returns the slash separated path of the file, relative to the backup root
+func (i *catalogItem) Path() string {
+	return path.Join(i.album.Path, i.Name)
+}
+
+// isMediaFile tells if the given file name has an image or video extension
+func isMediaFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return imageExtensions[ext] || videoExtensions[ext]
+}
+
+func isVideoFile(name string) bool {
+	return videoExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// skipBackupDir tells if a folder in the backup root isn't part of the albums tree (e.g. the
+// generated site or the internal folders)
+func skipBackupDir(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// loadCatalog walks the backup destination building the catalog of its albums. Folders with an
+// album.json file use it to get the album metadata and the images order, other folders
+// containing images or videos are added using the file names only
+func loadCatalog(root string) (*catalog, error) {
+	c := &catalog{root: root}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p != root && skipBackupDir(info.Name()) {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		a, err := loadCatalogAlbum(p, filepath.ToSlash(rel))
+		if err != nil {
+			log.WithError(err).Warnf("Cannot read album in %s", p)
+			return nil
+		}
+		if a != nil {
+			c.albums = append(c.albums, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(c.albums, func(i, j int) bool { return c.albums[i].Path < c.albums[j].Path })
+	return c, nil
+}
+
+// loadCatalogAlbum reads the album in the given folder. It returns nil if the folder doesn't
+// contain any album
+func loadCatalogAlbum(dir, relPath string) (*catalogAlbum, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	onDisk := make(map[string]os.FileInfo)
+	for _, f := range files {
+		if f.Mode()&os.ModeSymlink != 0 {
+			// Deduplicated backups link the blobs
+			if f, err = os.Stat(filepath.Join(dir, f.Name())); err != nil {
+				log.WithError(err).Warnf("Broken link in %s", dir)
+				continue
+			}
+		}
+		if !f.IsDir() && isMediaFile(f.Name()) {
+			onDisk[f.Name()] = f
+		}
+	}
+
+	a := &catalogAlbum{
+		Path: relPath,
+		Name: path.Base(relPath),
+	}
+
+	var meta albumMetadata
+	hasMeta, err := readJSONFile(filepath.Join(dir, albumMetadataFilename), &meta)
+	if err != nil {
+		return nil, err
+	}
+	if !hasMeta && len(onDisk) == 0 {
+		return nil, nil
+	}
+
+	var coverKey string
+	if hasMeta {
+		if meta.Name != "" {
+			a.Name = meta.Name
+		}
+		a.Description = meta.Description
+		a.Keywords = meta.Keywords
+		a.Date = parseTime(meta.Date)
+		coverKey = meta.HighlightImage
+
+		for _, m := range meta.Images {
+			fi, ok := onDisk[m.LocalName]
+			if !ok {
+				continue
+			}
+			delete(onDisk, m.LocalName)
+			item := &catalogItem{
+				album:    a,
+				ImageKey: m.ImageKey,
+				Name:     m.LocalName,
+				Title:    m.Title,
+				Caption:  m.Caption,
+				Keywords: m.Keywords,
+				Date:     parseTime(m.DateTimeOriginal),
+				Size:     fi.Size(),
+				IsVideo:  m.IsVideo || isVideoFile(m.LocalName),
+			}
+			if item.Date.IsZero() {
+				item.Date = fi.ModTime()
+			}
+			a.Items = append(a.Items, item)
+		}
+	}
+
+	// Files without metadata are appended, sorted by name
+	var others []string
+	for name := range onDisk {
+		others = append(others, name)
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		fi := onDisk[name]
+		a.Items = append(a.Items, &catalogItem{
+			album:   a,
+			Name:    name,
+			Date:    fi.ModTime(),
+			Size:    fi.Size(),
+			IsVideo: isVideoFile(name),
+		})
+	}
+
+	var comments albumComments
+	if _, err := readJSONFile(filepath.Join(dir, albumCommentsFilename), &comments); err != nil {
+		return nil, err
+	}
+	a.Comments = comments.Album
+
+	for _, item := range a.Items {
+		item.Comments = comments.Images[item.ImageKey]
+		if coverKey != "" && item.ImageKey == coverKey {
+			a.Cover = item
+		}
+	}
+	if a.Cover == nil {
+		for _, item := range a.Items {
+			if !item.IsVideo {
+				a.Cover = item
+				break
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// readJSONFile decodes the JSON file at the given path in obj. It returns false if the file
+// doesn't exist
+func readJSONFile(path string, obj interface{}) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, obj); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// parseTime parses a RFC3339 date as returned by the SmugMug API, returning the zero time if
+// it's empty or invalid
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
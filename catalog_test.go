@@ -0,0 +1,100 @@
+package smugmug
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestImage creates a PNG image of the given size at the given path
+func writeTestImage(t *testing.T, p string, w, h int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, h/2, color.RGBA{255, 0, 0, 255})
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	dest := t.TempDir()
+	albumDir := filepath.Join(dest, "Folder", "Album")
+
+	writeTestImage(t, filepath.Join(albumDir, "b.png"), 10, 10)
+	writeTestImage(t, filepath.Join(albumDir, "a.png"), 10, 10)
+	writeTestImage(t, filepath.Join(albumDir, "extra.png"), 10, 10)
+	writeTestImage(t, filepath.Join(dest, "Other", "c.png"), 10, 10)
+	writeTestImage(t, filepath.Join(dest, "_site", "ignored.png"), 10, 10)
+
+	err := writeJSON(newLocalStorage(dest), "Folder/Album/"+albumMetadataFilename, albumMetadata{
+		Name:           "My Album",
+		HighlightImage: "keyA",
+		Images: []albumImageMetadata{
+			{ImageKey: "keyB", LocalName: "b.png", Caption: "caption b", DateTimeOriginal: "2020-01-02T03:04:05Z"},
+			{ImageKey: "keyA", LocalName: "a.png", Caption: "caption a"},
+			{ImageKey: "keyMissing", LocalName: "missing.png"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeJSON(newLocalStorage(dest), "Folder/Album/"+albumCommentsFilename, albumComments{
+		Images: map[string][]comment{"keyA": {{Name: "author", Text: "nice"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadCatalog(dest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(c.albums) != 2 {
+		t.Fatalf("albums: want 2, got %d", len(c.albums))
+	}
+
+	a := c.albums[0]
+	if a.Path != "Folder/Album" || a.Name != "My Album" {
+		t.Fatalf("unexpected album %s (%s)", a.Path, a.Name)
+	}
+	var names []string
+	for _, i := range a.Items {
+		names = append(names, i.Name)
+	}
+	want := []string{"b.png", "a.png", "extra.png"}
+	if len(names) != len(want) {
+		t.Fatalf("items: want %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("items: want %v, got %v", want, names)
+		}
+	}
+	if a.Items[0].Date.Year() != 2020 {
+		t.Fatalf("unexpected date %v", a.Items[0].Date)
+	}
+	if a.Cover == nil || a.Cover.ImageKey != "keyA" {
+		t.Fatalf("unexpected cover %+v", a.Cover)
+	}
+	if len(a.Items[1].Comments) != 1 {
+		t.Fatalf("comments: want 1, got %d", len(a.Items[1].Comments))
+	}
+
+	if c.albums[1].Path != "Other" || c.albums[1].Name != "Other" {
+		t.Fatalf("unexpected album %s (%s)", c.albums[1].Path, c.albums[1].Name)
+	}
+}
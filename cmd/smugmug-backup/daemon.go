@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// daemon runs the backups on the configured schedule, reloading the configuration on SIGHUP
+func daemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	d, err := smugmug.NewDaemon(cfg)
+	if err != nil {
+		log.WithError(err).Fatal("Can't start the daemon")
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	serveMetrics(ctx, cfg)
+	if err := d.Run(ctx, reload); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// decrypt decrypts a single file of an encrypted backup
+func decrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	out := fs.String("out", "", "output file, \"-\" for stdout (default the file name in the current folder)")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("Usage: smugmug-backup decrypt [-out file] <path in the backup>\n"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	if *out == "" {
+		*out = path.Base(name)
+	}
+	f := os.Stdout
+	if *out != "-" {
+		if f, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := smugmug.Decrypt(cfg, name, f); err != nil {
+		if f != os.Stdout {
+			f.Close()
+			os.Remove(*out)
+		}
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// gc removes the unreferenced blobs of a deduplicated backup
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list the unreferenced blobs without removing them")
+	fs.Parse(args)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	stats, err := smugmug.GC(cfg.Destination, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	log.Infof("%s %d of %d blobs, %s", verb, stats.Removed, stats.Blobs, smugmug.FormatSize(stats.Freed))
+}
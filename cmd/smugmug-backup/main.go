@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/tommyblue/smugmug-backup"
@@ -13,37 +17,173 @@ import (
 var version = "-- unknown --"
 var flagVersion = flag.Bool("version", false, "print version number")
 
-func init() {
-	log.SetFormatter(&log.TextFormatter{})
-	log.SetOutput(os.Stdout)
+var (
+	flagLogFormat   = flag.String("log-format", "text", "format of the logs: \"text\" or \"json\"")
+	flagLogLevel    = flag.String("log-level", "", "minimum level of the logs: \"debug\", \"info\", \"warn\" or \"error\" (default \"info\", \"debug\" with DEBUG=1)")
+	flagLogFile     = flag.String("log-file", "", "write the logs to the given file instead of the standard output")
+	flagLogMaxSize  = flag.Int64("log-max-size", 100, "size in MiB after which the log file is rotated, 0 to never rotate it")
+	flagLogMaxFiles = flag.Int("log-max-files", 5, "number of rotated log files kept")
+)
+
+// command is a subcommand of the program. The run function receives the command line arguments
+// following the command name
+type command struct {
+	description string
+	run         func(args []string)
+}
+
+var commands = map[string]command{
+	"backup":       {"Backup the SmugMug account (default command)", backup},
+	"daemon":       {"Run the backup on the configured schedule", daemon},
+	"decrypt":      {"Decrypt a file of an encrypted backup", decrypt},
+	"gc":           {"Remove the blobs of a deduplicated backup not used by any album", gc},
+	"restore":      {"Decrypt an encrypted backup to a local folder", restore},
+	"retry-failed": {"Save again the albums and files that failed in the previous runs", retryFailed},
+	"serve":        {"Start a local web UI to browse and search the backup", serve},
+	"site":         {"Generate a static HTML gallery of the backup", site},
+	"snapshots":    {"List the snapshots of the backup or remove the old ones", snapshots},
+	"status":       {"Show the status of the last backup run by the daemon", status},
+}
+
+// setupLogs configures the format, the level and the output of the logs from the flags
+func setupLogs() error {
+	switch *flagLogFormat {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %q", *flagLogFormat)
+	}
 
-	flag, isPresent := os.LookupEnv("DEBUG")
-	if isPresent && flag == "1" {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	level := *flagLogLevel
+	if level == "" {
+		level = "info"
+		if flag, isPresent := os.LookupEnv("DEBUG"); isPresent && flag == "1" {
+			level = "debug"
+		}
+	}
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(lvl)
+
+	log.SetOutput(os.Stdout)
+	if *flagLogFile != "" {
+		f, err := smugmug.OpenLogFile(*flagLogFile, *flagLogMaxSize*1024*1024, *flagLogMaxFiles)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command] [command flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-12s %s\n", name, commands[name].description)
 	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	if *flagVersion {
 		fmt.Printf("Version: %s\n", version)
 		return
 	}
+	if err := setupLogs(); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%v\n\n", err)
+		usage()
+		os.Exit(2)
+	}
+
+	name := "backup"
+	var args []string
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+		args = flag.Args()[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(args)
+}
+
+// backup performs the backup of the SmugMug account
+func backup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.Parse(args)
 
 	cfg, err := smugmug.ReadConf()
 	if err != nil {
 		log.WithError(err).Fatal("Configuration error")
 	}
+	if cfg.Report.Enabled() && cfg.Report.Stdout && *flagLogFile == "" {
+		// Keep stdout for the report
+		log.SetOutput(os.Stderr)
+	}
 
 	wrk, err := smugmug.New(cfg)
 	if err != nil {
 		log.WithError(err).Fatal("Can't initialize the package")
 	}
 
-	if err := wrk.Run(); err != nil {
+	ctx, cancel := interruptContext()
+	defer cancel()
+	serveMetrics(ctx, cfg)
+	if err := wrk.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// serveMetrics starts the metrics listener in the background, if configured, until the context is
+// canceled
+func serveMetrics(ctx context.Context, cfg *smugmug.Conf) {
+	if cfg.Metrics.Listen == "" {
+		return
+	}
+	go func() {
+		if err := smugmug.ServeMetrics(ctx, cfg.Metrics.Listen); err != nil {
+			log.Error(err)
+		}
+	}()
+}
+
+// interruptContext returns a context canceled on SIGINT or SIGTERM, so that the running
+// command can stop cleanly. A second signal exits immediately
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Warnf("Received %s, stopping after cleaning up (send it again to exit immediately)", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		if _, ok := <-sigs; ok {
+			log.Error("Exiting immediately")
+			os.Exit(1)
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// restore decrypts an encrypted backup, or one of its folders, to a local folder
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	out := fs.String("out", "", "output folder (required)")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("Usage: smugmug-backup restore -out folder [folder in the backup]\n"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *out == "" || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	if err := smugmug.Restore(cfg, fs.Arg(0), *out); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// retryFailed saves again the albums and files that failed in the previous runs
+func retryFailed(args []string) {
+	fs := flag.NewFlagSet("retry-failed", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	wrk, err := smugmug.New(cfg)
+	if err != nil {
+		log.WithError(err).Fatal("Can't initialize the package")
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	serveMetrics(ctx, cfg)
+	if err := wrk.RetryFailed(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// serve starts the local web UI to browse and search the backup
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "address the HTTP server listens on")
+	fs.Parse(args)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	root, err := cfg.BackupFolder()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := smugmug.Serve(root, *addr); err != nil {
+		log.Fatal(err)
+	}
+}
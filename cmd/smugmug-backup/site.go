@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// site generates the static HTML gallery of the backup
+func site(args []string) {
+	fs := flag.NewFlagSet("site", flag.ExitOnError)
+	out := fs.String("out", "", "output folder of the site (default <destination>/_site)")
+	fs.Parse(args)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	if *out == "" {
+		*out = filepath.Join(cfg.Destination, "_site")
+	}
+
+	root, err := cfg.BackupFolder()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := smugmug.GenerateSite(root, *out); err != nil {
+		log.Fatal(err)
+	}
+}
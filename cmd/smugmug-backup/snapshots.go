@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// snapshots lists or prunes the snapshots of the backup
+func snapshots(args []string) {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "with prune, list the snapshots to remove without removing them")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("Usage: smugmug-backup snapshots [-dry-run] list|prune\n"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || (fs.Arg(0) != "list" && fs.Arg(0) != "prune") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	if fs.Arg(0) == "list" {
+		list, err := smugmug.Snapshots(cfg.Destination)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range list {
+			fmt.Printf("%s  %s\n", s.Name, s.Time.Local().Format("2006-01-02 15:04:05"))
+		}
+		return
+	}
+
+	removed, err := smugmug.PruneSnapshots(cfg.Destination, cfg.Snapshots, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, s := range removed {
+		fmt.Printf("%s %s\n", verb, s.Name)
+	}
+	log.Infof("%s %d snapshots", verb, len(removed))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup"
+)
+
+// status prints the status of the last backup run by the daemon
+func status(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg, err := smugmug.ReadConf()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+
+	s, err := smugmug.LastRunStatus(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	const layout = "2006-01-02 15:04:05"
+	result := "completed"
+	if s.Error != "" {
+		result = "failed: " + s.Error
+	}
+	fmt.Printf("Last run:  %s - %s (%s)\n", s.Start.Local().Format(layout), s.End.Local().Format(layout), s.End.Sub(s.Start).Round(time.Second))
+	fmt.Printf("Result:    %s\n", result)
+	fmt.Printf("Albums:    %d of %d completed\n", s.AlbumsDone, s.Albums)
+	fmt.Printf("Files:     %d downloaded, %d already saved, %d deferred, %d failed\n", s.FilesDownloaded, s.FilesSkipped, s.FilesDeferred, s.FilesFailed)
+	if !s.NextRun.IsZero() {
+		fmt.Printf("Next run:  %s\n", s.NextRun.Local().Format(layout))
+	}
+}
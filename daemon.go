@@ -0,0 +1,221 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statusFilename is the name of the file with the status of the last run
+const statusFilename = ".smugmug-backup.status.json"
+
+// DaemonConf is the configuration of the daemon mode
+type DaemonConf struct {
+	Schedule   string // Cron expression of the runs, like "0 3 * * *", "@daily" or "@every 6h"
+	RunOnStart bool   // When true, a backup is run when the daemon starts
+}
+
+// RunStatus is the status of a backup run
+type RunStatus struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	Error           string    `json:"error,omitempty"`
+	Albums          int       `json:"albums"`
+	AlbumsDone      int       `json:"albums_done"`
+	FilesDownloaded int       `json:"files_downloaded"`
+	FilesSkipped    int       `json:"files_skipped"`
+	FilesDeferred   int       `json:"files_deferred"`
+	FilesFailed     int       `json:"files_failed"`
+	NextRun         time.Time `json:"next_run"`
+}
+
+// statusPath returns the path of the status file
+func (cfg *Conf) statusPath() string {
+	return filepath.Join(cfg.stateFolder(), statusFilename)
+}
+
+// LastRunStatus returns the status of the last run of the daemon
+func LastRunStatus(cfg *Conf) (*RunStatus, error) {
+	b, err := ioutil.ReadFile(cfg.statusPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("No backup has been run by the daemon yet")
+		}
+		return nil, fmt.Errorf("Cannot read the status: %v", err)
+	}
+	var s RunStatus
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("Cannot read the status: %v", err)
+	}
+	return &s, nil
+}
+
+// writeStatus saves the status to the given path, replacing the previous one
+func writeStatus(path string, s *RunStatus) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode the status: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("Cannot write the status: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Cannot write the status: %v", err)
+	}
+	return nil
+}
+
+// runBackup runs a backup with the given configuration
+func runBackup(ctx context.Context, cfg *Conf) *RunStatus {
+	status := &RunStatus{Start: time.Now()}
+	err := func() error {
+		wrk, err := New(cfg)
+		if err != nil {
+			return err
+		}
+		err = wrk.Run(ctx)
+		wrk.fillStatus(status)
+		return err
+	}()
+	status.End = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Daemon runs the backups on the configured schedule
+type Daemon struct {
+	cfg      *Conf
+	schedule schedule
+	status   *RunStatus // Status of the last run, nil before the first one
+
+	readConf func() (*Conf, error)                   // ReadConf, replaced by tests
+	backup   func(context.Context, *Conf) *RunStatus // runBackup, replaced by tests
+	now      func() time.Time                        // time.Now, replaced by tests
+	after    func(time.Duration) <-chan time.Time    // time.After, replaced by tests
+}
+
+// NewDaemon returns a Daemon running the backups with the given configuration
+func NewDaemon(cfg *Conf) (*Daemon, error) {
+	d := &Daemon{
+		readConf: ReadConf,
+		backup:   runBackup,
+		now:      time.Now,
+		after:    time.After,
+	}
+	if err := d.setConf(cfg); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// setConf validates the configuration and its schedule, and makes it the current one
+func (d *Daemon) setConf(cfg *Conf) error {
+	if cfg.Daemon.Schedule == "" {
+		return errors.New("daemon.schedule can't be empty")
+	}
+	sched, err := parseSchedule(cfg.Daemon.Schedule)
+	if err != nil {
+		return err
+	}
+	if sched.next(time.Now()).IsZero() {
+		return fmt.Errorf("The schedule %q never runs", cfg.Daemon.Schedule)
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	d.cfg = cfg
+	d.schedule = sched
+	return nil
+}
+
+// reload reads the configuration again. If it isn't valid, the current one is kept
+func (d *Daemon) reload() {
+	log.Info("Reloading the configuration")
+	cfg, err := d.readConf()
+	if err == nil {
+		err = d.setConf(cfg)
+	}
+	if err != nil {
+		log.WithError(err).Error("Cannot reload the configuration, keeping the current one")
+		return
+	}
+	log.Infof("Configuration reloaded, schedule %q", cfg.Daemon.Schedule)
+}
+
+// saveStatus writes the status of the last run, with the time of the next one
+func (d *Daemon) saveStatus(next time.Time) {
+	if d.status == nil {
+		return
+	}
+	d.status.NextRun = next
+	if err := writeStatus(d.cfg.statusPath(), d.status); err != nil {
+		log.WithError(err).Error("Cannot save the status of the last run")
+	}
+}
+
+// runOnce runs a backup, saving and logging its result
+func (d *Daemon) runOnce(ctx context.Context) {
+	log.Info("Starting the scheduled backup")
+	d.status = d.backup(ctx, d.cfg)
+	d.saveStatus(time.Time{})
+	entry := log.WithField(fieldDuration, d.status.End.Sub(d.status.Start).Round(time.Second).Seconds())
+	if d.status.Error != "" {
+		entry.Errorf("Backup failed: %s", d.status.Error)
+		return
+	}
+	entry.Info("Backup completed")
+}
+
+// Run runs the backups on schedule until the context is canceled. A value received from the
+// reload channel reloads the configuration, as done on SIGHUP. A reload requested during a backup
+// is applied when it completes
+func (d *Daemon) Run(ctx context.Context, reload <-chan os.Signal) error {
+	log.Infof("Daemon started, schedule %q", d.cfg.Daemon.Schedule)
+	if d.cfg.Daemon.RunOnStart {
+		d.runOnce(ctx)
+	}
+	for ctx.Err() == nil {
+		next := d.schedule.next(d.now())
+		d.saveStatus(next)
+		log.Infof("Next backup at %s", next.Format(time.RFC1123))
+		if d.wait(ctx, next, reload) {
+			d.runOnce(ctx)
+		}
+	}
+	log.Info("Daemon stopped")
+	return nil
+}
+
+// wait waits until the given time. The clock is checked at least every minute, so that a
+// suspension of the system doesn't delay the run. It returns false if the context is canceled or
+// the configuration is reloaded before
+func (d *Daemon) wait(ctx context.Context, next time.Time, reload <-chan os.Signal) bool {
+	for {
+		wait := next.Sub(d.now())
+		if wait <= 0 {
+			return true
+		}
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-reload:
+			d.reload()
+			return false
+		case <-d.after(wait):
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package smugmug
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func testDaemonConf(t *testing.T, schedule string) *Conf {
+	return &Conf{
+		ApiKey:      "key",
+		ApiSecret:   "secret",
+		UserToken:   "token",
+		UserSecret:  "secret",
+		Destination: t.TempDir(),
+		Daemon:      DaemonConf{Schedule: schedule},
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	cfg := testDaemonConf(t, "0 3 * * *")
+	d, err := NewDaemon(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Fake clock, moved forward by the waits
+	now := time.Date(2021, 6, 15, 10, 0, 0, 0, time.Local)
+	d.now = func() time.Time { return now }
+	d.after = func(wait time.Duration) <-chan time.Time {
+		if wait > time.Minute {
+			t.Fatalf("waiting more than a minute: %v", wait)
+		}
+		now = now.Add(wait)
+		c := make(chan time.Time, 1)
+		c <- now
+		return c
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var runs []time.Time
+	d.backup = func(_ context.Context, c *Conf) *RunStatus {
+		runs = append(runs, now)
+		if len(runs) == 2 {
+			// The status of the first run has been saved with the time of the next one
+			if s, err := LastRunStatus(c); err != nil || s.Error != "" || !s.NextRun.Equal(now) {
+				t.Fatalf("unexpected status %+v (%v)", s, err)
+			}
+		}
+		status := &RunStatus{Start: now, End: now.Add(time.Hour), Albums: 2, AlbumsDone: 2}
+		if len(runs) == 2 {
+			status.Error = "network error"
+			cancel()
+		}
+		return status
+	}
+	if err := d.Run(ctx, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []time.Time{
+		time.Date(2021, 6, 16, 3, 0, 0, 0, time.Local),
+		time.Date(2021, 6, 17, 3, 0, 0, 0, time.Local),
+	}
+	if len(runs) != 2 || !runs[0].Equal(want[0]) || !runs[1].Equal(want[1]) {
+		t.Fatalf("want runs at %v, got %v", want, runs)
+	}
+
+	s, err := LastRunStatus(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.AlbumsDone != 2 || s.Error != "network error" || !s.NextRun.IsZero() {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	cfg := testDaemonConf(t, "@daily")
+	d, err := NewDaemon(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	newCfg := testDaemonConf(t, "@every 2h")
+	d.readConf = func() (*Conf, error) { return newCfg, nil }
+	d.reload()
+	if d.cfg != newCfg {
+		t.Fatalf("configuration not reloaded")
+	}
+	if _, ok := d.schedule.(everySchedule); !ok {
+		t.Fatalf("schedule not reloaded: %#v", d.schedule)
+	}
+
+	// Invalid configurations are ignored
+	for _, read := range []func() (*Conf, error){
+		func() (*Conf, error) { return nil, errors.New("syntax error") },
+		func() (*Conf, error) { return testDaemonConf(t, "* *"), nil },
+		func() (*Conf, error) { return &Conf{Daemon: DaemonConf{Schedule: "@daily"}}, nil },
+	} {
+		d.readConf = read
+		d.reload()
+		if d.cfg != newCfg {
+			t.Fatalf("invalid configuration loaded")
+		}
+	}
+
+	// A reload signal stops the wait
+	reload := make(chan os.Signal, 1)
+	reload <- os.Interrupt
+	if d.wait(context.Background(), time.Now().Add(time.Hour), reload) {
+		t.Fatalf("want wait interrupted by the reload")
+	}
+
+	if _, err := NewDaemon(testDaemonConf(t, "")); err == nil {
+		t.Fatalf("want error without schedule, got nil")
+	}
+}
+
+func TestRunBackupLocked(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	cfg := testDaemonConf(t, "@daily")
+	lock, err := acquireLock(cfg.lockPath())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lock.release()
+	s := runBackup(context.Background(), cfg)
+	if !strings.Contains(s.Error, "Another backup is running") {
+		t.Fatalf("want locked error, got %q", s.Error)
+	}
+}
@@ -14,6 +14,8 @@
 		package main
 
 		import (
+			"context"
+
 			log "github.com/sirupsen/logrus"
 			"github.com/tommyblue/smugmug-backup"
 		)
@@ -29,7 +31,7 @@
 				log.WithError(err).Fatal("Can't initialize the package")
 			}
 
-			if err := wrk.Run(); err != nil {
+			if err := wrk.Run(context.Background()); err != nil {
 				log.Fatal(err)
 			}
 		}
@@ -48,6 +50,85 @@
 		[store]
 		destination = "<Backup destination folder>"
 		file_names = "{{.FileName}}"
+		use_metadata_times = false
+		force_metadata_times = false
+		album_metadata = false
+		album_password = false
+		comments = false
+		backend = "local"
+		backends = []
+		archive = ""
+		archive_per = "album"
+		dedup = ""
+		preflight = ""
+		max_bytes = 0
+		lock_wait = "0s"
+		processing_wait = "0s"
+
+		[s3]
+		endpoint = "<S3 endpoint URL>"
+		region = "<Bucket region>"
+		bucket = "<Bucket name>"
+		prefix = "<Optional prefix of all keys>"
+		access_key = "<Access key ID>"
+		secret_key = "<Secret access key>"
+		path_style = false
+
+		[sftp]
+		host = "<Server host>"
+		port = 22
+		user = "<SSH user>"
+		key_file = "<Path of the private key>"
+		known_hosts = "<Path of the known_hosts file>"
+		root = "<Remote backup folder>"
+
+		[webdav]
+		url = "<URL of the WebDAV backup folder>"
+		user = "<WebDAV user>"
+		password = "<WebDAV password>"
+		set_mtime = false
+
+		[encryption]
+		key_file = "<Path of the encryption key file>"
+		passphrase = "<Passphrase, if key_file is empty>"
+		encrypt_names = false
+
+		[snapshots]
+		enabled = false
+		keep_daily = 0
+		keep_weekly = 0
+		keep_monthly = 0
+
+		[versions]
+		enabled = false
+		max_per_file = 0
+		max_bytes = 0
+
+		[report]
+		formats = []
+		destination = true
+		stdout = false
+
+		[daemon]
+		schedule = "<Cron expression of the daemon runs, like 0 3 * * *>"
+		run_on_start = false
+
+		[metrics]
+		listen = ""
+		textfile = ""
+
+		[notify]
+		webhook_url = ""
+		ping_url = ""
+		only_failures = false
+
+		[notify.smtp]
+		host = ""
+		port = 587
+		username = ""
+		password = ""
+		from = ""
+		to = []
 
 	All values can be overridden by environment variables, that have the following names:
 
@@ -58,6 +139,11 @@
 		SMGMG_BK_USER_SECRET = "<User Secret>"
 		SMGMG_BK_DESTINATION = "<Backup destination folder>"
 		SMGMG_BK_FILE_NAMES = "<Backup destination folder>"
+		SMGMG_BK_S3_ACCESS_KEY = "<S3 access key ID>"
+		SMGMG_BK_S3_SECRET_KEY = "<S3 secret access key>"
+		SMGMG_BK_WEBDAV_PASSWORD = "<WebDAV password>"
+		SMGMG_BK_ENCRYPTION_PASSPHRASE = "<Encryption passphrase>"
+		SMGMG_BK_SMTP_PASSWORD = "<SMTP password>"
 
 	All configuration values are required. They can be omitted in the configuration file
 	as long as they are overridden by environment values.
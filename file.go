@@ -2,28 +2,17 @@ package smugmug
 
 import (
 	"errors"
-	"fmt"
 	"os"
 	"path/filepath"
-
-	log "github.com/sirupsen/logrus"
 )
 
-func createFolder(path string) error {
-	_, err := os.Stat(path)
-
-	// Folder exists
-	if err == nil {
-		return nil
-	}
+// albumMetadataFilename is the name of the file, saved in each album folder, containing the
+// album metadata
+const albumMetadataFilename = "album.json"
 
-	log.Infof("Creating folder %s\n", path)
-	if err := os.MkdirAll(path, os.ModePerm); err != nil {
-		return fmt.Errorf("Cannot create folder: %v", err)
-	}
-
-	return nil
-}
+// albumCommentsFilename is the name of the file, saved in each album folder, containing the
+// comments of the album and of its images
+const albumCommentsFilename = "comments.json"
 
 func checkDestFolder(folderPath string) error {
 	if !filepath.IsAbs(folderPath) {
@@ -41,11 +30,3 @@ func checkDestFolder(folderPath string) error {
 
 	return nil
 }
-
-func sameFileSizes(path string, fileSize int64) bool {
-	fi, err := os.Stat(path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return fi.Size() == fileSize
-}
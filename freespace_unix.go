@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package smugmug
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to the user in the filesystem of the given path
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package smugmug
+
+import "errors"
+
+// freeSpace returns the number of bytes available to the user in the filesystem of the given
+// path. It isn't supported on Windows
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("Checking the free space is not supported on Windows")
+}
@@ -3,8 +3,12 @@ module github.com/tommyblue/smugmug-backup
 go 1.15
 
 require (
+	github.com/klauspost/compress v1.13.6
+	github.com/pkg/sftp v1.13.4
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.9.0
-	golang.org/x/sys v0.0.0-20211004093028-2c5d950f24ef // indirect
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
+	golang.org/x/sys v0.0.0-20211004093028-2c5d950f24ef
 	golang.org/x/text v0.3.7 // indirect
 )
@@ -1,12 +1,13 @@
 package smugmug
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -22,70 +23,73 @@ type header struct {
 }
 
 type handler struct {
-	oauth *oauthConf
+	oauth    *oauthConf
+	store    Storage
+	progress *progress // Counts the downloaded bytes, can be nil
 }
 
-func newHTTPHandler(apiKey, apiSecret, userToken, userSecret string) *handler {
+func newHTTPHandler(apiKey, apiSecret, userToken, userSecret string, store Storage) *handler {
 	return &handler{
 		oauth: newOauthConf(apiKey, apiSecret, userToken, userSecret),
+		store: store,
 	}
 }
 
 // get calls getJSON with the given url
-func (s *handler) get(url string, obj interface{}) error {
+func (s *handler) get(ctx context.Context, url string, obj interface{}) error {
 	if url == "" {
 		return errors.New("Can't get empty url")
 	}
-	return s.getJSON(fmt.Sprintf("%s%s", baseAPIURL, url), obj)
+	return s.getJSON(ctx, fmt.Sprintf("%s%s", baseAPIURL, url), obj)
 }
 
-// download the resource (image or video) from the given url to the given destination, checking
-// if a file with the same size exists (and skipping the download in that case, returning false)
-func (s *handler) download(dest, downloadURL string, fileSize int64) (bool, error) {
-	if _, err := os.Stat(dest); err == nil {
-		if sameFileSizes(dest, fileSize) {
-			log.Debug("File exists with same size:", downloadURL)
-			return false, nil
-		}
-	}
-	log.Info("Getting ", downloadURL)
+// download the resource (image or video) from the given url to the given destination. When the
+// context is canceled the download is aborted and the partial file discarded
+func (s *handler) download(ctx context.Context, image albumImage, dest, downloadURL string, meta FileMeta) error {
+	entry := imageLog(image).WithFields(log.Fields{fieldFile: dest, fieldBytes: meta.Size, fieldURL: downloadURL})
+	entry.Info("Downloading")
+	start := time.Now()
 
-	response, err := s.makeAPICall(downloadURL)
+	response, err := s.makeAPICall(ctx, downloadURL)
 	if err != nil {
-		return false, fmt.Errorf("%s: download failed with: %s", downloadURL, err)
+		return fmt.Errorf("%s: download failed with: %s", downloadURL, err)
 	}
 	defer response.Body.Close()
 
 	// Create empty destination file
-	file, err := os.Create(dest)
+	file, err := s.store.Create(dest, meta)
 	if err != nil {
-		return false, fmt.Errorf("%s: file creation failed with: %s", dest, err)
+		return fmt.Errorf("%s: file creation failed with: %s", dest, err)
 	}
 	defer file.Close()
 
 	// Copy the content to the file
-	_, err = io.Copy(file, response.Body)
+	_, err = io.Copy(file, s.progress.reader(response.Body))
 	if err != nil {
-		return false, fmt.Errorf("%s: file content copy failed with: %s", dest, err)
+		return fmt.Errorf("%s: file content copy failed with: %s", dest, err)
 	}
 
-	log.Info("Saved ", dest)
-	return true, nil
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("%s: file commit failed with: %s", dest, err)
+	}
+
+	entry.WithField(fieldDuration, time.Since(start).Round(time.Millisecond).Seconds()).Info("Saved")
+	return nil
 }
 
 // getJSON makes a http calls to the given url, trying to decode the JSON response on the given obj
-func (s *handler) getJSON(url string, obj interface{}) error {
+func (s *handler) getJSON(ctx context.Context, url string, obj interface{}) error {
 	var result interface{}
 	for i := 1; i <= maxRetries; i++ {
-		log.Debug("Calling ", url)
-		resp, err := s.makeAPICall(url)
+		log.WithFields(log.Fields{fieldURL: url, fieldAttempt: i}).Debug("Calling the API")
+		resp, err := s.makeAPICall(ctx, url)
 		if err != nil {
 			return err
 		}
 		err = json.NewDecoder(resp.Body).Decode(&obj)
 		defer resp.Body.Close()
 		if err != nil {
-			log.Errorf("%s: reading response. %s", url, err)
+			log.WithFields(log.Fields{fieldURL: url, fieldAttempt: i}).WithError(err).Error("Cannot read the API response")
 			if i >= maxRetries {
 				return err
 			}
@@ -98,13 +102,17 @@ func (s *handler) getJSON(url string, obj interface{}) error {
 }
 
 // makeAPICall performs an HTTP call to the given url, returning the response
-func (s *handler) makeAPICall(url string) (*http.Response, error) {
+func (s *handler) makeAPICall(ctx context.Context, url string) (*http.Response, error) {
 	client := &http.Client{}
 
 	var resp *http.Response
-	var errorsList []error
+	var errorsList []apiError
+	endpoint := apiEndpoint(url)
 	for i := 1; i <= maxRetries; i++ {
-		req, err := http.NewRequest("GET", url, nil)
+		if i > 1 {
+			metricAPIRetries.add(1)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 
 		// Auth header must be generate every time (nonce must change)
 		h, err := s.oauth.authorizationHeader(url)
@@ -115,41 +123,54 @@ func (s *handler) makeAPICall(url string) (*http.Response, error) {
 			{name: "Accept", value: "application/json"},
 			{name: "Authorization", value: h},
 		}
-		log.Debug(headers)
 		addHeaders(req, headers)
 
+		entry := log.WithFields(log.Fields{fieldURL: url, fieldAttempt: i})
+		start := time.Now()
 		r, err := client.Do(req)
+		duration := time.Since(start).Round(time.Millisecond).Seconds()
 		if err != nil {
-			log.Debugf("#%d %s: %s\n", i, url, err)
-			errorsList = append(errorsList, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			metricAPIRequests.add(1, endpoint, "error")
+			entry.WithField(fieldDuration, duration).WithError(err).Debug("API call failed")
+			errorsList = append(errorsList, apiError{err: err, duration: duration})
 			if i >= maxRetries {
-				for _, e := range errorsList {
-					log.Error(e)
-				}
+				logErrors(url, errorsList)
 				return nil, errors.New("Too many errors")
 			}
 			// Go on and try again after a little pause
-			time.Sleep(2 * time.Second)
+			if err := sleep(ctx, 2*time.Second); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
+		metricAPIRequests.add(1, endpoint, strconv.Itoa(r.StatusCode))
+		if r.StatusCode == 429 {
+			metricAPIRateLimited.add(1)
+		}
 		if r.StatusCode >= 400 {
-			errorsList = append(errorsList, errors.New(r.Status))
+			r.Body.Close()
+			err := errors.New(r.Status)
+			entry.WithField(fieldDuration, duration).WithError(err).Debug("API call failed")
+			errorsList = append(errorsList, apiError{err: err, duration: duration})
 			if i >= maxRetries {
-				for _, e := range errorsList {
-					log.Error(e)
-				}
+				logErrors(url, errorsList)
 				return nil, errors.New("Too many errors")
 			}
 
 			if r.StatusCode == 429 {
 				// Header Retry-After tells the number of seconds until the end of the current window
-				log.Error("Got 429 too many requests, let's try to wait 10 seconds...")
-				log.Errorf("Retry-After header: %s\n", r.Header.Get("Retry-After"))
-				time.Sleep(10 * time.Second)
+				entry.Errorf("Got 429 too many requests, let's try to wait 10 seconds (Retry-After header: %s)", r.Header.Get("Retry-After"))
+				if err := sleep(ctx, 10*time.Second); err != nil {
+					return nil, err
+				}
 			}
 			continue
 		}
+		entry.WithField(fieldDuration, duration).Debug("API call done")
 		resp = r
 		break
 
@@ -157,6 +178,32 @@ func (s *handler) makeAPICall(url string) (*http.Response, error) {
 	return resp, nil
 }
 
+// apiError is the error of an attempt of an API call
+type apiError struct {
+	err      error
+	duration float64 // In seconds
+}
+
+// logErrors logs the errors of the attempts of an API call
+func logErrors(url string, errorsList []apiError) {
+	for i, e := range errorsList {
+		log.WithFields(log.Fields{fieldURL: url, fieldAttempt: i + 1, fieldDuration: e.duration}).WithError(e.err).
+			Error("API call failed")
+	}
+}
+
+// sleep waits for the given duration, returning the context error if it's canceled before
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 // addHeaders to the provided http request
 func addHeaders(req *http.Request, headers []header) {
 	for _, h := range headers {
@@ -0,0 +1,74 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMakeAPICallLogs(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	logger := log.StandardLogger()
+	defer func(o io.Writer, f log.Formatter, l log.Level) {
+		log.SetOutput(o)
+		log.SetFormatter(f)
+		log.SetLevel(l)
+	}(logger.Out, logger.Formatter, logger.Level)
+	log.SetOutput(&out)
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetLevel(log.DebugLevel)
+
+	h := newHTTPHandler("api_key", "api_secret", "user_token", "user_secret", nil)
+	var obj struct{}
+	if err := h.getJSON(context.Background(), ts.URL+"/api/v2!authuser", &obj); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("want 2 calls, got %d", calls)
+	}
+
+	logs := out.String()
+	for _, secret := range []string{"OAuth", "oauth_signature", "user_token", "api_secret", "user_secret"} {
+		if strings.Contains(logs, secret) {
+			t.Errorf("%q logged:\n%s", secret, logs)
+		}
+	}
+	for _, field := range []string{`"attempt":1`, `"attempt":2`, `"duration":`, `"url":"` + ts.URL + `/api/v2!authuser"`} {
+		if !strings.Contains(logs, field) {
+			t.Errorf("want the %s field, got:\n%s", field, logs)
+		}
+	}
+	if strings.Contains(logs, `"msg":"Calling `+ts.URL) {
+		t.Errorf("want the URL in its field only, got:\n%s", logs)
+	}
+
+	out.Reset()
+	h.store = newMemStorage()
+	image := albumImage{AlbumPath: "/Folder/Album", ImageKey: "key1"}
+	if err := h.download(context.Background(), image, "Album/image.jpg", ts.URL+"/image.jpg", FileMeta{Size: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logs = out.String()
+	for _, field := range []string{`"album":"/Folder/Album"`, `"image_key":"key1"`, `"file":"Album/image.jpg"`, `"bytes":2`, `"duration":`} {
+		if !strings.Contains(logs, field) {
+			t.Errorf("want the %s field, got:\n%s", field, logs)
+		}
+	}
+}
@@ -38,14 +38,86 @@ type albumsResponse struct {
 }
 
 type album struct {
-	URLPath string `json:"UrlPath"`
-	Uris    struct {
+	AlbumKey      string `json:"AlbumKey"`
+	Name          string `json:"Name"`
+	Description   string `json:"Description"`
+	Keywords      string `json:"Keywords"`
+	Date          string `json:"Date"` // Creation date
+	Privacy       string `json:"Privacy"`
+	SecurityType  string `json:"SecurityType"`
+	Password      string `json:"Password"`
+	PasswordHint  string `json:"PasswordHint"`
+	SortMethod    string `json:"SortMethod"`
+	SortDirection string `json:"SortDirection"`
+	URLName       string `json:"UrlName"`
+	URLPath       string `json:"UrlPath"`
+	Uris          struct {
 		AlbumImages struct {
 			URI string `json:"Uri"`
 		} `json:"AlbumImages"`
+		HighlightImage struct {
+			URI string `json:"Uri"`
+		} `json:"HighlightImage"`
+		AlbumComments struct {
+			URI string `json:"Uri"`
+		} `json:"AlbumComments"`
 	} `json:"Uris"`
 }
 
+type highlightImageResponse struct {
+	Response struct {
+		Image struct {
+			ImageKey string `json:"ImageKey"`
+		} `json:"Image"`
+	} `json:"Response"`
+}
+
+type albumResponse struct {
+	Response struct {
+		Album album `json:"Album"`
+	} `json:"Response"`
+}
+
+type albumImageResponse struct {
+	Response struct {
+		AlbumImage albumImage `json:"AlbumImage"`
+	} `json:"Response"`
+}
+
+// albumMetadata is the content of the album.json file saved in each album folder. It contains
+// the album settings and the ordered list of its images, so that the album can be rebuilt
+type albumMetadata struct {
+	AlbumKey       string               `json:"AlbumKey"`
+	Name           string               `json:"Name"`
+	Description    string               `json:"Description"`
+	Keywords       string               `json:"Keywords"`
+	Date           string               `json:"Date"`
+	Privacy        string               `json:"Privacy"`
+	SecurityType   string               `json:"SecurityType"`
+	Password       string               `json:"Password,omitempty"`
+	PasswordHint   string               `json:"PasswordHint,omitempty"`
+	SortMethod     string               `json:"SortMethod"`
+	SortDirection  string               `json:"SortDirection"`
+	URLName        string               `json:"UrlName"`
+	URLPath        string               `json:"UrlPath"`
+	HighlightImage string               `json:"HighlightImage,omitempty"` // ImageKey of the cover image
+	Images         []albumImageMetadata `json:"Images"`
+}
+
+// albumImageMetadata describes an image inside the album.json file
+type albumImageMetadata struct {
+	ImageKey         string `json:"ImageKey"`
+	FileName         string `json:"FileName"`  // Original name of the file on SmugMug
+	LocalName        string `json:"LocalName"` // Name of the file in the backup folder
+	Title            string `json:"Title"`
+	Caption          string `json:"Caption"`
+	Keywords         string `json:"Keywords"`
+	DateTimeOriginal string `json:"DateTimeOriginal"`
+	ArchivedMD5      string `json:"ArchivedMD5"`
+	ArchivedSize     int64  `json:"ArchivedSize"`
+	IsVideo          bool   `json:"IsVideo"`
+}
+
 type albumImagesResponse struct {
 	Response struct {
 		URI        string       `json:"Uri"`
@@ -65,8 +137,12 @@ type imageMetadataResponse struct {
 
 type albumImage struct {
 	AlbumPath        string // From album.URLPath
+	AlbumKey         string // From album.AlbumKey
 	FileName         string `json:"FileName"`
 	ImageKey         string `json:"ImageKey"` // Use as unique ID if FileName is empty
+	Title            string `json:"Title"`
+	Caption          string `json:"Caption"`
+	Keywords         string `json:"Keywords"`
 	ArchivedMD5      string `json:"ArchivedMD5"`
 	ArchivedSize     int64  `json:"ArchivedSize"`
 	ArchivedUri      string `json:"ArchivedUri"`
@@ -81,10 +157,14 @@ type albumImage struct {
 		LargestVideo struct {
 			Uri string `json:"Uri"`
 		} `json:"LargestVideo"`
+		ImageComments struct {
+			Uri string `json:"Uri"`
+		} `json:"ImageComments"`
 	} `json:"Uris"`
 
 	fileDatetime  time.Time
-	builtFilename string // The final filename, after template replacements
+	builtFilename string      // The final filename, after template replacements
+	video         *albumVideo // The largest video, once retrieved
 }
 
 func (a *albumImage) buildFilename(tmpl *template.Template) error {
@@ -124,6 +204,30 @@ type albumVideo struct {
 		LargestVideo struct {
 			Size int64  `json:"Size"`
 			Url  string `json:"Url"`
+			MD5  string `json:"MD5"`
 		} `json:"LargestVideo"`
 	} `json:"Response"`
 }
+
+type commentsResponse struct {
+	Response struct {
+		URI     string    `json:"Uri"`
+		Comment []comment `json:"Comment"`
+		Pages   struct {
+			NextPage string `json:"NextPage"`
+		} `json:"Pages"`
+	} `json:"Response"`
+}
+
+type comment struct {
+	Name   string `json:"Name"` // Author of the comment
+	Date   string `json:"Date"`
+	Text   string `json:"Text"`
+	Rating int    `json:"Rating"`
+}
+
+// albumComments is the content of the comments.json file saved in each album folder
+type albumComments struct {
+	Album  []comment            `json:"Album"`
+	Images map[string][]comment `json:"Images"` // Image comments, by ImageKey
+}
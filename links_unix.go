@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package smugmug
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links of a file
+func linkCount(fi os.FileInfo) (uint64, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("Cannot count the links of %s", fi.Name())
+	}
+	return uint64(st.Nlink), nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package smugmug
+
+import (
+	"errors"
+	"os"
+)
+
+// linkCount returns the number of hard links of a file. It isn't supported on Windows
+func linkCount(fi os.FileInfo) (uint64, error) {
+	return 0, errors.New("Counting hard links is not supported on Windows")
+}
@@ -0,0 +1,232 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lockFilename is the name of the lock file preventing concurrent runs on the same destination
+const lockFilename = ".smugmug-backup.lock"
+
+const (
+	lockRefresh    = time.Minute      // How often the lock file of a running backup is touched
+	lockStaleAfter = 10 * time.Minute // Age of the lock file after which the run is considered crashed
+	lockPoll       = 5 * time.Second  // How often the lock is checked while waiting for it
+)
+
+// lockInfo describes the run holding the lock. It's saved in the lock file
+type lockInfo struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Start time.Time `json:"start"`
+}
+
+func (i lockInfo) String() string {
+	return fmt.Sprintf("PID %d on %s, started at %s", i.PID, i.Host, i.Start.Local().Format("2006-01-02 15:04:05"))
+}
+
+// errLocked is returned when the lock is held by another run
+type errLocked struct {
+	path  string
+	owner lockInfo
+}
+
+func (e *errLocked) Error() string {
+	return fmt.Sprintf("Another backup is running on the same destination (%s, lock file %s)", e.owner, e.path)
+}
+
+// lockFile is an exclusive lock, held while the file exists. The file is touched periodically by
+// its owner, so that the lock of a crashed run is detected as stale
+type lockFile struct {
+	path string
+	info lockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireLock creates the lock file at the given path, with the PID, the host and the start time of
+// the run. A stale lock, left by a crashed run, is replaced. It returns an errLocked error if the
+// lock is held by another run
+func acquireLock(path string) (*lockFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create the lock folder: %v", err)
+	}
+	host, _ := os.Hostname()
+	l := &lockFile{
+		path: path,
+		info: lockInfo{PID: os.Getpid(), Host: host, Start: time.Now().UTC().Truncate(time.Second)},
+	}
+	for retry := true; ; retry = false {
+		err := l.create()
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Cannot create the lock file: %v", err)
+		}
+		owner, stale := readLock(path)
+		if !stale || !retry {
+			return nil, &errLocked{path: path, owner: owner}
+		}
+		log.Warnf("Removing the stale lock of a crashed run (%s)", owner)
+		if err := removeStaleLock(path, owner); err != nil {
+			return nil, err
+		}
+	}
+
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.refresh()
+	return l, nil
+}
+
+// removeStaleLock removes the stale lock of the given owner. Two runs may find the same stale lock
+// at the same time, and the first one may have already replaced it with its own lock when the
+// second one removes it. So the lock is first moved to a unique name, and if it isn't the stale
+// lock anymore it's put back
+func removeStaleLock(path string, owner lockInfo) error {
+	tmp := fmt.Sprintf("%s.stale-%d-%s", path, os.Getpid(), nonce())
+	if err := os.Rename(path, tmp); err != nil {
+		if os.IsNotExist(err) {
+			// Removed by another run
+			return nil
+		}
+		return fmt.Errorf("Cannot remove the stale lock file: %v", err)
+	}
+	if current, stale := readLock(tmp); !stale || current != owner {
+		// The lock of another run: the link fails only if a third run created a lock meanwhile
+		if err := os.Link(tmp, path); err != nil {
+			log.WithError(err).Warn("Cannot restore the lock of another run")
+		}
+	}
+	if err := os.Remove(tmp); err != nil {
+		return fmt.Errorf("Cannot remove the stale lock file: %v", err)
+	}
+	return nil
+}
+
+// waitLock acquires the lock at the given path, waiting up to timeout while it's held by another
+// run. With a zero timeout it doesn't wait
+func waitLock(ctx context.Context, path string, timeout time.Duration) (*lockFile, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		l, err := acquireLock(path)
+		if _, locked := err.(*errLocked); !locked || !time.Now().Before(deadline) {
+			return l, err
+		}
+		log.Infof("%v, waiting up to %s", err, time.Until(deadline).Round(time.Second))
+		wait := lockPoll
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lock acquires the lock of the destination, if any, returning the function releasing it
+func (w *Worker) lock(ctx context.Context) (func(), error) {
+	if w.lockPath == "" {
+		return func() {}, nil
+	}
+	l, err := waitLock(ctx, w.lockPath, w.cfg.LockWait)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := l.release(); err != nil {
+			log.WithError(err).Error("Cannot release the lock")
+		}
+	}, nil
+}
+
+// create writes the lock file, failing if it already exists
+func (l *lockFile) create() error {
+	b, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// readLock returns the owner of the existing lock at the given path and tells if it's stale: its
+// process isn't running anymore on this host, or its file hasn't been touched for lockStaleAfter
+func readLock(path string) (lockInfo, bool) {
+	var info lockInfo
+	fi, err := os.Stat(path)
+	if err != nil {
+		// Removed in the meanwhile
+		return info, os.IsNotExist(err)
+	}
+	if b, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(b, &info)
+	}
+	if time.Since(fi.ModTime()) > lockStaleAfter {
+		return info, true
+	}
+	host, _ := os.Hostname()
+	if info.PID > 0 && info.Host == host && !processRunning(info.PID) {
+		return info, true
+	}
+	return info, false
+}
+
+// refresh touches the lock file every lockRefresh, until the lock is released
+func (l *lockFile) refresh() {
+	defer close(l.done)
+	t := time.NewTicker(lockRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-t.C:
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				log.WithError(err).Warn("Cannot refresh the lock file")
+			}
+		}
+	}
+}
+
+// release removes the lock file
+func (l *lockFile) release() error {
+	close(l.stop)
+	<-l.done
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Cannot remove the lock file: %v", err)
+	}
+	return nil
+}
+
+// stateFolder returns the folder of the lock and status files: the destination folder with the
+// local backend, otherwise the configuration folder in the user's home
+func (cfg *Conf) stateFolder() string {
+	if cfg.hasLocalBackend() && cfg.Destination != "" {
+		return cfg.Destination
+	}
+	return os.ExpandEnv("$HOME/.smgmg")
+}
+
+// lockPath returns the path of the lock file
+func (cfg *Conf) lockPath() string {
+	return filepath.Join(cfg.stateFolder(), lockFilename)
+}
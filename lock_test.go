@@ -0,0 +1,225 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func writeLockInfo(t *testing.T, path string, info lockInfo) {
+	b, _ := json.Marshal(info)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	path := filepath.Join(t.TempDir(), lockFilename)
+	lock, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, stale := readLock(path)
+	if stale || info.PID != os.Getpid() || info.Start.IsZero() {
+		t.Fatalf("unexpected lock %+v, stale %v", info, stale)
+	}
+	if _, err := acquireLock(path); err == nil {
+		t.Fatalf("lock acquired twice")
+	} else if _, ok := err.(*errLocked); !ok {
+		t.Fatalf("want errLocked, got %v", err)
+	}
+	if err := lock.release(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("lock file not removed: %v", err)
+	}
+
+	// Lock of a process not running anymore on this host
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	host, _ := os.Hostname()
+	writeLockInfo(t, path, lockInfo{PID: cmd.Process.Pid, Host: host, Start: time.Now()})
+	if lock, err = acquireLock(path); err != nil {
+		t.Fatalf("stale lock not replaced: %v", err)
+	}
+	lock.release()
+
+	// The process of another host can't be checked: the lock is stale only when not refreshed
+	writeLockInfo(t, path, lockInfo{PID: cmd.Process.Pid, Host: "other-" + host, Start: time.Now()})
+	if _, err := acquireLock(path); err == nil {
+		t.Fatalf("want locked error, got nil")
+	}
+	old := time.Now().Add(-2 * lockStaleAfter)
+	os.Chtimes(path, old, old)
+	if lock, err = acquireLock(path); err != nil {
+		t.Fatalf("stale lock not replaced: %v", err)
+	}
+	lock.release()
+}
+
+func TestLockStaleTakeover(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, lockFilename)
+	old := time.Now().Add(-2 * lockStaleAfter)
+	staleLock := func() lockInfo {
+		info := lockInfo{PID: 1, Host: "other-host", Start: old.UTC().Truncate(time.Second)}
+		writeLockInfo(t, path, info)
+		os.Chtimes(path, old, old)
+		return info
+	}
+
+	// A run found the stale lock, but another one took it over before the removal
+	owner := staleLock()
+	lock, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := removeStaleLock(path, owner); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := acquireLock(path); err == nil {
+		t.Fatalf("lock of the other run removed")
+	}
+	lock.release()
+
+	// Concurrent runs finding the same stale lock: only one of them takes it over
+	for n := 0; n < 20; n++ {
+		staleLock()
+		const runs = 8
+		locks := make(chan *lockFile, runs)
+		var wg sync.WaitGroup
+		for i := 0; i < runs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if l, err := acquireLock(path); err == nil {
+					locks <- l
+				}
+			}()
+		}
+		wg.Wait()
+		close(locks)
+		if len(locks) != 1 {
+			t.Fatalf("want a single lock owner, got %d", len(locks))
+		}
+		(<-locks).release()
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("want no lock files left, got %d", len(files))
+		}
+	}
+}
+
+func TestWaitLock(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	path := filepath.Join(t.TempDir(), lockFilename)
+	lock, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lock.release()
+
+	start := time.Now()
+	if _, err := waitLock(context.Background(), path, 200*time.Millisecond); err == nil {
+		t.Fatalf("want locked error, got nil")
+	} else if _, ok := err.(*errLocked); !ok {
+		t.Fatalf("want errLocked, got %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("returned after %v, without waiting", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := waitLock(ctx, path, time.Hour); err != context.Canceled {
+		t.Fatalf("want canceled error, got %v", err)
+	}
+}
+
+func TestRunLocked(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	lock, err := acquireLock(filepath.Join(dest, lockFilename))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lock.release()
+
+	w := &Worker{
+		cfg:      &Conf{Destination: dest},
+		store:    newLocalStorage(dest),
+		req:      &mockHandler{username: testUsername},
+		lockPath: filepath.Join(dest, lockFilename),
+	}
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatalf("want locked error, got nil")
+	} else if _, ok := err.(*errLocked); !ok {
+		t.Fatalf("want errLocked, got %v", err)
+	}
+}
+
+func TestNewLockedSnapshot(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	snapshots := filepath.Join(dest, snapshotsFolder)
+	partial := filepath.Join(snapshots, "20210602T100000Z"+snapshotPartialSuffix)
+	for _, name := range []string{filepath.Join(snapshots, "20210601T100000Z", "album", "a.jpg"), filepath.Join(partial, "album", "b.jpg")} {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte("content"), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	lock, err := acquireLock(filepath.Join(dest, lockFilename))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lock.release()
+
+	// The partial snapshot belongs to the run holding the lock
+	cfg := &Conf{
+		ApiKey:      "key",
+		ApiSecret:   "secret",
+		UserToken:   "token",
+		UserSecret:  "secret",
+		Destination: dest,
+		Backend:     "local",
+		Snapshots:   SnapshotsConf{Enabled: true},
+	}
+	w, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatalf("want locked error, got nil")
+	} else if _, ok := err.(*errLocked); !ok {
+		t.Fatalf("want errLocked, got %v", err)
+	}
+	if err := w.RetryFailed(context.Background()); err == nil {
+		t.Fatalf("want locked error, got nil")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(partial, "album"))
+	if err != nil || len(files) != 1 || files[0].Name() != "b.jpg" {
+		t.Fatalf("partial snapshot changed: %v (%v)", files, err)
+	}
+	if files, _ := ioutil.ReadDir(snapshots); len(files) != 2 {
+		t.Fatalf("want the 2 snapshots only, got %d", len(files))
+	}
+}
@@ -0,0 +1,94 @@
+package smugmug
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LogFile is a log file rotated when it reaches a maximum size. The rotated files are named with
+// the .1, .2, ... suffixes, .1 being the most recent one
+type LogFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64 // Size after which the file is rotated, 0 to never rotate it
+	maxFiles int   // Number of rotated files kept
+	file     *os.File
+	size     int64
+}
+
+// OpenLogFile opens the log file at the given path, appending to it. The file is rotated when it
+// would exceed maxSize bytes, keeping maxFiles rotated files
+func OpenLogFile(path string, maxSize int64, maxFiles int) (*LogFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Cannot create the log folder: %v", err)
+	}
+	l := &LogFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Cannot open the log file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Cannot open the log file: %v", err)
+	}
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+// Write writes a log entry, rotating the file first if the entry would exceed the maximum size
+func (l *LogFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the current file
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to .1, shifting the previous rotated files and removing the oldest one,
+// and opens a new file
+func (l *LogFile) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("Cannot rotate the log file: %v", err)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, n), fmt.Sprintf("%s.%d", l.path, n+1))
+	}
+	var err error
+	if l.maxFiles > 0 {
+		err = os.Rename(l.path, l.path+".1")
+	} else {
+		err = os.Remove(l.path)
+	}
+	if oErr := l.open(); oErr != nil {
+		return oErr
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot rotate the log file: %v", err)
+	}
+	return nil
+}
+
+// Close closes the log file
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,48 @@
+package smugmug
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "backup.log")
+	l, err := OpenLogFile(path, 20, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range []string{"first entry\n", "second entry\n", "third entry\n", "fourth entry\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Each entry exceeds the size with the previous one: the first one has been removed
+	for name, want := range map[string]string{
+		path:        "fourth entry\n",
+		path + ".1": "third entry\n",
+		path + ".2": "second entry\n",
+	} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil || string(b) != want {
+			t.Errorf("%s: want %q, got %q (%v)", name, want, b, err)
+		}
+	}
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 3 {
+		t.Errorf("want 3 files, got %v", files)
+	}
+
+	// Reopened, the file is appended
+	l, _ = OpenLogFile(path, 0, 2)
+	l.Write([]byte("fifth entry\n"))
+	l.Close()
+	if b, _ := ioutil.ReadFile(path); !strings.HasSuffix(string(b), "fourth entry\nfifth entry\n") {
+		t.Errorf("want the entry appended, got %q", b)
+	}
+}
@@ -0,0 +1,21 @@
+package smugmug
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields of the structured log entries
+const (
+	fieldAlbum    = "album"     // URL path of the album
+	fieldImageKey = "image_key" // ImageKey of the image or video
+	fieldFile     = "file"      // Name of the file in the storage
+	fieldBytes    = "bytes"     // Size of the file
+	fieldDuration = "duration"  // Duration, in seconds
+	fieldAttempt  = "attempt"   // Attempt of an API call, starting from 1
+	fieldURL      = "url"       // URL of an API call or of a download
+)
+
+// imageLog returns a log entry with the album and the ImageKey of the image
+func imageLog(image albumImage) *log.Entry {
+	return log.WithFields(log.Fields{fieldAlbum: image.AlbumPath, fieldImageKey: image.ImageKey})
+}
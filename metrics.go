@@ -0,0 +1,247 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricsConf is the configuration of the Prometheus metrics
+type MetricsConf struct {
+	Listen   string // Address of the HTTP listener exposing /metrics, like ":9101", no listener if empty
+	Textfile string // Path of the node_exporter textfile written at the end of each run, none if empty
+}
+
+// metric is a Prometheus counter or gauge, with the values of each combination of its labels
+type metric struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // By the label values, joined with labelSep
+}
+
+// labelSep separates the label values in the keys of metric.values
+const labelSep = "\xff"
+
+// metrics are the metrics of the process, in the exposition order
+var metrics []*metric
+
+var (
+	metricAPIRequests = newMetric("smugmug_backup_api_requests_total", "counter",
+		"SmugMug API calls by endpoint and status code, \"error\" when no response was received", "endpoint", "code")
+	metricAPIRetries = newMetric("smugmug_backup_api_retries_total", "counter",
+		"SmugMug API calls retried after an error")
+	metricAPIRateLimited = newMetric("smugmug_backup_api_rate_limited_total", "counter",
+		"SmugMug API calls rejected with 429 Too Many Requests")
+	metricDownloadedBytes = newMetric("smugmug_backup_downloaded_bytes_total", "counter",
+		"Bytes of the downloaded images and videos")
+	metricFiles = newMetric("smugmug_backup_files_total", "counter",
+		"Processed images and videos by outcome", "outcome")
+	metricRuns = newMetric("smugmug_backup_runs_total", "counter",
+		"Backup runs by result", "result")
+	metricRunDuration = newMetric("smugmug_backup_last_run_duration_seconds", "gauge",
+		"Duration of the last backup run")
+	metricRunTimestamp = newMetric("smugmug_backup_last_run_timestamp_seconds", "gauge",
+		"End time of the last backup run")
+	metricSuccessTimestamp = newMetric("smugmug_backup_last_success_timestamp_seconds", "gauge",
+		"End time of the last backup run completed without errors or failed files")
+)
+
+// newMetric registers a metric with the given name, kind, help and label names
+func newMetric(name, kind, help string, labels ...string) *metric {
+	m := &metric{name: name, kind: kind, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, m)
+	return m
+}
+
+// add adds v to the value with the given label values
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[strings.Join(labelValues, labelSep)] += v
+}
+
+// set sets the value with the given label values
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[strings.Join(labelValues, labelSep)] = v
+}
+
+// value returns the value of a metric without labels, and false if it has no value
+func (m *metric) value() (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[""]
+	return v, ok
+}
+
+// write writes the metric in the Prometheus text format, with the series sorted by label values.
+// A counter without labels and without values is written as 0, while a gauge without values isn't
+// written, since 0 isn't a meaningful timestamp or duration
+func (m *metric) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.values) == 0 && (len(m.labels) > 0 || m.kind == "gauge") {
+		return
+	}
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if len(m.values) == 0 {
+		fmt.Fprintf(out, "%s 0\n", m.name)
+		return
+	}
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprint(out, m.name)
+		if len(m.labels) > 0 {
+			var pairs []string
+			for i, v := range strings.Split(k, labelSep) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", m.labels[i], v))
+			}
+			fmt.Fprintf(out, "{%s}", strings.Join(pairs, ","))
+		}
+		fmt.Fprintf(out, " %s\n", strconv.FormatFloat(m.values[k], 'g', -1, 64))
+	}
+}
+
+// writeMetrics writes all the metrics in the Prometheus text format
+func writeMetrics(out io.Writer) {
+	for _, m := range metrics {
+		m.write(out)
+	}
+}
+
+// apiEndpoint returns the endpoint of a SmugMug API url, without the keys of the objects, like
+// "album!images" for "/api/v2/album/<key>!images". The downloads of the images and videos are
+// reported as "download"
+func apiEndpoint(url string) string {
+	url = strings.SplitN(url, "?", 2)[0]
+	prefix := baseAPIURL + "/api/v2"
+	if !strings.HasPrefix(url, prefix) {
+		return "download"
+	}
+	// The path alternates the object names and their keys: keep the names and the actions
+	var names []string
+	for i, s := range strings.Split(strings.TrimPrefix(url, prefix), "/") {
+		if i%2 == 0 {
+			// Key, with an optional action
+			if n := strings.Index(s, "!"); n >= 0 {
+				names = append(names, s[n:])
+			}
+			continue
+		}
+		names = append(names, "/"+s)
+	}
+	endpoint := strings.TrimPrefix(strings.Join(names, ""), "/")
+	return strings.TrimPrefix(endpoint, "!")
+}
+
+// recordRun records the result and the duration of the run started at the given time, and writes
+// the metrics textfile if configured. A run is successful only if its result is "completed"
+func (w *Worker) recordRun(start time.Time, result string) {
+	end := time.Now()
+	metricRuns.add(1, result)
+	metricRunDuration.set(end.Sub(start).Seconds())
+	metricRunTimestamp.set(float64(end.Unix()))
+	if result == "completed" {
+		metricSuccessTimestamp.set(float64(end.Unix()))
+	}
+
+	if w.cfg.Metrics.Textfile == "" {
+		return
+	}
+	// A process that didn't complete a run yet, like the one of a failed cron run, keeps the time of
+	// the last success written by the previous processes
+	if _, ok := metricSuccessTimestamp.value(); !ok {
+		if v, ok := readTextfileValue(w.cfg.Metrics.Textfile, metricSuccessTimestamp.name); ok {
+			metricSuccessTimestamp.set(v)
+		}
+	}
+	if err := writeMetricsTextfile(w.cfg.Metrics.Textfile); err != nil {
+		log.WithError(err).Error("Cannot save the metrics textfile")
+	}
+}
+
+// writeMetricsTextfile writes the metrics to the given path, for the node_exporter textfile
+// collector. The file is written to a temporary file and renamed, so that it's never read partially
+func writeMetricsTextfile(path string) error {
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Cannot write the metrics: %v", err)
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		// The temporary file is created with mode 0600, while the collector may run as another user
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Cannot write the metrics: %v", err)
+	}
+	return nil
+}
+
+// readTextfileValue returns the value of the named metric without labels in the given textfile,
+// and false if the file or the metric doesn't exist
+func readTextfileValue(path, name string) (float64, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, name+" ") {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, name+" ")), 64)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+// ServeMetrics starts an HTTP server, listening on addr, exposing the metrics at /metrics in the
+// Prometheus text format. It returns when the context is canceled
+func ServeMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("Serving the metrics at http://%s/metrics", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return fmt.Errorf("Cannot serve the metrics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package smugmug
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	for url, want := range map[string]string{
+		baseAPIURL + "/api/v2!authuser":                               "authuser",
+		baseAPIURL + "/api/v2/user/test_username":                     "user",
+		baseAPIURL + "/api/v2/user/test_username!albums?start=1":      "user!albums",
+		baseAPIURL + "/api/v2/album/Xk2nF4p!images":                   "album!images",
+		baseAPIURL + "/api/v2/album/Xk2nF4p/image/abc123":             "album/image",
+		baseAPIURL + "/api/v2/image/abc123-0!metadata":                "image!metadata",
+		"https://photos.smugmug.com/photos/i-abc123/0/O/i-abc123.jpg": "download",
+	} {
+		if got := apiEndpoint(url); got != want {
+			t.Errorf("%s: want %q, got %q", url, want, got)
+		}
+	}
+}
+
+func TestMetricWrite(t *testing.T) {
+	m := &metric{name: "test_total", kind: "counter", help: "Test", labels: []string{"endpoint", "code"}, values: make(map[string]float64)}
+	var b strings.Builder
+	m.write(&b)
+	if b.String() != "" {
+		t.Fatalf("want no series, got %q", b.String())
+	}
+	m.add(1, "user", "200")
+	m.add(2, "album!images", "500")
+	m.add(1, "user", "200")
+	m.write(&b)
+	want := "# HELP test_total Test\n# TYPE test_total counter\n" +
+		"test_total{endpoint=\"album!images\",code=\"500\"} 2\n" +
+		"test_total{endpoint=\"user\",code=\"200\"} 2\n"
+	if b.String() != want {
+		t.Fatalf("want %q, got %q", want, b.String())
+	}
+
+	// A gauge without values isn't written, a counter is written as 0
+	b.Reset()
+	(&metric{name: "test_seconds", kind: "gauge", help: "Test", values: make(map[string]float64)}).write(&b)
+	if b.String() != "" {
+		t.Fatalf("want no series, got %q", b.String())
+	}
+	(&metric{name: "test_total", kind: "counter", help: "Test", values: make(map[string]float64)}).write(&b)
+	if !strings.HasSuffix(b.String(), "\ntest_total 0\n") {
+		t.Fatalf("want the counter written as 0, got %q", b.String())
+	}
+}
+
+func TestRunMetricsTextfile(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	textfile := filepath.Join(t.TempDir(), "smugmug_backup.prom")
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination: dest,
+			Metrics:     MetricsConf{Textfile: textfile},
+		},
+		store: newLocalStorage(dest),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn:   func(_ context.Context, _ albumImage, _, _ string, _ FileMeta) error { return nil },
+		filenameTmpl: tmpl,
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(textfile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE smugmug_backup_files_total counter\n",
+		"smugmug_backup_files_total{outcome=\"downloaded\"} ",
+		"smugmug_backup_runs_total{result=\"completed\"} ",
+		"smugmug_backup_last_success_timestamp_seconds 1",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("want %q in the textfile, got:\n%s", want, b)
+		}
+	}
+}
+
+func TestRunMetricsTextfileFailure(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	// No success in this process yet
+	metricSuccessTimestamp.mu.Lock()
+	values := metricSuccessTimestamp.values
+	metricSuccessTimestamp.values = make(map[string]float64)
+	metricSuccessTimestamp.mu.Unlock()
+	defer func() {
+		metricSuccessTimestamp.mu.Lock()
+		metricSuccessTimestamp.values = values
+		metricSuccessTimestamp.mu.Unlock()
+	}()
+
+	dest := t.TempDir()
+	textfile := filepath.Join(t.TempDir(), "smugmug_backup.prom")
+	previous := "smugmug_backup_last_success_timestamp_seconds 1.6e+09\n"
+	if err := ioutil.WriteFile(textfile, []byte(previous), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination: dest,
+			Metrics:     MetricsConf{Textfile: textfile},
+		},
+		store: newLocalStorage(dest),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+			if strings.HasSuffix(dest, "abc124") {
+				return errors.New("connection reset")
+			}
+			return nil
+		},
+		filenameTmpl: tmpl,
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The run with a failed file keeps the time of the previous success
+	b, err := ioutil.ReadFile(textfile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"smugmug_backup_runs_total{result=\"completed_with_errors\"} ", previous} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("want %q in the textfile, got:\n%s", want, b)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notifyTimeout is the maximum duration of the sending of a notification
+const notifyTimeout = 10 * time.Second
+
+// notifyMaxItems is the maximum number of failed items listed in the email
+const notifyMaxItems = 50
+
+// NotifyConf is the configuration of the notifications sent at the end of the runs
+type NotifyConf struct {
+	WebhookURL   string   // URL receiving a JSON POST with the summary of the run
+	PingURL      string   // Healthchecks-style URL, pinged with "/start" at start, and with "/fail" on failure
+	OnlyFailures bool     // When true, the webhook and the email are sent only for the failed runs
+	SMTP         SMTPConf // Email sent with the summary of the run
+}
+
+// SMTPConf is the configuration of the email notifications
+type SMTPConf struct {
+	Host     string   // SMTP server, no email if empty
+	Port     int      // SMTP port, 465 for implicit TLS, otherwise STARTTLS is used when supported
+	Username string   // Optional username for the authentication
+	Password string   // Password of the username
+	From     string   // Sender address
+	To       []string // Recipient addresses
+}
+
+func (c NotifyConf) validate() error {
+	for name, u := range map[string]string{"notify.webhook_url": c.WebhookURL, "notify.ping_url": c.PingURL} {
+		if u == "" {
+			continue
+		}
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("%s must be an http or https URL, got %q", name, u)
+		}
+	}
+	if c.SMTP.Host != "" {
+		if c.SMTP.From == "" || len(c.SMTP.To) == 0 {
+			return errors.New("notify.smtp.from and notify.smtp.to are required with notify.smtp.host")
+		}
+		if c.SMTP.Port <= 0 {
+			return errors.New("notify.smtp.port must be a valid port")
+		}
+	}
+	return nil
+}
+
+// runNotice is the result of a run sent by the notifiers
+type runNotice struct {
+	Success bool `json:"success"` // True if the run completed without errors
+	*runReport
+}
+
+// notifier sends the notifications of a run
+type notifier interface {
+	name() string
+	started(ctx context.Context) error
+	finished(ctx context.Context, n runNotice) error
+}
+
+// notifiers returns the configured notifiers
+func (c NotifyConf) notifiers() []notifier {
+	var ns []notifier
+	if c.PingURL != "" {
+		ns = append(ns, &pingNotifier{url: strings.TrimSuffix(c.PingURL, "/")})
+	}
+	if c.WebhookURL != "" {
+		ns = append(ns, &webhookNotifier{url: c.WebhookURL, onlyFailures: c.OnlyFailures})
+	}
+	if c.SMTP.Host != "" {
+		ns = append(ns, &emailNotifier{cfg: c.SMTP, onlyFailures: c.OnlyFailures})
+	}
+	return ns
+}
+
+// notifyStart tells the notifiers that the run started. The errors are logged, so that they never
+// affect the backup
+func (w *Worker) notifyStart() {
+	for _, n := range w.cfg.Notify.notifiers() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := n.started(ctx); err != nil {
+			log.WithError(err).Warnf("Cannot send the %s notification", n.name())
+		}
+		cancel()
+	}
+}
+
+// notifyEnd sends the result of the run to the notifiers. The errors are logged, so that they
+// never affect the backup. The notifications are sent also when the run has been interrupted
+func (w *Worker) notifyEnd(r *runReport, success bool) {
+	for _, n := range w.cfg.Notify.notifiers() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := n.finished(ctx, runNotice{Success: success, runReport: r}); err != nil {
+			log.WithError(err).Warnf("Cannot send the %s notification", n.name())
+		}
+		cancel()
+	}
+}
+
+// post sends a POST request with the given body, failing on a status code other than 2xx
+func post(ctx context.Context, url, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// pingNotifier pings a healthchecks-style URL: <url>/start when the run starts, <url> when it
+// succeeds and <url>/fail when it fails. The summary of the run is sent as body
+type pingNotifier struct {
+	url string
+}
+
+func (p *pingNotifier) name() string {
+	return "ping"
+}
+
+func (p *pingNotifier) started(ctx context.Context) error {
+	return post(ctx, p.url+"/start", "text/plain; charset=utf-8", nil)
+}
+
+func (p *pingNotifier) finished(ctx context.Context, n runNotice) error {
+	u := p.url
+	if !n.Success {
+		u += "/fail"
+	}
+	return post(ctx, u, "text/plain; charset=utf-8", []byte(n.summary()))
+}
+
+// webhookNotifier sends a JSON POST with the summary of the run
+type webhookNotifier struct {
+	url          string
+	onlyFailures bool
+}
+
+func (h *webhookNotifier) name() string {
+	return "webhook"
+}
+
+func (h *webhookNotifier) started(context.Context) error {
+	return nil
+}
+
+func (h *webhookNotifier) finished(ctx context.Context, n runNotice) error {
+	if n.Success && h.onlyFailures {
+		return nil
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return post(ctx, h.url, "application/json", b)
+}
+
+// emailNotifier sends an email with the summary of the run
+type emailNotifier struct {
+	cfg          SMTPConf
+	onlyFailures bool
+}
+
+func (e *emailNotifier) name() string {
+	return "email"
+}
+
+func (e *emailNotifier) started(context.Context) error {
+	return nil
+}
+
+func (e *emailNotifier) finished(ctx context.Context, n runNotice) error {
+	if n.Success && e.onlyFailures {
+		return nil
+	}
+	subject := "SmugMug backup completed"
+	if !n.Success {
+		subject = "SmugMug backup failed"
+	}
+	host, _ := os.Hostname()
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s on %s\r\n", subject, host)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(n.summary(), "\n", "\r\n", -1))
+	return e.send(ctx, msg.Bytes())
+}
+
+// send sends the message with the configured SMTP server. With port 465 the connection uses
+// implicit TLS, otherwise it's upgraded with STARTTLS when the server supports it
+func (e *emailNotifier) send(ctx context.Context, msg []byte) error {
+	addr := net.JoinHostPort(e.cfg.Host, strconv.Itoa(e.cfg.Port))
+	tlsConf := &tls.Config{ServerName: e.cfg.Host}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if e.cfg.Port == 465 {
+		conn = tls.Client(conn, tlsConf)
+	}
+	c, err := smtp.NewClient(conn, e.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && e.cfg.Port != 465 {
+		if err := c.StartTLS(tlsConf); err != nil {
+			return err
+		}
+	}
+	if e.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.cfg.Username, e.cfg.Password, e.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range e.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(msg); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// summary returns the description of the result of the run, with the failed items
+func (n runNotice) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Result: %s\n", n.Result)
+	if n.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", n.Error)
+	}
+	fmt.Fprintf(&b, "Start: %s\n", n.Start.Format(time.RFC1123))
+	fmt.Fprintf(&b, "Duration: %s\n", n.End.Sub(n.Start).Round(time.Second))
+	fmt.Fprintf(&b, "Albums: %d of %d completed\n", n.AlbumsDone, n.Albums)
+	fmt.Fprintf(&b, "Files: %d downloaded, %d already saved, %d deferred, %d failed\n",
+		n.FilesDownloaded, n.FilesSkipped+n.FilesRetimed, n.FilesDeferred, n.FilesFailed)
+	fmt.Fprintf(&b, "Downloaded: %s\n", FormatSize(n.BytesDownloaded))
+	if len(n.Failed) > 0 {
+		b.WriteString("\nFailed items:\n")
+		for i, f := range n.Failed {
+			if i == notifyMaxItems {
+				fmt.Fprintf(&b, "... and %d more\n", len(n.Failed)-i)
+				break
+			}
+			name := f.File
+			if name == "" {
+				name = f.Album
+			}
+			fmt.Fprintf(&b, "- %s: %s\n", name, f.Reason)
+		}
+	}
+	return b.String()
+}
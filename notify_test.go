@@ -0,0 +1,241 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// notifyServer records the requests received by a local stand-in of the webhook and ping services
+type notifyServer struct {
+	mu       sync.Mutex
+	requests []string // Path and body of each request
+}
+
+func (s *notifyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.Path+" "+string(b))
+	s.mu.Unlock()
+}
+
+// fakeSMTP starts a local SMTP stand-in accepting a single message, that is sent to the channel
+func fakeSMTP(t *testing.T) (string, int, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	msgs := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		tp := textproto.NewConn(conn)
+		defer tp.Close()
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				lines, _ := tp.ReadDotLines()
+				msgs <- strings.Join(lines, "\n")
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Unknown command")
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, msgs
+}
+
+// failingHandler fails all the API calls
+type failingHandler struct{}
+
+func (failingHandler) get(context.Context, string, interface{}) error {
+	return errors.New("401 Unauthorized")
+}
+
+func TestRunNotify(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	srv := &notifyServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	host, port, msgs := fakeSMTP(t)
+
+	dest := t.TempDir()
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination: dest,
+			Notify: NotifyConf{
+				WebhookURL: ts.URL + "/hook",
+				PingURL:    ts.URL + "/ping/",
+				SMTP:       SMTPConf{Host: host, Port: port, From: "backup@example.com", To: []string{"me@example.com"}},
+			},
+		},
+		store: newLocalStorage(dest),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn:   func(_ context.Context, _ albumImage, _, _ string, _ FileMeta) error { return nil },
+		filenameTmpl: tmpl,
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.requests) != 3 || srv.requests[0] != "/ping/start " || !strings.HasPrefix(srv.requests[1], "/ping Result: completed\n") {
+		t.Fatalf("unexpected requests %q", srv.requests)
+	}
+	var n struct {
+		Success         bool   `json:"success"`
+		Result          string `json:"result"`
+		FilesDownloaded int    `json:"files_downloaded"`
+	}
+	body := strings.TrimPrefix(srv.requests[2], "/hook ")
+	if err := json.Unmarshal([]byte(body), &n); err != nil || !n.Success || n.Result != "completed" || n.FilesDownloaded != 2 {
+		t.Fatalf("unexpected webhook body %s (%v)", body, err)
+	}
+
+	msg := <-msgs
+	for _, want := range []string{"To: me@example.com", "Subject: SmugMug backup completed", "Files: 2 downloaded"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("want %q in the email, got:\n%s", want, msg)
+		}
+	}
+}
+
+func TestRunNotifyFailure(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	srv := &notifyServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// Nothing listens on the SMTP port
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	w := &Worker{
+		cfg: &Conf{
+			Notify: NotifyConf{
+				WebhookURL:   "http://127.0.0.1:" + strconv.Itoa(port) + "/hook",
+				PingURL:      ts.URL,
+				OnlyFailures: true,
+				SMTP:         SMTPConf{Host: "127.0.0.1", Port: port, From: "backup@example.com", To: []string{"me@example.com"}},
+			},
+		},
+		store: newLocalStorage(t.TempDir()),
+		req:   failingHandler{},
+	}
+	// The notifiers failing don't change the result of the backup
+	err := w.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Error checking credentials") {
+		t.Fatalf("want the backup error, got %v", err)
+	}
+	if len(srv.requests) != 2 || srv.requests[0] != "/start " || !strings.HasPrefix(srv.requests[1], "/fail Result: failed\n") {
+		t.Fatalf("unexpected requests %q", srv.requests)
+	}
+}
+
+func TestRunNotifyFailedFile(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	srv := &notifyServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	host, port, msgs := fakeSMTP(t)
+
+	dest := t.TempDir()
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination: dest,
+			Notify: NotifyConf{
+				WebhookURL: ts.URL + "/hook",
+				PingURL:    ts.URL + "/ping",
+				SMTP:       SMTPConf{Host: host, Port: port, From: "backup@example.com", To: []string{"me@example.com"}},
+			},
+		},
+		store: newLocalStorage(dest),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+			if strings.HasSuffix(dest, "abc124") {
+				return errors.New("connection reset")
+			}
+			return nil
+		},
+		filenameTmpl: tmpl,
+	}
+	// A failed file isn't a backup error, but the run isn't successful
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.requests) != 3 || !strings.HasPrefix(srv.requests[1], "/ping/fail Result: completed_with_errors\n") {
+		t.Fatalf("unexpected requests %q", srv.requests)
+	}
+	var n struct {
+		Success bool   `json:"success"`
+		Result  string `json:"result"`
+	}
+	body := strings.TrimPrefix(srv.requests[2], "/hook ")
+	if err := json.Unmarshal([]byte(body), &n); err != nil || n.Success || n.Result != "completed_with_errors" {
+		t.Fatalf("unexpected webhook body %s (%v)", body, err)
+	}
+
+	msg := <-msgs
+	for _, want := range []string{"Subject: SmugMug backup failed", "abc124: connection reset"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("want %q in the email, got:\n%s", want, msg)
+		}
+	}
+}
+
+func TestNotifyConf(t *testing.T) {
+	for _, c := range []NotifyConf{
+		{WebhookURL: "ftp://example.com/hook"},
+		{PingURL: "hc-ping.com/uuid"},
+		{SMTP: SMTPConf{Host: "smtp.example.com", Port: 587, From: "backup@example.com"}},
+		{SMTP: SMTPConf{Host: "smtp.example.com", From: "backup@example.com", To: []string{"me@example.com"}}},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v: want error, got nil", c)
+		}
+	}
+	if err := (NotifyConf{PingURL: "https://hc-ping.com/uuid"}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
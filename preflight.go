@@ -0,0 +1,124 @@
+package smugmug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pre-flight check modes
+const (
+	preflightWarn  = "warn"
+	preflightAbort = "abort"
+)
+
+// freeSpacer is implemented by the storages that know the free space of the destination
+type freeSpacer interface {
+	// FreeSpace returns the number of bytes available in the destination
+	FreeSpace() (int64, error)
+}
+
+// storageFreeSpace returns the free space of a storage, or an error if it isn't known
+func storageFreeSpace(s Storage) (int64, error) {
+	fs, ok := s.(freeSpacer)
+	if !ok {
+		return 0, errors.New("The storage doesn't know its free space")
+	}
+	return fs.FreeSpace()
+}
+
+// albumWork is an album to backup, with its images and videos
+type albumWork struct {
+	album   album
+	folder  string
+	images  []albumImage
+	partial bool // Only some images of the album are saved, when retrying the failed ones
+}
+
+// plannedDownloads returns the number and the total size of the files that need to be
+// downloaded, because they don't exist in the storage or they're different
+func (w *Worker) plannedDownloads(ctx context.Context, works []albumWork) (int, int64) {
+	var files int
+	var size int64
+	for i := range works {
+		if ctx.Err() != nil {
+			break
+		}
+		var albumFiles int
+		var albumSize int64
+		for j := range works[i].images {
+			image := &works[i].images[j]
+			if image.Name() == "" || (image.IsVideo && image.Processing) {
+				continue
+			}
+			_, meta, err := w.imageFile(ctx, image)
+			if err != nil {
+				// Reported while saving the file
+				log.Debugf("Pre-flight: %v", err)
+				continue
+			}
+			dest := path.Join(works[i].folder, image.Name())
+			if fi, err := w.store.Stat(dest); err == nil && sameFile(fi, meta) {
+				continue
+			}
+			albumFiles++
+			albumSize += meta.Size
+		}
+		if albumFiles > 0 {
+			log.Debugf("Pre-flight: %s has %d files to download, %s", works[i].folder, albumFiles, FormatSize(albumSize))
+		}
+		files += albumFiles
+		size += albumSize
+	}
+	return files, size
+}
+
+// preflight compares the size of the files to download with the free space of the destination.
+// If there isn't enough space, it logs a warning or, with store.preflight = "abort", it returns an
+// error
+func (w *Worker) preflight(ctx context.Context, works []albumWork) error {
+	files, size := w.plannedDownloads(ctx, works)
+	report := fmt.Sprintf("%d files to download, %s", files, FormatSize(size))
+	needed := size
+	if w.cfg.MaxBytes > 0 && needed > w.cfg.MaxBytes {
+		needed = w.cfg.MaxBytes
+		report += fmt.Sprintf(" (%s allowed by store.max_bytes)", FormatSize(needed))
+	}
+
+	free, err := storageFreeSpace(w.store)
+	if err != nil {
+		log.WithError(err).Warnf("Pre-flight: %s, cannot check the free space of the destination", report)
+		return nil
+	}
+	report += fmt.Sprintf(", %s free on the destination", FormatSize(free))
+
+	if needed <= free {
+		log.Infof("Pre-flight: %s", report)
+		return nil
+	}
+	if w.cfg.Preflight == preflightAbort {
+		return fmt.Errorf("Not enough free space: %s", report)
+	}
+	log.Warnf("Pre-flight: not enough free space: %s", report)
+	return nil
+}
+
+// checkQuota tells if a file of the given size can be downloaded without exceeding the
+// store.max_bytes quota. Once the quota is reached, no other file is downloaded
+func (w *Worker) checkQuota(size int64) bool {
+	if w.cfg.MaxBytes <= 0 {
+		return true
+	}
+	if !w.quotaReached && w.downloaded+size > w.cfg.MaxBytes {
+		log.Warnf("Reached the store.max_bytes quota of %s, no other file will be downloaded", FormatSize(w.cfg.MaxBytes))
+		w.quotaReached = true
+	}
+	if w.quotaReached {
+		w.overQuota++
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package smugmug
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// spaceStorage is a memStorage with a fixed free space
+type spaceStorage struct {
+	*memStorage
+	free int64
+}
+
+func (s *spaceStorage) FreeSpace() (int64, error) {
+	return s.free, nil
+}
+
+func TestPreflight(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	s := &spaceStorage{memStorage: newMemStorage(), free: 100}
+	writeFile(t, s, "album/existing.jpg", []byte("0123456789"))
+	works := []albumWork{{
+		folder: "album",
+		images: []albumImage{
+			{FileName: "existing.jpg", ArchivedSize: 10},
+			{FileName: "new.jpg", ArchivedSize: 60},
+			{FileName: "changed.jpg", ArchivedSize: 50},
+			{FileName: "processing.mp4", IsVideo: true, Processing: true},
+		},
+	}}
+	writeFile(t, s, "album/changed.jpg", []byte("old"))
+
+	w := &Worker{cfg: &Conf{Preflight: preflightAbort}, store: s}
+	if files, size := w.plannedDownloads(context.Background(), works); files != 2 || size != 110 {
+		t.Fatalf("want 2 files and 110 bytes, got %d and %d", files, size)
+	}
+	err := w.preflight(context.Background(), works)
+	if err == nil || !strings.Contains(err.Error(), "2 files to download, 110 B") {
+		t.Fatalf("want not enough space error, got %v", err)
+	}
+
+	w.cfg.Preflight = preflightWarn
+	if err := w.preflight(context.Background(), works); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The quota limits the downloads of the run
+	w.cfg.Preflight = preflightAbort
+	w.cfg.MaxBytes = 100
+	if err := w.preflight(context.Background(), works); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.free = 1000
+	w.cfg.MaxBytes = 0
+	if err := w.preflight(context.Background(), works); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Unknown free space
+	w.store = newMemStorage()
+	if err := w.preflight(context.Background(), works); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	var downloaded []string
+	w := &Worker{
+		cfg:   &Conf{MaxBytes: 5},
+		store: newMemStorage(),
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+			downloaded = append(downloaded, dest)
+			return nil
+		},
+	}
+	for _, f := range []struct {
+		name string
+		size int64
+	}{{"a.jpg", 3}, {"b.jpg", 3}, {"c.jpg", 1}} {
+		if err := w.saveFile(context.Background(), albumImage{}, f.name, "url", FileMeta{Size: f.size}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(downloaded) != 1 || downloaded[0] != "a.jpg" || w.overQuota != 2 || w.downloaded != 3 {
+		t.Fatalf("unexpected downloads %v, over quota %d", downloaded, w.overQuota)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on Windows")
+	}
+	free, err := newLocalStorage(t.TempDir()).FreeSpace()
+	if err != nil || free <= 0 {
+		t.Fatalf("unexpected free space %d (%v)", free, err)
+	}
+}
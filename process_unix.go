@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package smugmug
+
+import "syscall"
+
+// processRunning tells if a process with the given PID is running
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package smugmug
+
+import "os"
+
+// processRunning tells if a process with the given PID is running
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,73 @@
+package smugmug
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// processingPoll is how often the videos under processing are checked at the end of the run
+const processingPoll = 30 * time.Second
+
+// errProcessing is the reason of the videos left under processing
+var errProcessing = errors.New("Video still under processing")
+
+// processingVideo is a video that was under processing when its album was saved
+type processingVideo struct {
+	image  albumImage
+	folder string
+}
+
+// deferVideo records a video under processing, to be checked again at the end of the run
+func (w *Worker) deferVideo(image albumImage, folder string) {
+	imageLog(image).WithField(fieldFile, path.Join(folder, image.Name())).Info("Video under processing, it will be checked again at the end of the run")
+	w.processing = append(w.processing, processingVideo{image: image, folder: folder})
+}
+
+// saveDeferred checks again the videos under processing and saves the ready ones. They're checked
+// every processingPoll until they're all saved or store.processing_wait has passed. The videos
+// still under processing are recorded as deferred, so that they're queued for the next runs
+func (w *Worker) saveDeferred(ctx context.Context) {
+	deadline := time.Now().Add(w.cfg.ProcessingWait)
+	for len(w.processing) > 0 && ctx.Err() == nil {
+		log.Infof("Checking %d videos under processing", len(w.processing))
+		var pending []processingVideo
+		for n, v := range w.processing {
+			if ctx.Err() != nil {
+				pending = append(pending, w.processing[n:]...)
+				break
+			}
+			image, err := w.albumImage(ctx, v.image.AlbumKey, v.image.ImageKey, v.image.AlbumPath)
+			if err != nil {
+				imageLog(v.image).WithField(fieldFile, path.Join(v.folder, v.image.Name())).WithError(err).Warn("Cannot check the video")
+				pending = append(pending, v)
+				continue
+			}
+			if image.Processing {
+				pending = append(pending, v)
+				continue
+			}
+			w.saveImages(ctx, []albumImage{image}, v.folder)
+		}
+		w.processing = pending
+
+		wait := time.Until(deadline)
+		if len(pending) == 0 || wait <= 0 {
+			break
+		}
+		if wait > processingPoll {
+			wait = processingPoll
+		}
+		if err := sleep(ctx, wait); err != nil {
+			break
+		}
+	}
+
+	for _, v := range w.processing {
+		w.fileDone(fileDeferred, v.image, path.Join(v.folder, v.image.Name()), v.image.knownSize(), errProcessing)
+	}
+	w.processing = nil
+}
@@ -0,0 +1,84 @@
+package smugmug
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// processingMockHandler returns an album with a video under processing, that is ready once
+// checked again if ready is set
+type processingMockHandler struct {
+	ready   bool
+	checked int
+}
+
+func (m *processingMockHandler) get(_ context.Context, url string, obj interface{}) error {
+	video := albumImage{FileName: "video.mp4", ImageKey: "vid1", IsVideo: true, Processing: true}
+	video.Uris.LargestVideo.Uri = "/video/vid1/largest"
+	switch url {
+	case "/api/v2!authuser":
+		obj.(*currentUser).Response.User.NickName = testUsername
+	case "/api/v2/user/" + testUsername:
+		obj.(*user).Response.User.Uris.UserAlbums.URI = userAlbumsURI
+	case userAlbumsURI:
+		a := album{AlbumKey: testAlbumKey, URLPath: albumURLPath}
+		a.Uris.AlbumImages.URI = albumImagesURI
+		obj.(*albumsResponse).Response.Album = []album{a}
+	case albumImagesURI:
+		obj.(*albumImagesResponse).Response.AlbumImage = []albumImage{video}
+	case "/api/v2/album/" + testAlbumKey + "/image/vid1":
+		m.checked++
+		video.Processing = !m.ready
+		obj.(*albumImageResponse).Response.AlbumImage = video
+	case "/video/vid1/largest":
+		v := obj.(*albumVideo)
+		v.Response.LargestVideo.Url = "https://example.com/vid1.mp4"
+		v.Response.LargestVideo.Size = 100
+	}
+	return nil
+}
+
+func TestRunProcessingVideo(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	tmpl, _ := buildFilenameTemplate("")
+	for _, ready := range []bool{true, false} {
+		dest := t.TempDir()
+		var downloads []string
+		m := &processingMockHandler{ready: ready}
+		w := &Worker{
+			cfg:   &Conf{Destination: dest},
+			store: newLocalStorage(dest),
+			req:   m,
+			downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+				downloads = append(downloads, dest)
+				return nil
+			},
+			filenameTmpl: tmpl,
+			failedPath:   filepath.Join(dest, failedFilename),
+		}
+		if err := w.Run(context.Background()); err != nil {
+			t.Fatalf("ready %v: unexpected error: %v", ready, err)
+		}
+		if m.checked != 1 {
+			t.Fatalf("ready %v: want the video checked once, got %d", ready, m.checked)
+		}
+		items, _ := readFailed(w.failedPath)
+
+		if ready {
+			if len(downloads) != 1 || w.filesDeferred != 0 || len(items) != 0 {
+				t.Fatalf("want the video downloaded, got downloads %v, %d deferred, queue %+v", downloads, w.filesDeferred, items)
+			}
+			continue
+		}
+		if len(downloads) != 0 || w.filesDeferred != 1 || w.filesFailed != 0 {
+			t.Fatalf("want the video deferred, got downloads %v, %d deferred, %d failed", downloads, w.filesDeferred, w.filesFailed)
+		}
+		if len(items) != 1 || !items[0].Deferred || items[0].ImageKey != "vid1" || items[0].Reason != errProcessing.Error() {
+			t.Fatalf("want the video queued, got %+v", items)
+		}
+	}
+}
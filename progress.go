@@ -0,0 +1,251 @@
+package smugmug
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	progressTerminalInterval = time.Second      // Refresh interval of the terminal progress line
+	progressLogInterval      = 30 * time.Second // Interval of the progress log lines
+)
+
+// progress reports the progress of the downloads: the files and bytes processed out of the
+// planned ones, the transfer rate and the estimated time to completion. When the logs are written
+// to a terminal, it's shown as a line refreshed in place, otherwise as periodic log lines.
+//
+// All the methods can be called on a nil progress, that does nothing
+type progress struct {
+	mu          sync.Mutex
+	start       time.Time
+	files       int   // Number of files planned
+	bytes       int64 // Size of the files planned
+	counts      [len(fileOutcomes)]int
+	doneBytes   int64 // Size of the processed files
+	current     int64 // Bytes received of the file being downloaded
+	transferred int64 // Bytes received from SmugMug
+
+	interval time.Duration
+	term     *terminalOutput // nil when the logs aren't written to a terminal
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// begin starts reporting the progress of the given number of files, with the given total size
+func (p *progress) begin(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.start = time.Now()
+	p.files = files
+	p.bytes = bytes
+	p.mu.Unlock()
+
+	p.interval = progressLogInterval
+	if out, ok := log.StandardLogger().Out.(*os.File); ok && isTerminal(out) {
+		p.term = &terminalOutput{out: out}
+		log.SetOutput(p.term)
+		p.interval = progressTerminalInterval
+	}
+	log.Infof("Progress: %d files to process, %s", files, FormatSize(bytes))
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run()
+}
+
+// end stops reporting the progress, restoring the log output
+func (p *progress) end() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+	if p.term != nil {
+		p.term.clear()
+		log.SetOutput(p.term.out)
+		p.term = nil
+	}
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			if p.term != nil {
+				p.term.render(p.String())
+				continue
+			}
+			log.Info(p.String())
+		}
+	}
+}
+
+// add records a processed file with the given outcome and size
+func (p *progress) add(outcome fileOutcome, size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[outcome]++
+	p.doneBytes += size
+	p.current = 0
+}
+
+// reader returns a reader counting the bytes read from r as received
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	p.mu.Lock()
+	p.current = 0
+	p.mu.Unlock()
+	return &progressReader{p: p, r: r}
+}
+
+// String returns the description of the progress, like "Progress: 120/4500 files (100 downloaded,
+// 18 skipped, 2 failed), 1.2 GiB/45.0 GiB (2%), 5.3 MiB/s, ETA 2h13m"
+func (p *progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.start)
+	skipped := p.counts[fileSkipped] + p.counts[fileRetimed] + p.counts[fileOverQuota] + p.counts[fileDeferred]
+	processed := p.counts[fileDownloaded] + skipped + p.counts[fileFailed]
+	doneBytes := p.doneBytes + p.current
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Progress: %d/%d files (%d downloaded, %d skipped, %d failed), %s/%s",
+		processed, p.files, p.counts[fileDownloaded], skipped, p.counts[fileFailed],
+		FormatSize(doneBytes), FormatSize(p.bytes))
+	if p.bytes > 0 {
+		// The sizes of the videos are known only when downloading them
+		percent := doneBytes * 100 / p.bytes
+		if percent > 100 {
+			percent = 100
+		}
+		fmt.Fprintf(&b, " (%d%%)", percent)
+	}
+	if elapsed >= time.Second {
+		fmt.Fprintf(&b, ", %s/s", FormatSize(int64(float64(p.transferred)/elapsed.Seconds())))
+	}
+	b.WriteString(", ETA ")
+	b.WriteString(p.eta(elapsed, doneBytes))
+	return b.String()
+}
+
+// eta estimates the remaining time from the rate of the bytes processed so far. The skipped files
+// are included, so that a backup with many existing files isn't estimated as a full download
+func (p *progress) eta(elapsed time.Duration, doneBytes int64) string {
+	if doneBytes <= 0 || elapsed < time.Second {
+		return "unknown"
+	}
+	remaining := p.bytes - doneBytes
+	if remaining < 0 {
+		remaining = 0
+	}
+	eta := time.Duration(float64(elapsed) * float64(remaining) / float64(doneBytes))
+	if eta < time.Minute {
+		return eta.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(eta.Round(time.Minute).String(), "0s")
+}
+
+// knownSize returns the size of the file of the image, or of the video if already retrieved
+func (i *albumImage) knownSize() int64 {
+	if i.video != nil {
+		return i.video.Response.LargestVideo.Size
+	}
+	return i.ArchivedSize
+}
+
+// worksSize returns the number of files of the albums and their total size, as known before
+// downloading them
+func worksSize(works []albumWork) (int, int64) {
+	var files int
+	var size int64
+	for _, work := range works {
+		for i := range work.images {
+			files++
+			size += work.images[i].knownSize()
+		}
+	}
+	return files, size
+}
+
+// progressReader counts the bytes read from the response body of a download
+type progressReader struct {
+	p *progress
+	r io.Reader
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.mu.Lock()
+	r.p.current += int64(n)
+	r.p.transferred += int64(n)
+	r.p.mu.Unlock()
+	return n, err
+}
+
+// terminalOutput is the log output while the progress is shown in a terminal. The progress line is
+// cleared before writing a log line and written again after it, so that it's always the last line
+type terminalOutput struct {
+	mu   sync.Mutex
+	out  *os.File
+	line string
+}
+
+func (t *terminalOutput) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.line != "" {
+		io.WriteString(t.out, "\r\x1b[K")
+	}
+	n, err := t.out.Write(b)
+	if t.line != "" {
+		io.WriteString(t.out, t.line)
+	}
+	return n, err
+}
+
+// render replaces the progress line. The line is truncated to the width of the terminal, since
+// a wrapped line couldn't be replaced
+func (t *terminalOutput) render(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w := terminalWidth(t.out); w > 1 && len(line) >= w {
+		line = line[:w-1]
+	}
+	t.line = line
+	io.WriteString(t.out, "\r\x1b[K"+line)
+}
+
+// clear removes the progress line
+func (t *terminalOutput) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.line != "" {
+		io.WriteString(t.out, "\r\x1b[K")
+		t.line = ""
+	}
+}
+
+// isTerminal tells if the file is a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
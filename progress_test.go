@@ -0,0 +1,55 @@
+package smugmug
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	var nilProgress *progress
+	nilProgress.add(fileDownloaded, 10)
+	if r := nilProgress.reader(strings.NewReader("a")); r == nil {
+		t.Fatalf("nil progress returned a nil reader")
+	}
+
+	works := []albumWork{{images: []albumImage{
+		{ArchivedSize: 100},
+		{ArchivedSize: 200},
+		{IsVideo: true, ArchivedSize: 5, video: &albumVideo{}},
+	}}}
+	works[0].images[2].video.Response.LargestVideo.Size = 700
+	files, size := worksSize(works)
+	if files != 3 || size != 1000 {
+		t.Fatalf("want 3 files and 1000 bytes, got %d and %d", files, size)
+	}
+
+	p := &progress{start: time.Now().Add(-10 * time.Second), files: files, bytes: size}
+	if got := p.String(); !strings.Contains(got, "0/3 files") || !strings.Contains(got, "ETA unknown") {
+		t.Fatalf("unexpected progress %q", got)
+	}
+
+	p.add(fileSkipped, 100)
+	if _, err := ioutil.ReadAll(p.reader(bytes.NewReader(make([]byte, 150)))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Bytes of the file being downloaded are included
+	want := "Progress: 1/3 files (0 downloaded, 1 skipped, 0 failed), 250 B/1000 B (25%), "
+	if got := p.String(); !strings.HasPrefix(got, want) || !strings.HasSuffix(got, " B/s, ETA 30s") {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	p.add(fileDownloaded, 200)
+	p.add(fileFailed, 700)
+	want = "Progress: 3/3 files (1 downloaded, 1 skipped, 1 failed), 1000 B/1000 B (100%), "
+	if got := p.String(); !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "ETA 0s") {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	p = &progress{start: time.Now().Add(-time.Hour), bytes: 100, doneBytes: 10}
+	if got := p.eta(time.Hour, 10); got != "9h0m" {
+		t.Fatalf("want 9h0m, got %s", got)
+	}
+}
@@ -0,0 +1,246 @@
+package smugmug
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reportsFolder is the folder, in the backup root, where the run reports are saved
+const reportsFolder = ".reports"
+
+// Formats of the run report
+const (
+	reportJSON = "json"
+	reportCSV  = "csv"
+)
+
+// ReportConf is the configuration of the run report
+type ReportConf struct {
+	Formats     []string // "json" and/or "csv", no report if empty
+	Destination bool     // When true, the report is saved to the .reports folder of the destination
+	Stdout      bool     // When true, the report is written to stdout
+}
+
+// Enabled tells if the report is configured
+func (c ReportConf) Enabled() bool {
+	return len(c.Formats) > 0
+}
+
+// has tells if the report is saved in the given format
+func (c ReportConf) has(format string) bool {
+	for _, f := range c.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ReportConf) validate() error {
+	for _, f := range c.Formats {
+		if f != reportJSON && f != reportCSV {
+			return fmt.Errorf("report.formats values must be \"json\" or \"csv\", got %q", f)
+		}
+	}
+	if c.Enabled() && !c.Destination && !c.Stdout {
+		return errors.New("The report must be saved to the destination and/or to stdout")
+	}
+	if c.Stdout && len(c.Formats) != 1 {
+		return errors.New("report.stdout requires a single report format")
+	}
+	return nil
+}
+
+// fileOutcome is the result of the backup of a file
+type fileOutcome int
+
+const (
+	fileDownloaded fileOutcome = iota
+	fileSkipped                // Already saved
+	fileRetimed                // Already saved, its modification time has been set
+	fileOverQuota              // Not downloaded because of store.max_bytes
+	fileDeferred               // Video still under processing, left to the next runs
+	fileFailed
+)
+
+var fileOutcomes = [...]string{"downloaded", "skipped", "retimed", "over_quota", "deferred", "failed"}
+
+func (o fileOutcome) String() string {
+	return fileOutcomes[o]
+}
+
+// reportItem is a file, or an album, in the run report
+type reportItem struct {
+	Album    string `json:"album"`
+	AlbumKey string `json:"-"`
+	File     string `json:"file,omitempty"`
+	ImageKey string `json:"image_key,omitempty"`
+	Outcome  string `json:"-"`
+	Size     int64  `json:"-"`
+	Reason   string `json:"reason"`
+}
+
+// runReport is the report of a backup run
+type runReport struct {
+	Start           time.Time    `json:"start"`
+	End             time.Time    `json:"end"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Result          string       `json:"result"` // "completed", "completed_with_errors", "interrupted" or "failed"
+	Error           string       `json:"error,omitempty"`
+	Errors          int          `json:"errors"`
+	Albums          int          `json:"albums"`
+	AlbumsDone      int          `json:"albums_done"`
+	FilesDownloaded int          `json:"files_downloaded"`
+	FilesSkipped    int          `json:"files_skipped"`
+	FilesRetimed    int          `json:"files_retimed"`
+	FilesOverQuota  int          `json:"files_over_quota"`
+	FilesDeferred   int          `json:"files_deferred"`
+	FilesFailed     int          `json:"files_failed"`
+	BytesDownloaded int64        `json:"bytes_downloaded"`
+	Failed          []reportItem `json:"failed"`
+	Deferred        []reportItem `json:"deferred"`
+
+	items []reportItem // All the processed files, for the CSV report
+}
+
+// fileDone counts a processed file with the given outcome and size. A failed file is recorded with
+// the error, for the report
+func (w *Worker) fileDone(outcome fileOutcome, image albumImage, dest string, size int64, err error) {
+	switch outcome {
+	case fileDownloaded:
+		w.filesDownloaded++
+	case fileSkipped:
+		w.filesSkipped++
+	case fileRetimed:
+		w.filesRetimed++
+	case fileDeferred:
+		w.filesDeferred++
+	case fileFailed:
+		w.filesFailed++
+	}
+	w.progress.add(outcome, size)
+	metricFiles.add(1, outcome.String())
+
+	item := reportItem{
+		Album:    image.AlbumPath,
+		AlbumKey: image.AlbumKey,
+		File:     dest,
+		ImageKey: image.ImageKey,
+		Outcome:  outcome.String(),
+		Size:     size,
+	}
+	if err != nil {
+		item.Reason = err.Error()
+	}
+	switch outcome {
+	case fileFailed:
+		w.failures = append(w.failures, item)
+	case fileDeferred:
+		w.deferred = append(w.deferred, item)
+	}
+	if w.cfg.Report.has(reportCSV) {
+		w.reportItems = append(w.reportItems, item)
+	}
+}
+
+// albumFailed counts an error of the given album, recording it for the report
+func (w *Worker) albumFailed(a album, err error) {
+	w.errors++
+	w.failures = append(w.failures, reportItem{
+		Album:    a.URLPath,
+		AlbumKey: a.AlbumKey,
+		Outcome:  fileFailed.String(),
+		Reason:   err.Error(),
+	})
+}
+
+// report returns the report of the run started at the given time, that ended with the given error
+func (w *Worker) report(start time.Time, err error, interrupted bool) *runReport {
+	end := time.Now()
+	r := &runReport{
+		Start:           start,
+		End:             end,
+		DurationSeconds: end.Sub(start).Round(time.Millisecond).Seconds(),
+		Errors:          w.errors,
+		Albums:          w.albumsTotal,
+		AlbumsDone:      w.albumsDone,
+		FilesDownloaded: w.filesDownloaded,
+		FilesSkipped:    w.filesSkipped,
+		FilesRetimed:    w.filesRetimed,
+		FilesOverQuota:  w.overQuota,
+		FilesDeferred:   w.filesDeferred,
+		FilesFailed:     w.filesFailed,
+		BytesDownloaded: w.downloaded,
+		Failed:          w.failures,
+		Deferred:        w.deferred,
+		items:           w.reportItems,
+	}
+	if r.Failed == nil {
+		r.Failed = []reportItem{}
+	}
+	if r.Deferred == nil {
+		r.Deferred = []reportItem{}
+	}
+	switch {
+	case err != nil:
+		r.Result = "failed"
+		r.Error = err.Error()
+	case interrupted:
+		r.Result = "interrupted"
+	case w.errors > 0 || w.filesFailed > 0:
+		r.Result = "completed_with_errors"
+	default:
+		r.Result = "completed"
+	}
+	return r
+}
+
+// write writes the report in the given format. The CSV report has a line for each processed file
+// and for each failed album
+func (r *runReport) write(out io.Writer, format string) error {
+	if format == reportJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"album", "file", "image_key", "outcome", "size", "reason"})
+	for _, i := range r.items {
+		cw.Write([]string{i.Album, i.File, i.ImageKey, i.Outcome, strconv.FormatInt(i.Size, 10), i.Reason})
+	}
+	for _, i := range r.Failed {
+		if i.File == "" {
+			cw.Write([]string{i.Album, "", "", i.Outcome, "", i.Reason})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// saveReport saves the report to the reports folder of the destination, in the configured formats,
+// named after the start time of the run
+func (w *Worker) saveReport(r *runReport) {
+	name := path.Join(reportsFolder, r.Start.UTC().Format(versionStampFormat))
+	for _, format := range w.cfg.Report.Formats {
+		var buf bytes.Buffer
+		if err := r.write(&buf, format); err != nil {
+			log.WithError(err).Errorf("Cannot encode the %s report", format)
+			continue
+		}
+		if err := writeStorageFile(w.store, name+"."+format, buf.Bytes()); err != nil {
+			log.WithError(err).Errorf("Cannot save the %s report", format)
+			continue
+		}
+		log.Infof("Report saved to %s.%s", name, format)
+	}
+}
@@ -0,0 +1,82 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestRunReport(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination: dest,
+			Report:      ReportConf{Formats: []string{reportJSON, reportCSV}, Destination: true},
+		},
+		store: newLocalStorage(dest),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+			if strings.HasSuffix(dest, "abc124") {
+				return errors.New("connection reset")
+			}
+			return nil
+		},
+		filenameTmpl: tmpl,
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reports, _ := filepath.Glob(filepath.Join(dest, reportsFolder, "*.json"))
+	if len(reports) != 1 {
+		t.Fatalf("want a JSON report, got %v", reports)
+	}
+	b, _ := ioutil.ReadFile(reports[0])
+	var r runReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Result != "completed_with_errors" || r.AlbumsDone != 1 || r.FilesDownloaded != 1 || r.FilesFailed != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if len(r.Failed) != 1 || r.Failed[0].ImageKey != "abc124" || r.Failed[0].Album != albumURLPath || r.Failed[0].Reason != "connection reset" {
+		t.Fatalf("unexpected failed items %+v", r.Failed)
+	}
+
+	b, _ = ioutil.ReadFile(strings.TrimSuffix(reports[0], ".json") + ".csv")
+	want := "album,file,image_key,outcome,size,reason\n" +
+		"dest_path,dest_path/abc123,abc123,downloaded,0,\n" +
+		"dest_path,dest_path/abc124,abc124,failed,0,connection reset\n"
+	if string(b) != want {
+		t.Fatalf("want CSV report %q, got %q", want, b)
+	}
+}
+
+func TestReportConf(t *testing.T) {
+	for _, c := range []ReportConf{
+		{Formats: []string{"xml"}, Destination: true},
+		{Formats: []string{reportJSON}},
+		{Formats: []string{reportJSON, reportCSV}, Stdout: true},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v: want error, got nil", c)
+		}
+	}
+	if err := (ReportConf{Destination: true}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
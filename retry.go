@@ -0,0 +1,309 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// failedFilename is the name of the file with the queue of the failed albums and files
+const failedFilename = ".smugmug-backup.failed.json"
+
+// failedItem is an album, or a file of an album, whose backup failed. The items are queued by the
+// backup runs and saved again by RetryFailed, looking them up by their keys
+type failedItem struct {
+	AlbumKey string    `json:"album_key"`
+	Album    string    `json:"album"`          // URL path of the album
+	File     string    `json:"file,omitempty"` // Empty when the whole album failed
+	ImageKey string    `json:"image_key,omitempty"`
+	Reason   string    `json:"reason"`
+	Deferred bool      `json:"deferred,omitempty"` // Video under processing
+	Attempts int       `json:"attempts"`
+	Failed   time.Time `json:"failed"` // Time of the last failure
+}
+
+// key identifies the item in the queue
+func (i failedItem) key() string {
+	return i.AlbumKey + "/" + i.ImageKey
+}
+
+// failedPath returns the path of the queue of the failed items
+func (cfg *Conf) failedPath() string {
+	return filepath.Join(cfg.stateFolder(), failedFilename)
+}
+
+// readFailed returns the queued failed items, none if the queue doesn't exist
+func readFailed(path string) ([]failedItem, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cannot read the failed items: %v", err)
+	}
+	var items []failedItem
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("Cannot read the failed items: %v", err)
+	}
+	return items, nil
+}
+
+// writeFailed saves the queue of the failed items, replacing the previous one. The file is removed
+// when the queue is empty
+func writeFailed(path string, items []failedItem) error {
+	if len(items) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot remove the failed items: %v", err)
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode the failed items: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Cannot write the failed items: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("Cannot write the failed items: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Cannot write the failed items: %v", err)
+	}
+	return nil
+}
+
+// updateFailed saves the queue with the failures and the deferred videos of the run. The queued
+// items failing again are updated, the others are kept only if keep returns true for them,
+// otherwise they have been saved by the run. It returns the number of queued items. The failures
+// without an album key can't be retried and aren't queued
+func (w *Worker) updateFailed(keep func(failedItem) bool) int {
+	if w.failedPath == "" {
+		return 0
+	}
+	previous, err := readFailed(w.failedPath)
+	if err != nil {
+		log.WithError(err).Error("Cannot update the failed items")
+		return 0
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	failed := make(map[string]failedItem)
+	var added []failedItem
+	for n, list := range [][]reportItem{w.failures, w.deferred} {
+		for _, f := range list {
+			i := failedItem{
+				AlbumKey: f.AlbumKey,
+				Album:    f.Album,
+				File:     f.File,
+				ImageKey: f.ImageKey,
+				Reason:   f.Reason,
+				Deferred: n == 1,
+				Attempts: 1,
+				Failed:   now,
+			}
+			if _, ok := failed[i.key()]; ok || i.AlbumKey == "" {
+				continue
+			}
+			failed[i.key()] = i
+			added = append(added, i)
+		}
+	}
+
+	var items []failedItem
+	for _, p := range previous {
+		if i, ok := failed[p.key()]; ok {
+			i.Attempts += p.Attempts
+			items = append(items, i)
+			delete(failed, p.key())
+			continue
+		}
+		if keep(p) {
+			items = append(items, p)
+		}
+	}
+	for _, i := range added {
+		if _, ok := failed[i.key()]; ok {
+			items = append(items, i)
+		}
+	}
+
+	if err := writeFailed(w.failedPath, items); err != nil {
+		log.WithError(err).Error("Cannot update the failed items")
+	}
+	if len(items) > 0 {
+		log.Infof("%d failed items queued in %s, run the retry-failed command to save them again", len(items), w.failedPath)
+	}
+	return len(items)
+}
+
+// RetryFailed saves again the albums and files that failed in the previous runs, without walking
+// the whole account. The images are retrieved by their keys: a failed album is saved entirely,
+// while for the other albums only the failed files are saved again. The saved items are removed
+// from the queue, the ones failing again are kept with the new error. With snapshots, the items
+// are saved to a new snapshot, linking all the files of the previous one like a backup run
+func (w *Worker) RetryFailed(ctx context.Context) error {
+	release, err := w.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	items, err := readFailed(w.failedPath)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		log.Info("No failed items to retry")
+		return nil
+	}
+
+	w.cfg.username, err = w.currentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("Error checking credentials: %v", err)
+	}
+	if err := w.openStorage(ctx); err != nil {
+		return err
+	}
+	log.Infof("Retrying %d failed items", len(items))
+
+	works := w.retryWorks(ctx, items)
+	done := make(map[string]bool)
+	w.progress.begin(worksSize(works))
+	for _, work := range works {
+		if ctx.Err() != nil {
+			break
+		}
+		if work.partial {
+			w.retryAlbum(ctx, work)
+		} else {
+			w.backupAlbum(ctx, work)
+		}
+		if ctx.Err() == nil {
+			done[work.album.AlbumKey] = true
+		}
+	}
+	w.saveDeferred(ctx)
+	w.progress.end()
+	interrupted := ctx.Err() != nil
+
+	if err := closeStorage(w.store, interrupted); err != nil {
+		log.WithError(err).Error("Cannot close the storage")
+		w.errors++
+	}
+
+	left := w.updateFailed(func(i failedItem) bool { return !done[i.AlbumKey] })
+	log.Infof("Summary: %d files downloaded, %d already saved, %d deferred, %d failed",
+		w.filesDownloaded, w.filesSkipped+w.filesRetimed, w.filesDeferred, w.filesFailed)
+
+	if interrupted {
+		return fmt.Errorf("Retry interrupted, %d items left in the queue", left)
+	}
+	if left > 0 || w.errors > 0 {
+		return fmt.Errorf("%d items still failing, please check logs", left)
+	}
+	log.Info("All the failed items have been saved.")
+	return nil
+}
+
+// retryWorks groups the failed items by album and retrieves the albums and the images to save
+// again. The items that can't be retrieved are queued again with the new error
+func (w *Worker) retryWorks(ctx context.Context, items []failedItem) []albumWork {
+	var keys []string
+	byAlbum := make(map[string][]failedItem)
+	for _, i := range items {
+		if _, ok := byAlbum[i.AlbumKey]; !ok {
+			keys = append(keys, i.AlbumKey)
+		}
+		byAlbum[i.AlbumKey] = append(byAlbum[i.AlbumKey], i)
+	}
+
+	var works []albumWork
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		work, err := w.retryWork(ctx, key, byAlbum[key])
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.WithError(err).Errorf("Cannot get the failed items of album %s", byAlbum[key][0].Album)
+			w.errors++
+			w.requeue(byAlbum[key], err)
+			continue
+		}
+		works = append(works, work)
+	}
+	return works
+}
+
+// retryWork returns the album with the given key and its images to save again: all of them if the
+// album failed as a whole, otherwise the ones of the failed files
+func (w *Worker) retryWork(ctx context.Context, key string, items []failedItem) (albumWork, error) {
+	var a albumResponse
+	if err := w.req.get(ctx, fmt.Sprintf("/api/v2/album/%s", key), &a); err != nil {
+		return albumWork{}, fmt.Errorf("Cannot get the album: %v", err)
+	}
+	album := a.Response.Album
+	work := albumWork{album: album, folder: albumFolder(album), partial: true}
+
+	for _, i := range items {
+		if i.ImageKey == "" {
+			images, err := w.albumImages(ctx, album.Uris.AlbumImages.URI, album.URLPath, album.AlbumKey)
+			if err != nil {
+				return albumWork{}, err
+			}
+			work.images = images
+			work.partial = false
+			return work, nil
+		}
+	}
+
+	for _, i := range items {
+		image, err := w.albumImage(ctx, key, i.ImageKey, album.URLPath)
+		if err != nil {
+			if ctx.Err() != nil {
+				return albumWork{}, ctx.Err()
+			}
+			log.WithError(err).Errorf("Cannot get the image %s of album %s", i.ImageKey, i.Album)
+			w.filesFailed++
+			w.requeue([]failedItem{i}, err)
+			continue
+		}
+		work.images = append(work.images, image)
+	}
+	return work, nil
+}
+
+// retryAlbum saves the failed images of an album, without its metadata and comments
+func (w *Worker) retryAlbum(ctx context.Context, work albumWork) {
+	if err := w.store.MkdirAll(work.folder); err != nil {
+		log.WithError(err).Errorf("cannot create the destination folder %s", work.folder)
+		w.albumFailed(work.album, fmt.Errorf("Cannot create the destination folder: %v", err))
+		return
+	}
+	w.saveImages(ctx, work.images, work.folder)
+}
+
+// requeue records the given queued items as failed again with the given error
+func (w *Worker) requeue(items []failedItem, err error) {
+	for _, i := range items {
+		w.failures = append(w.failures, reportItem{
+			Album:    i.Album,
+			AlbumKey: i.AlbumKey,
+			File:     i.File,
+			ImageKey: i.ImageKey,
+			Outcome:  fileFailed.String(),
+			Reason:   err.Error(),
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package smugmug
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+const testAlbumKey = "album1"
+
+// retryMockHandler adds to mockHandler the endpoints of a single album and image
+type retryMockHandler struct {
+	mockHandler
+}
+
+func (m *retryMockHandler) get(ctx context.Context, url string, obj interface{}) error {
+	switch url {
+	case "/api/v2/album/" + testAlbumKey:
+		a := obj.(*albumResponse)
+		a.Response.Album.AlbumKey = testAlbumKey
+		a.Response.Album.URLPath = m.albumURLPath
+		a.Response.Album.Uris.AlbumImages.URI = m.albumImagesURI
+		return nil
+	case "/api/v2/album/" + testAlbumKey + "/image/abc124":
+		r := obj.(*albumImageResponse)
+		r.Response.AlbumImage.FileName = fileName
+		r.Response.AlbumImage.ImageKey = "abc124"
+		return nil
+	case "/api/v2/album/" + testAlbumKey + "/image/gone":
+		return errors.New("Too many errors")
+	}
+	return m.mockHandler.get(ctx, url, obj)
+}
+
+func newRetryWorker(dest string, downloads *[]string, fail *bool) *Worker {
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	return &Worker{
+		cfg:   &Conf{Destination: dest},
+		store: newLocalStorage(dest),
+		req: &retryMockHandler{mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+			albumKey:       testAlbumKey,
+		}},
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+			*downloads = append(*downloads, dest)
+			if *fail && strings.HasSuffix(dest, "abc124") {
+				return errors.New("503 Service Unavailable")
+			}
+			return nil
+		},
+		filenameTmpl: tmpl,
+		failedPath:   filepath.Join(dest, failedFilename),
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	var downloads []string
+	fail := true
+	if err := newRetryWorker(dest, &downloads, &fail).Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	queue := filepath.Join(dest, failedFilename)
+	items, err := readFailed(queue)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 1 || items[0].AlbumKey != testAlbumKey || items[0].ImageKey != "abc124" || items[0].Attempts != 1 {
+		t.Fatalf("unexpected queue %+v", items)
+	}
+
+	// Still failing: the item is kept, counting the attempts
+	downloads = nil
+	err = newRetryWorker(dest, &downloads, &fail).RetryFailed(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 items still failing") {
+		t.Fatalf("want still failing error, got %v", err)
+	}
+	if len(downloads) != 1 {
+		t.Fatalf("want only the failed file downloaded, got %v", downloads)
+	}
+	items, _ = readFailed(queue)
+	if len(items) != 1 || items[0].Attempts != 2 || items[0].Reason != "503 Service Unavailable" {
+		t.Fatalf("unexpected queue %+v", items)
+	}
+
+	fail = false
+	downloads = nil
+	if err := newRetryWorker(dest, &downloads, &fail).RetryFailed(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(downloads) != 1 || downloads[0] != albumURLPath+"/abc124" {
+		t.Fatalf("want only the failed file downloaded, got %v", downloads)
+	}
+	if _, err := os.Stat(queue); !os.IsNotExist(err) {
+		t.Fatalf("want the queue removed, got %v", err)
+	}
+
+	downloads = nil
+	if err := newRetryWorker(dest, &downloads, &fail).RetryFailed(context.Background()); err != nil || len(downloads) != 0 {
+		t.Fatalf("want nothing to retry, got %v and downloads %v", err, downloads)
+	}
+}
+
+func TestRetryFailedAlbum(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	queue := filepath.Join(dest, failedFilename)
+	err := writeFailed(queue, []failedItem{
+		{AlbumKey: testAlbumKey, Album: albumURLPath, Reason: "Cannot get album images", Attempts: 1},
+		{AlbumKey: testAlbumKey, Album: albumURLPath, ImageKey: "gone", Reason: "500 Internal Server Error", Attempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The whole album is saved again, so the failed file is saved too
+	var downloads []string
+	fail := false
+	if err := newRetryWorker(dest, &downloads, &fail).RetryFailed(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(downloads) != 2 {
+		t.Fatalf("want the album downloaded, got %v", downloads)
+	}
+	if items, _ := readFailed(queue); len(items) != 0 {
+		t.Fatalf("want an empty queue, got %+v", items)
+	}
+
+	// An image that can't be retrieved is queued again
+	writeFailed(queue, []failedItem{{AlbumKey: testAlbumKey, Album: albumURLPath, ImageKey: "gone", Attempts: 1}})
+	if err := newRetryWorker(dest, &downloads, &fail).RetryFailed(context.Background()); err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if items, _ := readFailed(queue); len(items) != 1 || items[0].Attempts != 2 || !strings.Contains(items[0].Reason, "Cannot get the image") {
+		t.Fatalf("unexpected queue %+v", items)
+	}
+}
+
+func TestRetryFailedSnapshot(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	snapshots := SnapshotsConf{Enabled: true, KeepDaily: 1}
+	run := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	newWorker := func(fail bool) *Worker {
+		var downloads []string
+		w := newRetryWorker(dest, &downloads, &fail)
+		w.cfg.Snapshots = snapshots
+		store, err := newSnapshotStorage(dest, snapshots, run)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.store = store
+		download := w.downloadFn
+		w.downloadFn = func(ctx context.Context, image albumImage, dest, url string, meta FileMeta) error {
+			if err := download(ctx, image, dest, url, meta); err != nil {
+				return err
+			}
+			return writeStorageFile(store, dest, []byte(dest))
+		}
+		return w
+	}
+
+	if err := newWorker(true).Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The retry snapshot replaces the one of the run, on the same day, so it must have all the files
+	run = run.Add(time.Hour)
+	if err := newWorker(false).RetryFailed(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	list, err := Snapshots(dest)
+	if err != nil || len(list) != 1 || list[0].Name != run.Format(snapshotStampFormat) {
+		t.Fatalf("unexpected snapshots %+v (%v)", list, err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dest, snapshotsFolder, list[0].Name, filepath.FromSlash(cleanName(albumURLPath))))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("want the files of both runs in the snapshot, got %d (%v)", len(files), err)
+	}
+}
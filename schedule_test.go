@@ -0,0 +1,46 @@
+package smugmug
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	loc := time.UTC
+	from := time.Date(2021, 6, 15, 10, 30, 20, 0, loc) // Tuesday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 3 * * *", time.Date(2021, 6, 16, 3, 0, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2021, 6, 15, 10, 45, 0, 0, loc)},
+		{"30 10 * * *", time.Date(2021, 6, 16, 10, 30, 0, 0, loc)},
+		{"0 9-17/4 * * 1-5", time.Date(2021, 6, 15, 13, 0, 0, 0, loc)},
+		{"0 0 * * 7", time.Date(2021, 6, 20, 0, 0, 0, 0, loc)},
+		{"0 0 1,20 * 1", time.Date(2021, 6, 20, 0, 0, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+		{"@daily", time.Date(2021, 6, 16, 0, 0, 0, 0, loc)},
+		{"@monthly", time.Date(2021, 7, 1, 0, 0, 0, 0, loc)},
+		{"@every 6h", from.Add(6 * time.Hour)},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.spec, err)
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.spec, tt.want, got)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "@every 10s", "@yearly"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: want error, got nil", spec)
+		}
+	}
+
+	s, _ := parseSchedule("0 0 30 2 *")
+	if got := s.next(from); !got.IsZero() {
+		t.Fatalf("want no run, got %v", got)
+	}
+}
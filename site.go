@@ -0,0 +1,291 @@
+package smugmug
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// thumbsFolder is the folder, inside the site output, containing the generated thumbnails
+const thumbsFolder = "_thumbs"
+
+// folderNode is a node of the albums hierarchy. It can be a folder, an album or both
+type folderNode struct {
+	Path     string
+	Name     string
+	Album    *catalogAlbum
+	Children []*folderNode
+}
+
+// cover returns the first cover found in the node or in its children
+func (n *folderNode) cover() *catalogItem {
+	if n.Album != nil && n.Album.Cover != nil {
+		return n.Album.Cover
+	}
+	for _, c := range n.Children {
+		if cover := c.cover(); cover != nil {
+			return cover
+		}
+	}
+	return nil
+}
+
+// buildFolderTree builds the albums hierarchy from the album paths in the catalog
+func buildFolderTree(c *catalog) *folderNode {
+	root := &folderNode{Name: "Home"}
+	nodes := map[string]*folderNode{"": root}
+
+	var getNode func(p string) *folderNode
+	getNode = func(p string) *folderNode {
+		if n, ok := nodes[p]; ok {
+			return n
+		}
+		parentPath := path.Dir(p)
+		if parentPath == "." {
+			parentPath = ""
+		}
+		parent := getNode(parentPath)
+		n := &folderNode{Path: p, Name: path.Base(p)}
+		parent.Children = append(parent.Children, n)
+		nodes[p] = n
+		return n
+	}
+
+	for _, a := range c.albums {
+		p := a.Path
+		if p == "." {
+			p = ""
+		}
+		n := getNode(p)
+		n.Album = a
+		if a.Name != "" && p != "" {
+			n.Name = a.Name
+		}
+	}
+
+	var sortChildren func(n *folderNode)
+	sortChildren = func(n *folderNode) {
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Path < n.Children[j].Path })
+		for _, c := range n.Children {
+			sortChildren(c)
+		}
+	}
+	sortChildren(root)
+
+	return root
+}
+
+type siteGenerator struct {
+	destination string
+	output      string
+	tmpl        *template.Template
+}
+
+type sitePage struct {
+	Title        string
+	Breadcrumbs  []siteLink
+	Folders      []siteLink
+	Description  string
+	Comments     []comment
+	Items        []siteItem
+	SearchAction string // URL of the search form, if search is supported
+	Query        string
+}
+
+type siteLink struct {
+	Name  string
+	Href  string
+	Thumb string
+}
+
+type siteItem struct {
+	Name     string
+	Href     string
+	Thumb    string
+	Title    string
+	Caption  string
+	Date     string
+	IsVideo  bool
+	Comments []comment
+	Album    *siteLink // Set when the page lists items of different albums
+}
+
+// GenerateSite writes to the output folder an offline static HTML gallery of the backup saved in
+// destination. The gallery mirrors the albums hierarchy and links the files in the backup folder,
+// so the output is expected to stay on the same disk of the backup
+func GenerateSite(destination, output string) error {
+	var err error
+	if destination, err = filepath.Abs(destination); err != nil {
+		return err
+	}
+	if output, err = filepath.Abs(output); err != nil {
+		return err
+	}
+
+	c, err := loadCatalog(destination)
+	if err != nil {
+		return fmt.Errorf("Cannot read the backup in %s: %v", destination, err)
+	}
+	log.Infof("Found %d albums in %s", len(c.albums), destination)
+
+	tmpl, err := template.New("page").Parse(sitePageTemplate)
+	if err != nil {
+		return err
+	}
+
+	g := &siteGenerator{
+		destination: destination,
+		output:      output,
+		tmpl:        tmpl,
+	}
+	if err := g.writeNode(buildFolderTree(c), nil); err != nil {
+		return err
+	}
+
+	log.Infof("Site generated in %s", filepath.Join(output, "index.html"))
+	return nil
+}
+
+// writeNode writes the page of the node and, recursively, of its children
+func (g *siteGenerator) writeNode(n *folderNode, parents []*folderNode) error {
+	pageDir := filepath.Join(g.output, filepath.FromSlash(n.Path))
+	if err := os.MkdirAll(pageDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	page := sitePage{Title: n.Name}
+	for _, p := range parents {
+		page.Breadcrumbs = append(page.Breadcrumbs, siteLink{
+			Name: p.Name,
+			Href: relLink(pageDir, filepath.Join(g.output, filepath.FromSlash(p.Path), "index.html")),
+		})
+	}
+
+	for _, c := range n.Children {
+		link := siteLink{
+			Name: c.Name,
+			Href: relLink(pageDir, filepath.Join(g.output, filepath.FromSlash(c.Path), "index.html")),
+		}
+		if cover := c.cover(); cover != nil {
+			link.Thumb = g.thumbnail(pageDir, cover)
+		}
+		page.Folders = append(page.Folders, link)
+	}
+
+	if n.Album != nil {
+		page.Description = n.Album.Description
+		page.Comments = n.Album.Comments
+		for _, i := range n.Album.Items {
+			item := siteItem{
+				Name:     i.Name,
+				Href:     relLink(pageDir, filepath.Join(g.destination, filepath.FromSlash(i.Path()))),
+				Title:    i.Title,
+				Caption:  i.Caption,
+				IsVideo:  i.IsVideo,
+				Comments: i.Comments,
+			}
+			if !i.Date.IsZero() {
+				item.Date = i.Date.Format("2006-01-02 15:04")
+			}
+			if !i.IsVideo {
+				item.Thumb = g.thumbnail(pageDir, i)
+			}
+			page.Items = append(page.Items, item)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(pageDir, "index.html"))
+	if err != nil {
+		return err
+	}
+	if err := g.tmpl.Execute(f, page); err != nil {
+		f.Close()
+		return fmt.Errorf("Cannot write page for %s: %v", n.Path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	parents = append(parents, n)
+	for _, c := range n.Children {
+		if err := g.writeNode(c, parents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// thumbnail generates the thumbnail of the item, returning its link relative to pageDir. It
+// returns an empty string if the thumbnail can't be generated (e.g. unsupported image format)
+func (g *siteGenerator) thumbnail(pageDir string, i *catalogItem) string {
+	src := filepath.Join(g.destination, filepath.FromSlash(i.Path()))
+	dest := filepath.Join(g.output, thumbsFolder, filepath.FromSlash(i.Path())+".jpg")
+	if err := makeThumbnail(src, dest); err != nil {
+		log.Debugf("Cannot create thumbnail for %s: %v", src, err)
+		return ""
+	}
+	return relLink(pageDir, dest)
+}
+
+// relLink returns the URL of target relative to the folder from
+func relLink(from, target string) string {
+	rel, err := filepath.Rel(from, target)
+	if err != nil {
+		return ""
+	}
+	return escapePath(filepath.ToSlash(rel))
+}
+
+const sitePageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 2em 2em; background: #fafafa; color: #222; }
+nav { margin: 1em 0; color: #666; }
+nav a { color: #06c; text-decoration: none; }
+.grid { display: flex; flex-wrap: wrap; gap: 1em; }
+.card { width: 320px; background: #fff; border: 1px solid #ddd; padding: .5em; }
+.card img, .card video { width: 320px; height: 240px; object-fit: cover; background: #eee; display: block; }
+.card .placeholder { width: 320px; height: 240px; background: #eee; display: flex; align-items: center; justify-content: center; color: #888; word-break: break-all; }
+.card a { color: #222; text-decoration: none; }
+.caption { font-size: .9em; margin-top: .4em; }
+.date { font-size: .8em; color: #888; }
+.comments { font-size: .8em; color: #555; list-style: none; padding: 0; }
+</style>
+</head>
+<body>
+<nav>{{range .Breadcrumbs}}<a href="{{.Href}}">{{.Name}}</a> / {{end}}{{.Title}}</nav>
+{{if .SearchAction}}<form action="{{.SearchAction}}"><input type="search" name="q" value="{{.Query}}" placeholder="Search titles, captions, keywords"> from <input type="date" name="from"> to <input type="date" name="to"> <input type="submit" value="Search"></form>{{end}}
+<h1>{{.Title}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+{{if .Comments}}<ul class="comments">{{range .Comments}}<li><b>{{.Name}}</b> {{.Date}}: {{.Text}}</li>{{end}}</ul>{{end}}
+{{if .Folders}}
+<div class="grid">
+{{range .Folders}}<div class="card"><a href="{{.Href}}">{{if .Thumb}}<img loading="lazy" src="{{.Thumb}}" alt="">{{else}}<div class="placeholder">{{.Name}}</div>{{end}}<div class="caption">{{.Name}}</div></a></div>
+{{end}}
+</div>
+{{end}}
+{{if .Items}}
+<div class="grid">
+{{range .Items}}<div class="card">
+{{if .IsVideo}}<video controls preload="none" src="{{.Href}}"></video>{{else}}<a href="{{.Href}}">{{if .Thumb}}<img loading="lazy" src="{{.Thumb}}" alt="{{.Title}}">{{else}}<div class="placeholder">{{.Name}}</div>{{end}}</a>{{end}}
+{{if .Title}}<div class="caption"><b>{{.Title}}</b></div>{{end}}
+{{if .Caption}}<div class="caption">{{.Caption}}</div>{{end}}
+<div class="date">{{.Date}}</div>
+{{with .Album}}<div class="date"><a href="{{.Href}}">{{.Name}}</a></div>{{end}}
+{{if .Comments}}<ul class="comments">{{range .Comments}}<li><b>{{.Name}}</b>: {{.Text}}</li>{{end}}</ul>{{end}}
+</div>
+{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`
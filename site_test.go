@@ -0,0 +1,66 @@
+package smugmug
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestGenerateSite(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	out := filepath.Join(dest, "_site")
+	albumDir := filepath.Join(dest, "Folder", "Album")
+
+	writeTestImage(t, filepath.Join(albumDir, "a.png"), 800, 600)
+	if err := ioutil.WriteFile(filepath.Join(albumDir, "movie.mp4"), []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := writeJSON(newLocalStorage(dest), "Folder/Album/"+albumMetadataFilename, albumMetadata{
+		Name: "My Album",
+		Images: []albumImageMetadata{
+			{ImageKey: "keyA", LocalName: "a.png", Caption: "A <nice> caption"},
+			{ImageKey: "keyV", LocalName: "movie.mp4", IsVideo: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GenerateSite(dest, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(out, "index.html"))
+	if err != nil {
+		t.Fatalf("index not generated: %v", err)
+	}
+	if !strings.Contains(string(index), `href="Folder/index.html"`) {
+		t.Fatalf("index doesn't link the folder:\n%s", index)
+	}
+
+	page, err := ioutil.ReadFile(filepath.Join(out, "Folder", "Album", "index.html"))
+	if err != nil {
+		t.Fatalf("album page not generated: %v", err)
+	}
+	for _, s := range []string{
+		"A &lt;nice&gt; caption",
+		`src="../../_thumbs/Folder/Album/a.png.jpg"`,
+		`href="../../../Folder/Album/a.png"`,
+		`<video controls preload="none" src="../../../Folder/Album/movie.mp4">`,
+	} {
+		if !strings.Contains(string(page), s) {
+			t.Fatalf("album page doesn't contain %s:\n%s", s, page)
+		}
+	}
+
+	thumb := filepath.Join(out, thumbsFolder, "Folder", "Album", "a.png.jpg")
+	if _, err := os.Stat(thumb); err != nil {
+		t.Fatalf("thumbnail not generated: %v", err)
+	}
+}
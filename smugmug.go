@@ -1,11 +1,12 @@
 package smugmug
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
 	"os"
-	"path/filepath"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -13,14 +14,36 @@ import (
 
 // Conf is the configuration of the smugmug worker
 type Conf struct {
-	ApiKey             string // API key
-	ApiSecret          string // API secret
-	UserToken          string // User token
-	UserSecret         string // User secret
-	Destination        string // Backup destination folder
-	Filenames          string // Template for files naming
-	UseMetadataTimes   bool   // When true, the last update timestamp will be retrieved from metadata
-	ForceMetadataTimes bool   // When true, then the last update timestamp is always retrieved and overwritten, also for existing files
+	ApiKey             string         // API key
+	ApiSecret          string         // API secret
+	UserToken          string         // User token
+	UserSecret         string         // User secret
+	Destination        string         // Backup destination folder
+	Filenames          string         // Template for files naming
+	UseMetadataTimes   bool           // When true, the last update timestamp will be retrieved from metadata
+	ForceMetadataTimes bool           // When true, then the last update timestamp is always retrieved and overwritten, also for existing files
+	AlbumMetadata      bool           // When true, an album.json file with the album metadata is saved in each album folder
+	AlbumPassword      bool           // When true, the album password is saved in album.json too
+	Comments           bool           // When true, a comments.json file with the album and images comments is saved in each album folder
+	Backend            string         // Storage backend: "local" (default), "s3", "sftp" or "webdav"
+	Backends           []string       // Multiple storage backends, overriding Backend when not empty
+	Archive            string         // When set, images and videos are saved in "tar", "tar.zst" or "zip" archives
+	ArchivePer         string         // Create an archive per "album" (default) or per "run"
+	Dedup              string         // When set, media are saved once and linked in the albums with a "hardlink" or a "symlink"
+	Preflight          string         // When set, check the free space before downloading and "warn" or "abort" if not enough
+	MaxBytes           int64          // Maximum number of bytes downloaded by a run, 0 for no limit
+	LockWait           time.Duration  // How long to wait for another run on the same destination, 0 to fail immediately
+	ProcessingWait     time.Duration  // How long to wait at the end of the run for the videos under processing
+	S3                 S3Conf         // Configuration of the s3 backend
+	SFTP               SFTPConf       // Configuration of the sftp backend
+	WebDAV             WebDAVConf     // Configuration of the webdav backend
+	Encryption         EncryptionConf // Configuration of the client-side encryption
+	Snapshots          SnapshotsConf  // Configuration of the snapshots of the local backend
+	Versions           VersionsConf   // Configuration of the previous versions of the replaced files
+	Daemon             DaemonConf     // Configuration of the daemon mode
+	Report             ReportConf     // Configuration of the run report
+	Metrics            MetricsConf    // Configuration of the Prometheus metrics
+	Notify             NotifyConf     // Configuration of the notifications of the runs
 
 	username string
 }
@@ -51,6 +74,26 @@ func (cfg *Conf) overrideEnvConf() {
 	if os.Getenv("SMGMG_BK_FILE_NAMES") != "" {
 		cfg.Filenames = os.Getenv("SMGMG_BK_FILE_NAMES")
 	}
+
+	if os.Getenv("SMGMG_BK_S3_ACCESS_KEY") != "" {
+		cfg.S3.AccessKey = os.Getenv("SMGMG_BK_S3_ACCESS_KEY")
+	}
+
+	if os.Getenv("SMGMG_BK_S3_SECRET_KEY") != "" {
+		cfg.S3.SecretKey = os.Getenv("SMGMG_BK_S3_SECRET_KEY")
+	}
+
+	if os.Getenv("SMGMG_BK_WEBDAV_PASSWORD") != "" {
+		cfg.WebDAV.Password = os.Getenv("SMGMG_BK_WEBDAV_PASSWORD")
+	}
+
+	if os.Getenv("SMGMG_BK_ENCRYPTION_PASSPHRASE") != "" {
+		cfg.Encryption.Passphrase = os.Getenv("SMGMG_BK_ENCRYPTION_PASSPHRASE")
+	}
+
+	if os.Getenv("SMGMG_BK_SMTP_PASSWORD") != "" {
+		cfg.Notify.SMTP.Password = os.Getenv("SMGMG_BK_SMTP_PASSWORD")
+	}
 }
 
 func (cfg *Conf) validate() error {
@@ -70,18 +113,141 @@ func (cfg *Conf) validate() error {
 		return errors.New("UserSecret can't be empty")
 	}
 
-	if cfg.Destination == "" {
-		return errors.New("Destination can't be empty")
+	seen := make(map[string]bool)
+	for _, backend := range cfg.backends() {
+		if seen[backend] {
+			return fmt.Errorf("Storage backend %q is listed more than once", backend)
+		}
+		seen[backend] = true
+		if err := cfg.validateBackend(backend); err != nil {
+			return err
+		}
+	}
+
+	switch cfg.Archive {
+	case "", archiveTar, archiveTarZst, archiveZip:
+	default:
+		return fmt.Errorf("Unknown archive format %q", cfg.Archive)
+	}
+
+	switch cfg.ArchivePer {
+	case "", "album", "run":
+	default:
+		return fmt.Errorf("store.archive_per must be \"album\" or \"run\", got %q", cfg.ArchivePer)
+	}
+
+	switch cfg.Dedup {
+	case "":
+	case dedupHardlink, dedupSymlink:
+		if !cfg.hasLocalBackend() {
+			return errors.New("store.dedup is supported only by the local backend")
+		}
+		if cfg.Archive != "" {
+			return errors.New("store.dedup can't be used with store.archive")
+		}
+		if cfg.Encryption.Enabled() {
+			return errors.New("store.dedup can't be used with the encryption")
+		}
+	default:
+		return fmt.Errorf("store.dedup must be \"hardlink\" or \"symlink\", got %q", cfg.Dedup)
+	}
+
+	switch cfg.Preflight {
+	case "", preflightWarn, preflightAbort:
+	default:
+		return fmt.Errorf("store.preflight must be \"warn\" or \"abort\", got %q", cfg.Preflight)
+	}
+
+	if cfg.MaxBytes < 0 {
+		return errors.New("store.max_bytes can't be negative")
+	}
+
+	if cfg.LockWait < 0 {
+		return errors.New("store.lock_wait can't be negative")
+	}
+
+	if cfg.ProcessingWait < 0 {
+		return errors.New("store.processing_wait can't be negative")
 	}
 
-	// Check exising and writeability of destination folder
-	if err := checkDestFolder(cfg.Destination); err != nil {
-		return fmt.Errorf("Can't find in the destination folder %s: %v", cfg.Destination, err)
+	if err := cfg.Encryption.validate(); err != nil {
+		return err
+	}
+
+	if cfg.Snapshots.Enabled {
+		if !cfg.hasLocalBackend() {
+			return errors.New("Snapshots are supported only by the local backend")
+		}
+		if cfg.Archive != "" || cfg.Dedup != "" {
+			return errors.New("Snapshots can't be used with store.archive or store.dedup")
+		}
+	}
+	if err := cfg.Snapshots.validate(); err != nil {
+		return err
+	}
+
+	if cfg.Versions.Enabled && (cfg.Archive != "" || cfg.Dedup != "") {
+		return errors.New("Versions can't be used with store.archive or store.dedup")
+	}
+	if err := cfg.Versions.validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Report.validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Notify.validate(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// backends returns the configured storage backends
+func (cfg *Conf) backends() []string {
+	if len(cfg.Backends) > 0 {
+		return cfg.Backends
+	}
+	if cfg.Backend == "" {
+		return []string{"local"}
+	}
+	return []string{cfg.Backend}
+}
+
+// hasLocalBackend tells if the backup is saved to the local destination folder
+func (cfg *Conf) hasLocalBackend() bool {
+	for _, backend := range cfg.backends() {
+		if backend == "local" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Conf) validateBackend(backend string) error {
+	switch backend {
+	case "local":
+		if cfg.Destination == "" {
+			return errors.New("Destination can't be empty")
+		}
+
+		// Check exising and writeability of destination folder
+		if err := checkDestFolder(cfg.Destination); err != nil {
+			return fmt.Errorf("Can't find in the destination folder %s: %v", cfg.Destination, err)
+		}
+	case "s3":
+		return cfg.S3.validate()
+	case "sftp":
+		return cfg.SFTP.validate()
+	case "webdav":
+		return cfg.WebDAV.validate()
+	default:
+		return fmt.Errorf("Unknown storage backend %q", backend)
+	}
+	return nil
+}
+
 // ReadConf produces a configuration object for the Smugmug worker.
 //
 // It reads the configuration from ./config.toml or "$HOME/.smgmg/config.toml"
@@ -93,6 +259,12 @@ func ReadConf() (*Conf, error) {
 
 	// defaults
 	viper.SetDefault("store.file_names", "{{.FileName}}")
+	viper.SetDefault("store.backend", "local")
+	viper.SetDefault("store.archive_per", "album")
+	viper.SetDefault("report.destination", true)
+	viper.SetDefault("sftp.port", 22)
+	viper.SetDefault("notify.smtp.port", 587)
+	viper.SetDefault("sftp.known_hosts", "$HOME/.ssh/known_hosts")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -115,6 +287,84 @@ func ReadConf() (*Conf, error) {
 		Filenames:          viper.GetString("store.file_names"),
 		UseMetadataTimes:   viper.GetBool("store.use_metadata_times"),
 		ForceMetadataTimes: viper.GetBool("store.force_metadata_times"),
+		AlbumMetadata:      viper.GetBool("store.album_metadata"),
+		AlbumPassword:      viper.GetBool("store.album_password"),
+		Comments:           viper.GetBool("store.comments"),
+		Backend:            viper.GetString("store.backend"),
+		Backends:           viper.GetStringSlice("store.backends"),
+		Archive:            viper.GetString("store.archive"),
+		ArchivePer:         viper.GetString("store.archive_per"),
+		Dedup:              viper.GetString("store.dedup"),
+		Preflight:          viper.GetString("store.preflight"),
+		MaxBytes:           viper.GetInt64("store.max_bytes"),
+		LockWait:           viper.GetDuration("store.lock_wait"),
+		ProcessingWait:     viper.GetDuration("store.processing_wait"),
+		S3: S3Conf{
+			Endpoint:  viper.GetString("s3.endpoint"),
+			Region:    viper.GetString("s3.region"),
+			Bucket:    viper.GetString("s3.bucket"),
+			Prefix:    viper.GetString("s3.prefix"),
+			AccessKey: viper.GetString("s3.access_key"),
+			SecretKey: viper.GetString("s3.secret_key"),
+			PathStyle: viper.GetBool("s3.path_style"),
+			PartSize:  viper.GetInt64("s3.part_size"),
+		},
+		SFTP: SFTPConf{
+			Host:       viper.GetString("sftp.host"),
+			Port:       viper.GetInt("sftp.port"),
+			User:       viper.GetString("sftp.user"),
+			KeyFile:    os.ExpandEnv(viper.GetString("sftp.key_file")),
+			KnownHosts: os.ExpandEnv(viper.GetString("sftp.known_hosts")),
+			Root:       viper.GetString("sftp.root"),
+		},
+		WebDAV: WebDAVConf{
+			URL:      viper.GetString("webdav.url"),
+			User:     viper.GetString("webdav.user"),
+			Password: viper.GetString("webdav.password"),
+			SetMtime: viper.GetBool("webdav.set_mtime"),
+		},
+		Encryption: EncryptionConf{
+			KeyFile:      os.ExpandEnv(viper.GetString("encryption.key_file")),
+			Passphrase:   viper.GetString("encryption.passphrase"),
+			EncryptNames: viper.GetBool("encryption.encrypt_names"),
+		},
+		Snapshots: SnapshotsConf{
+			Enabled:     viper.GetBool("snapshots.enabled"),
+			KeepDaily:   viper.GetInt("snapshots.keep_daily"),
+			KeepWeekly:  viper.GetInt("snapshots.keep_weekly"),
+			KeepMonthly: viper.GetInt("snapshots.keep_monthly"),
+		},
+		Versions: VersionsConf{
+			Enabled:    viper.GetBool("versions.enabled"),
+			MaxPerFile: viper.GetInt("versions.max_per_file"),
+			MaxBytes:   viper.GetInt64("versions.max_bytes"),
+		},
+		Report: ReportConf{
+			Formats:     viper.GetStringSlice("report.formats"),
+			Destination: viper.GetBool("report.destination"),
+			Stdout:      viper.GetBool("report.stdout"),
+		},
+		Metrics: MetricsConf{
+			Listen:   viper.GetString("metrics.listen"),
+			Textfile: viper.GetString("metrics.textfile"),
+		},
+		Notify: NotifyConf{
+			WebhookURL:   viper.GetString("notify.webhook_url"),
+			PingURL:      viper.GetString("notify.ping_url"),
+			OnlyFailures: viper.GetBool("notify.only_failures"),
+			SMTP: SMTPConf{
+				Host:     viper.GetString("notify.smtp.host"),
+				Port:     viper.GetInt("notify.smtp.port"),
+				Username: viper.GetString("notify.smtp.username"),
+				Password: viper.GetString("notify.smtp.password"),
+				From:     viper.GetString("notify.smtp.from"),
+				To:       viper.GetStringSlice("notify.smtp.to"),
+			},
+		},
+		Daemon: DaemonConf{
+			Schedule:   viper.GetString("daemon.schedule"),
+			RunOnStart: viper.GetBool("daemon.run_on_start"),
+		},
 	}
 
 	cfg.overrideEnvConf()
@@ -130,9 +380,30 @@ func ReadConf() (*Conf, error) {
 type Worker struct {
 	req          requestsHandler
 	cfg          *Conf
+	store        Storage
 	errors       int
-	downloadFn   func(string, string, int64) (bool, error) // defined in struct for better testing
+	downloadFn   func(context.Context, albumImage, string, string, FileMeta) error // defined in struct for better testing
 	filenameTmpl *template.Template
+	versions     *versionKeeper // nil unless the versions are enabled
+	lockPath     string         // Lock file of the destination, no lock if empty
+	failedPath   string         // Queue of the failed items, not saved if empty
+	progress     *progress      // nil to not report the progress
+	downloaded   int64          // Bytes downloaded by the run
+	quotaReached bool           // Set when store.max_bytes is reached
+	overQuota    int            // Number of files not downloaded because of store.max_bytes
+
+	albumsTotal     int // Number of albums of the account
+	albumsDone      int // Number of albums completely processed
+	filesDownloaded int // Number of files downloaded
+	filesSkipped    int // Number of files already saved
+	filesRetimed    int // Number of files already saved whose modification time has been set
+	filesDeferred   int // Number of videos left under processing
+	filesFailed     int // Number of files that couldn't be saved
+
+	processing  []processingVideo // Videos under processing, checked again at the end of the run
+	failures    []reportItem      // Failed albums and files
+	deferred    []reportItem      // Videos left under processing
+	reportItems []reportItem      // All the processed files, only when the CSV report is enabled
 }
 
 // New return a SmugMug backup configuration. It returns an error if it fails parsing
@@ -142,19 +413,48 @@ func New(cfg *Conf) (*Worker, error) {
 		return nil, err
 	}
 
-	handler := newHTTPHandler(cfg.ApiKey, cfg.ApiSecret, cfg.UserToken, cfg.UserSecret)
+	// The storage is opened by Run and RetryFailed after acquiring the lock, since opening some
+	// storages changes the destination
+	handler := newHTTPHandler(cfg.ApiKey, cfg.ApiSecret, cfg.UserToken, cfg.UserSecret, nil)
 
 	tmpl, err := buildFilenameTemplate(cfg.Filenames)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Worker{
+	wrk := &Worker{
 		cfg:          cfg,
 		req:          handler,
 		downloadFn:   handler.download,
 		filenameTmpl: tmpl,
-	}, nil
+		lockPath:     cfg.lockPath(),
+		failedPath:   cfg.failedPath(),
+		progress:     &progress{},
+	}
+	handler.progress = wrk.progress
+	return wrk, nil
+}
+
+// openStorage opens the storage of the configured destinations, unless already set. It must be
+// called while holding the lock: the snapshots continue the partial snapshot of an interrupted run
+// and the encryption saves its parameters in the destination. Canceling the context interrupts the
+// requests of the remote backends
+func (w *Worker) openStorage(ctx context.Context) error {
+	if w.store != nil {
+		return nil
+	}
+	store, err := newStorage(ctx, w.cfg)
+	if err != nil {
+		return err
+	}
+	w.store = store
+	if h, ok := w.req.(*handler); ok {
+		h.store = store
+	}
+	if w.cfg.Versions.Enabled {
+		w.versions = newVersionKeeper(store, w.cfg.Versions)
+	}
+	return nil
 }
 
 func buildFilenameTemplate(filenameTemplate string) (*template.Template, error) {
@@ -173,54 +473,187 @@ func buildFilenameTemplate(filenameTemplate string) (*template.Template, error)
 //
 // The workflow is the following:
 //
-//   - Get user albums
+//   - Acquire the lock of the destination, waiting for another run if store.lock_wait is set, and
+//     open its storage
+//   - Get user albums and their images
+//   - Check the free space of the destination (if enabled)
+//   - Start reporting the progress
 //   - Iterate over all albums and:
 //     - create folder
+//     - save the album metadata and comments (if enabled)
 //     - iterate over all images and videos
 //       - if existing and with the same size, then skip
 //       - if not, download
-func (w *Worker) Run() error {
+//       - if a video is under processing, defer it
+//   - Check again the deferred videos, waiting up to store.processing_wait for them
+//   - Queue the failed albums and files, for the retry-failed command
+//   - Save the run report (if enabled)
+//   - Record the metrics of the run, writing the node_exporter textfile (if enabled)
+//   - Send the notifications of the run (if enabled)
+//
+// When the context is canceled, the in-flight download is aborted and the partial file discarded,
+// the storage is closed (keeping what has been completed) and an error is returned with a summary
+// of the completed work
+func (w *Worker) Run(ctx context.Context) error {
+	release, err := w.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := w.openStorage(ctx); err != nil {
+		return err
+	}
+
+	w.notifyStart()
+	start := time.Now()
+	err = w.backup(ctx)
+	interrupted := ctx.Err() != nil
+	if err == nil {
+		// The run processed all the albums, unless interrupted: the queued items it didn't reach
+		// are kept for the next one
+		w.updateFailed(func(failedItem) bool { return interrupted })
+	}
+
+	rep := w.report(start, err, interrupted)
+	if w.cfg.Report.Enabled() && w.cfg.Report.Destination {
+		w.saveReport(rep)
+	}
+
+	// A failed run is aborted, like an interrupted one, so that it isn't taken as complete
+	if err := closeStorage(w.store, interrupted || err != nil); err != nil {
+		log.WithError(err).Error("Cannot close the storage")
+		w.errors++
+		if rep.Result == "completed" {
+			rep.Result = "completed_with_errors"
+		}
+	}
+	rep.Errors = w.errors
+
+	log.Infof("Summary: %d of %d albums completed, %d files downloaded, %d already saved, %d deferred, %d failed",
+		w.albumsDone, w.albumsTotal, w.filesDownloaded, w.filesSkipped+w.filesRetimed, w.filesDeferred, w.filesFailed)
+	// The failed files don't count as errors, so the result of the report is used
+	success := rep.Result == "completed"
+	w.recordRun(start, rep.Result)
+	w.notifyEnd(rep, success)
+
+	if w.cfg.Report.Enabled() && w.cfg.Report.Stdout {
+		if err := rep.write(os.Stdout, w.cfg.Report.Formats[0]); err != nil {
+			log.WithError(err).Error("Cannot write the report")
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if interrupted {
+		return fmt.Errorf("Backup interrupted: %d of %d albums completed, the next run will continue from there", w.albumsDone, w.albumsTotal)
+	}
+
+	if w.overQuota > 0 {
+		log.Warnf("%d files not downloaded because of the store.max_bytes quota, they'll be downloaded by the next runs", w.overQuota)
+	}
+
+	if w.errors > 0 {
+		return fmt.Errorf("Completed with %d errors, please check logs", w.errors)
+	}
+
+	log.Info("Backup completed.")
+	return nil
+}
+
+// backup gets the albums and saves them. It returns an error if the backup can't be performed at
+// all, while the errors of the single albums and files are logged and counted
+func (w *Worker) backup(ctx context.Context) error {
 	var err error
-	w.cfg.username, err = w.currentUser()
+	w.cfg.username, err = w.currentUser(ctx)
 	if err != nil {
 		return fmt.Errorf("Error checking credentials: %v", err)
 	}
 
 	// Get user albums
 	log.Infof("Getting albums for user %s...\n", w.cfg.username)
-	albums, err := w.userAlbums()
+	albums, err := w.userAlbums(ctx)
 	if err != nil {
 		return fmt.Errorf("Error getting user albums: %v", err)
 	}
 
 	log.Infof("Found %d albums\n", len(albums))
+	w.albumsTotal = len(albums)
 
+	var works []albumWork
 	for _, album := range albums {
-		folder := filepath.Join(w.cfg.Destination, album.URLPath)
-
-		if err := createFolder(folder); err != nil {
-			log.WithError(err).Errorf("cannot create the destination folder %s", folder)
-			w.errors++
-			continue
+		if ctx.Err() != nil {
+			break
 		}
-
 		log.Debugf("[ALBUM IMAGES] %s", album.Uris.AlbumImages.URI)
-		images, err := w.albumImages(album.Uris.AlbumImages.URI, album.URLPath)
+		images, err := w.albumImages(ctx, album.Uris.AlbumImages.URI, album.URLPath, album.AlbumKey)
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			log.WithError(err).Errorf("Cannot get album images for %s", album.Uris.AlbumImages.URI)
-			w.errors++
+			w.albumFailed(album, err)
 			continue
 		}
 
 		log.Debugf("Got album images for %s", album.Uris.AlbumImages.URI)
 		log.Debugf("%+v", images)
-		w.saveImages(images, folder)
+		works = append(works, albumWork{album: album, folder: albumFolder(album), images: images})
 	}
 
-	if w.errors > 0 {
-		return fmt.Errorf("Completed with %d errors, please check logs", w.errors)
+	if w.cfg.Preflight != "" && ctx.Err() == nil {
+		if err := w.preflight(ctx, works); err != nil {
+			return err
+		}
 	}
 
-	log.Info("Backup completed.")
+	w.progress.begin(worksSize(works))
+	for _, work := range works {
+		if ctx.Err() != nil {
+			break
+		}
+		w.backupAlbum(ctx, work)
+		if ctx.Err() == nil {
+			w.albumsDone++
+		}
+	}
+	w.saveDeferred(ctx)
+	w.progress.end()
 	return nil
 }
+
+// fillStatus copies the counters of the run to the status
+func (w *Worker) fillStatus(s *RunStatus) {
+	s.Albums = w.albumsTotal
+	s.AlbumsDone = w.albumsDone
+	s.FilesDownloaded = w.filesDownloaded
+	s.FilesSkipped = w.filesSkipped
+	s.FilesDeferred = w.filesDeferred
+	s.FilesFailed = w.filesFailed
+}
+
+// backupAlbum creates the album folder and saves the album metadata, comments, images and videos
+func (w *Worker) backupAlbum(ctx context.Context, work albumWork) {
+	if err := w.store.MkdirAll(work.folder); err != nil {
+		log.WithError(err).Errorf("cannot create the destination folder %s", work.folder)
+		w.albumFailed(work.album, fmt.Errorf("Cannot create the destination folder: %v", err))
+		return
+	}
+
+	if w.cfg.AlbumMetadata {
+		if err := w.saveAlbumMetadata(ctx, work.album, work.images, work.folder); err != nil {
+			log.WithError(err).Errorf("Cannot save album metadata for %s", work.album.URLPath)
+			w.albumFailed(work.album, fmt.Errorf("Cannot save album metadata: %v", err))
+		}
+	}
+
+	if w.cfg.Comments {
+		if err := w.saveAlbumComments(ctx, work.album, work.images, work.folder); err != nil {
+			log.WithError(err).Errorf("Cannot save album comments for %s", work.album.URLPath)
+			w.albumFailed(work.album, fmt.Errorf("Cannot save album comments: %v", err))
+		}
+	}
+
+	w.saveImages(ctx, work.images, work.folder)
+}
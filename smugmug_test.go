@@ -1,10 +1,13 @@
 package smugmug
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/spf13/viper"
@@ -22,9 +25,10 @@ type mockHandler struct {
 	userAlbumsURI  string
 	albumURLPath   string
 	albumImagesURI string
+	albumKey       string
 }
 
-func (m *mockHandler) get(url string, obj interface{}) error {
+func (m *mockHandler) get(_ context.Context, url string, obj interface{}) error {
 	switch url {
 	case "/api/v2!authuser":
 		var u *currentUser
@@ -42,6 +46,7 @@ func (m *mockHandler) get(url string, obj interface{}) error {
 	case m.userAlbumsURI:
 		albumObj := album{}
 		albumObj.URLPath = m.albumURLPath
+		albumObj.AlbumKey = m.albumKey
 		albumObj.Uris.AlbumImages.URI = m.albumImagesURI
 		albumObjs := []album{albumObj}
 		// albumObjs = append(albumObjs, albumObj)
@@ -80,19 +85,20 @@ func TestRun(t *testing.T) {
 		cfg: &Conf{
 			Destination: dest_dir,
 		},
+		store: newLocalStorage(dest_dir),
 		req: &mockHandler{
 			username:       testUsername,
 			userAlbumsURI:  userAlbumsURI,
 			albumURLPath:   albumURLPath,
 			albumImagesURI: albumImagesURI,
 		},
-		downloadFn: func(_, _ string, _ int64) (bool, error) {
+		downloadFn: func(_ context.Context, _ albumImage, _, _ string, _ FileMeta) error {
 			downloadCalled++
-			return true, nil
+			return nil
 		},
 		filenameTmpl: tmpl,
 	}
-	w.Run()
+	w.Run(context.Background())
 
 	dst := filepath.Join(dest_dir, albumURLPath)
 	if _, err := os.Stat(dst); err != nil {
@@ -104,6 +110,94 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunInterrupted(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest_dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var downloadCalled int
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination: dest_dir,
+		},
+		store: newLocalStorage(dest_dir),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn: func(ctx context.Context, _ albumImage, _, _ string, _ FileMeta) error {
+			downloadCalled++
+			cancel()
+			return ctx.Err()
+		},
+		filenameTmpl: tmpl,
+	}
+	err := w.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "interrupted: 0 of 1 albums") {
+		t.Fatalf("want interrupted error, got %v", err)
+	}
+	if downloadCalled != 1 || w.filesFailed != 0 || w.errors != 0 {
+		t.Fatalf("unexpected %d downloads, %d failed files, %d errors", downloadCalled, w.filesFailed, w.errors)
+	}
+}
+
+func TestRunAlbumMetadata(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest_dir := t.TempDir()
+
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{
+			Destination:   dest_dir,
+			AlbumMetadata: true,
+		},
+		store: newLocalStorage(dest_dir),
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		downloadFn: func(_ context.Context, _ albumImage, _, _ string, _ FileMeta) error {
+			return nil
+		},
+		filenameTmpl: tmpl,
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dest_dir, albumURLPath, albumMetadataFilename))
+	if err != nil {
+		t.Fatalf("album metadata not saved: %v", err)
+	}
+	var m albumMetadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("cannot decode album metadata: %v", err)
+	}
+
+	if m.URLPath != albumURLPath {
+		t.Fatalf("UrlPath: want %s, got %s", albumURLPath, m.URLPath)
+	}
+	if len(m.Images) != 2 {
+		t.Fatalf("images: want %d, got %d", 2, len(m.Images))
+	}
+	for i, key := range []string{"abc123", "abc124"} {
+		if m.Images[i].ImageKey != key {
+			t.Fatalf("image #%d: want %s, got %s", i, key, m.Images[i].ImageKey)
+		}
+		if m.Images[i].LocalName != key {
+			t.Fatalf("image #%d local name: want %s, got %s", i, key, m.Images[i].LocalName)
+		}
+	}
+}
+
 type testConf struct {
 	username    string
 	destination string
@@ -0,0 +1,231 @@
+package smugmug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Storage is the destination where the backup is saved. All names are slash separated paths,
+// relative to the root of the destination.
+//
+// Implementations must return an error satisfying os.IsNotExist when a file doesn't exist.
+type Storage interface {
+	// Stat returns the info of the named file
+	Stat(name string) (FileInfo, error)
+	// Open returns a reader of the content of the named file
+	Open(name string) (io.ReadCloser, error)
+	// Create returns a writer for the named file. The content is visible under its final name
+	// only after a successful Commit, with the modification time set to meta.ModTime when not
+	// zero. Backends supporting it save the rest of meta along with the file
+	Create(name string, meta FileMeta) (FileWriter, error)
+	// Chtimes sets the modification time of the named file
+	Chtimes(name string, mtime time.Time) error
+	// List returns the files and folders contained in the named folder
+	List(dir string) ([]FileInfo, error)
+	// Remove deletes the named file
+	Remove(name string) error
+	// MkdirAll creates the named folder, along with any necessary parents
+	MkdirAll(dir string) error
+}
+
+// FileInfo describes a file in a Storage
+type FileInfo struct {
+	Name    string // Base name of the file
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	MD5     string // Hex MD5 of the content, empty if the backend doesn't know it
+}
+
+// FileMeta describes a file that is going to be written to a Storage
+type FileMeta struct {
+	Size      int64     // Expected size of the content
+	MD5       string    // Expected hex MD5 of the content, if known
+	ImageKey  string    // SmugMug image key
+	UploadKey string    // SmugMug upload key
+	ModTime   time.Time // Modification time of the file, zero to use the current time
+}
+
+// sameFile tells if the existing file matches the expected one, comparing the sizes and, when
+// both are known, the MD5 hashes
+func sameFile(fi FileInfo, meta FileMeta) bool {
+	if fi.Size != meta.Size {
+		return false
+	}
+	if fi.MD5 != "" && meta.MD5 != "" && !strings.EqualFold(fi.MD5, meta.MD5) {
+		return false
+	}
+	return true
+}
+
+// FileWriter writes the content of a file to a Storage
+type FileWriter interface {
+	io.Writer
+	// Commit completes the write, making the file available under its final name
+	Commit() error
+	// Close releases the writer resources. If called before Commit, the file is discarded
+	Close() error
+}
+
+// renamer is implemented by the storages that can move a file without copying its content
+type renamer interface {
+	// Rename moves the file oldname to newname, creating the newname folder if needed and
+	// replacing the existing file
+	Rename(oldname, newname string) error
+}
+
+// renameFile moves a file of the storage. Storages that don't implement renamer copy the content
+// to the new name, with the same modification time, and remove the old file
+func renameFile(s Storage, oldname, newname string) error {
+	if r, ok := s.(renamer); ok {
+		return r.Rename(oldname, newname)
+	}
+
+	fi, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	r, err := s.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := s.Create(newname, FileMeta{Size: fi.Size, MD5: fi.MD5, ModTime: fi.ModTime})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	return s.Remove(oldname)
+}
+
+// aborter is implemented by the storages that must be closed differently when the backup is
+// interrupted
+type aborter interface {
+	// Abort closes the storage, leaving the backup as incomplete
+	Abort() error
+}
+
+// closeStorage closes the storage, if it needs to be closed. When aborted is true, the storages
+// implementing aborter are aborted instead
+func closeStorage(s Storage, aborted bool) error {
+	if a, ok := s.(aborter); ok && aborted {
+		return a.Abort()
+	}
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// newStorage returns the Storage of the configured backends. With multiple backends, the files
+// are saved to all of them. The configuration is expected to be already validated. The context is
+// used by the remote backends to cancel their requests
+func newStorage(ctx context.Context, cfg *Conf) (Storage, error) {
+	backends := cfg.backends()
+	if len(backends) == 1 {
+		return newDestinationStorage(ctx, cfg, backends[0])
+	}
+
+	stores := make([]Storage, len(backends))
+	errs := make([]error, len(backends))
+	for i, backend := range backends {
+		stores[i], errs[i] = newDestinationStorage(ctx, cfg, backend)
+	}
+	return newMultiStorage(backends, stores, errs)
+}
+
+// newDestinationStorage returns the Storage of the given backend, saving the files in archives
+// and encrypting them if enabled
+func newDestinationStorage(ctx context.Context, cfg *Conf, backend string) (Storage, error) {
+	store, err := newBackendStorage(ctx, cfg, backend)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Archive != "" {
+		store = newArchiveStorage(store, cfg.Archive, cfg.ArchivePer == "run", time.Now())
+	}
+	if cfg.Encryption.Enabled() {
+		return newCryptStorage(store, cfg.Encryption)
+	}
+	return store, nil
+}
+
+// newBackendStorage returns the Storage of the given backend
+func newBackendStorage(ctx context.Context, cfg *Conf, backend string) (Storage, error) {
+	switch backend {
+	case "s3":
+		return newS3Storage(ctx, cfg.S3), nil
+	case "sftp":
+		return newSFTPStorage(cfg.SFTP)
+	case "webdav":
+		return newWebDAVStorage(cfg.WebDAV)
+	default:
+		if cfg.Snapshots.Enabled {
+			return newSnapshotStorage(cfg.Destination, cfg.Snapshots, time.Now())
+		}
+		if cfg.Dedup != "" {
+			return newDedupStorage(cfg.Destination, cfg.Dedup == dedupSymlink), nil
+		}
+		return newLocalStorage(cfg.Destination), nil
+	}
+}
+
+// albumFolder returns the name of the folder, in the Storage, of the given album
+func albumFolder(a album) string {
+	return cleanName(a.URLPath)
+}
+
+// cleanName converts a path to a Storage name, removing leading slashes and dots
+func cleanName(p string) string {
+	p = path.Clean("/" + strings.Replace(p, "\\", "/", -1))
+	return strings.TrimPrefix(p, "/")
+}
+
+// writeJSON saves the given object, encoded as indented JSON, to the named file
+func writeJSON(s Storage, name string, obj interface{}) error {
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot encode %s: %v", name, err)
+	}
+	return writeStorageFile(s, name, b)
+}
+
+// writeStorageFile saves the given content to the named file
+func writeStorageFile(s Storage, name string, b []byte) error {
+	w, err := s.Create(name, FileMeta{Size: int64(len(b))})
+	if err != nil {
+		return fmt.Errorf("Cannot write %s: %v", name, err)
+	}
+	defer w.Close()
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("Cannot write %s: %v", name, err)
+	}
+	if err := w.Commit(); err != nil {
+		return fmt.Errorf("Cannot write %s: %v", name, err)
+	}
+	return nil
+}
+
+// readStorageJSON decodes the JSON content of the named file of a Storage
+func readStorageJSON(s Storage, name string, obj interface{}) error {
+	r, err := s.Open(name)
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %v", name, err)
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(obj); err != nil {
+		return fmt.Errorf("Cannot decode %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,484 @@
+package smugmug
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archive formats
+const (
+	archiveTar    = "tar"
+	archiveTarZst = "tar.zst"
+	archiveZip    = "zip"
+)
+
+// archiveIndexSuffix is appended to the archive name to get the name of its index file
+const archiveIndexSuffix = ".index.json"
+
+// archiveIndex is the content of the index file saved next to each archive. It lists the
+// archived files, so that later runs can skip them without reading the archive
+type archiveIndex struct {
+	Archive string              `json:"archive"`
+	Created time.Time           `json:"created"`
+	Entries []archiveIndexEntry `json:"entries"`
+}
+
+type archiveIndexEntry struct {
+	Name      string    `json:"name"` // Name of the file in the archive
+	Size      int64     `json:"size"`
+	MD5       string    `json:"md5,omitempty"`
+	ModTime   time.Time `json:"mod_time"`
+	ImageKey  string    `json:"image_key,omitempty"`
+	UploadKey string    `json:"upload_key,omitempty"`
+}
+
+// archivedFile is a file saved in an archive
+type archivedFile struct {
+	archiveIndexEntry
+	archive string // Storage name of the archive
+}
+
+// archiveStorage saves the images and videos in archives, instead of single files, in the
+// underlying storage. Each run creates new archives, one per album or a single one for the whole
+// run, containing only the files that aren't in the previous archives. The entries are streamed
+// to the archive while they're downloaded.
+//
+// Only the files with a SmugMug image key are archived, the other ones (album metadata and
+// comments) are saved as they are
+type archiveStorage struct {
+	base    Storage
+	format  string
+	perRun  bool
+	stamp   string                             // Timestamp of the run, used in the archive names
+	indexes map[string]map[string]archivedFile // Archived files by folder and name, loaded lazily
+	used    map[string]int                     // Archives created in each folder by this run
+	current *archiveWriter                     // Archive being written
+}
+
+func newArchiveStorage(base Storage, format string, perRun bool, now time.Time) *archiveStorage {
+	return &archiveStorage{
+		base:    base,
+		format:  format,
+		perRun:  perRun,
+		stamp:   now.UTC().Format("20060102T150405Z"),
+		indexes: make(map[string]map[string]archivedFile),
+		used:    make(map[string]int),
+	}
+}
+
+// archiveDir returns the folder of the archive containing the named file, and the name of the
+// file in the archive
+func (s *archiveStorage) archiveDir(name string) (string, string) {
+	name = cleanName(name)
+	if s.perRun {
+		return "", name
+	}
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	return dir, path.Base(name)
+}
+
+// index returns the files archived in the given folder, reading the index files of the archives
+// the first time
+func (s *archiveStorage) index(dir string) (map[string]archivedFile, error) {
+	if idx, ok := s.indexes[dir]; ok {
+		return idx, nil
+	}
+
+	idx := make(map[string]archivedFile)
+	files, err := s.base.List(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Archive names contain the run timestamp, so newer entries override older ones
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	for _, f := range files {
+		if f.IsDir || !strings.HasSuffix(f.Name, archiveIndexSuffix) {
+			continue
+		}
+		var ai archiveIndex
+		if err := readStorageJSON(s.base, path.Join(dir, f.Name), &ai); err != nil {
+			return nil, err
+		}
+		archive := path.Join(dir, strings.TrimSuffix(f.Name, archiveIndexSuffix))
+		for _, e := range ai.Entries {
+			idx[e.Name] = archivedFile{archiveIndexEntry: e, archive: archive}
+		}
+	}
+	s.indexes[dir] = idx
+	return idx, nil
+}
+
+// archived returns the archived file with the given name, if any
+func (s *archiveStorage) archived(name string) (archivedFile, bool, error) {
+	dir, entry := s.archiveDir(name)
+	idx, err := s.index(dir)
+	if err != nil {
+		return archivedFile{}, false, err
+	}
+	f, ok := idx[entry]
+	return f, ok, nil
+}
+
+func (s *archiveStorage) Stat(name string) (FileInfo, error) {
+	f, ok, err := s.archived(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if ok {
+		return FileInfo{Name: path.Base(name), Size: f.Size, ModTime: f.ModTime, MD5: f.MD5}, nil
+	}
+	return s.base.Stat(name)
+}
+
+func (s *archiveStorage) Open(name string) (io.ReadCloser, error) {
+	f, ok, err := s.archived(name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, fmt.Errorf("Cannot open %s: it's saved in the archive %s", name, f.archive)
+	}
+	return s.base.Open(name)
+}
+
+// Create adds a new entry to the current archive if the file has an image key, otherwise it
+// creates the file in the underlying storage
+func (s *archiveStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	if meta.ImageKey == "" {
+		return s.base.Create(name, meta)
+	}
+
+	dir, entry := s.archiveDir(name)
+	if _, err := s.index(dir); err != nil {
+		return nil, err
+	}
+	a, err := s.archive(dir)
+	if err != nil {
+		return nil, err
+	}
+	return a.create(entry, meta)
+}
+
+// archive returns the archive being written in the given folder, finishing the previous one if
+// it's in another folder
+func (s *archiveStorage) archive(dir string) (*archiveWriter, error) {
+	if s.current != nil && s.current.dir == dir {
+		return s.current, nil
+	}
+	if err := s.finish(); err != nil {
+		return nil, err
+	}
+
+	base := "smugmug"
+	if dir != "" {
+		base = path.Base(dir)
+	}
+	base += "-" + s.stamp
+	if n := s.used[dir]; n > 0 {
+		base += fmt.Sprintf("-%d", n+1)
+	}
+	s.used[dir]++
+
+	a, err := newArchiveWriter(s.base, dir, path.Join(dir, base+"."+s.format), s.format)
+	if err != nil {
+		return nil, err
+	}
+	a.onEntry = func(f archivedFile) { s.indexes[dir][f.Name] = f }
+	s.current = a
+	return a, nil
+}
+
+// finish completes the archive being written, if any
+func (s *archiveStorage) finish() error {
+	if s.current == nil {
+		return nil
+	}
+	a := s.current
+	s.current = nil
+	return a.finish()
+}
+
+// Chtimes does nothing on archived files, as the archives can't be modified
+func (s *archiveStorage) Chtimes(name string, mtime time.Time) error {
+	_, ok, err := s.archived(name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		log.Debugf("%s is archived, skipping modification time update", name)
+		return nil
+	}
+	return s.base.Chtimes(name, mtime)
+}
+
+// List returns the files in the underlying storage along with the archived ones
+func (s *archiveStorage) List(dir string) ([]FileInfo, error) {
+	dir = cleanName(dir)
+	if dir == "." {
+		dir = ""
+	}
+	infos, listErr := s.base.List(dir)
+	if listErr != nil && !os.IsNotExist(listErr) {
+		return nil, listErr
+	}
+
+	seen := make(map[string]bool)
+	for _, fi := range infos {
+		seen[fi.Name] = true
+	}
+	archiveDir := dir
+	if s.perRun {
+		archiveDir = ""
+	}
+	idx, err := s.index(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range idx {
+		name := path.Join(archiveDir, f.Name)
+		if path.Dir(name) != dir && !(dir == "" && path.Dir(name) == ".") {
+			continue
+		}
+		if seen[path.Base(name)] {
+			continue
+		}
+		seen[path.Base(name)] = true
+		infos = append(infos, FileInfo{Name: path.Base(name), Size: f.Size, ModTime: f.ModTime, MD5: f.MD5})
+	}
+	if len(infos) == 0 && listErr != nil {
+		return nil, listErr
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *archiveStorage) Remove(name string) error {
+	f, ok, err := s.archived(name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("Cannot remove %s: it's saved in the archive %s", name, f.archive)
+	}
+	return s.base.Remove(name)
+}
+
+func (s *archiveStorage) MkdirAll(dir string) error {
+	return s.base.MkdirAll(dir)
+}
+
+// FreeSpace returns the free space of the underlying storage, if it knows it
+func (s *archiveStorage) FreeSpace() (int64, error) {
+	return storageFreeSpace(s.base)
+}
+
+// Close completes the archive being written and closes the underlying storage
+func (s *archiveStorage) Close() error {
+	err := s.finish()
+	if c, ok := s.base.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// archiveWriter writes an archive and its index to a Storage
+type archiveWriter struct {
+	store     Storage
+	dir       string // Folder of the archive
+	name      string // Storage name of the archive
+	file      FileWriter
+	zst       *zstd.Encoder
+	tar       *tar.Writer
+	zip       *zip.Writer
+	index     archiveIndex
+	entryOpen bool
+	onEntry   func(archivedFile) // Called when an entry is committed
+}
+
+func newArchiveWriter(store Storage, dir, name, format string) (*archiveWriter, error) {
+	file, err := store.Create(name, FileMeta{})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create archive %s: %v", name, err)
+	}
+	a := &archiveWriter{
+		store: store,
+		dir:   dir,
+		name:  name,
+		file:  file,
+		index: archiveIndex{Archive: path.Base(name), Created: time.Now()},
+	}
+	switch format {
+	case archiveTar:
+		a.tar = tar.NewWriter(file)
+	case archiveTarZst:
+		if a.zst, err = zstd.NewWriter(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Cannot create archive %s: %v", name, err)
+		}
+		a.tar = tar.NewWriter(a.zst)
+	case archiveZip:
+		a.zip = zip.NewWriter(file)
+	default:
+		file.Close()
+		return nil, fmt.Errorf("Unknown archive format %q", format)
+	}
+	log.Infof("Creating archive %s", name)
+	return a, nil
+}
+
+// create starts a new entry in the archive. Entries are written one at a time
+func (a *archiveWriter) create(name string, meta FileMeta) (FileWriter, error) {
+	if a.entryOpen {
+		return nil, fmt.Errorf("Cannot add %s to %s: another entry is being written", name, a.name)
+	}
+
+	modTime := meta.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	var w io.Writer
+	if a.tar != nil {
+		err := a.tar.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     meta.Size,
+			Mode:     0644,
+			ModTime:  modTime,
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot add %s to %s: %v", name, a.name, err)
+		}
+		w = a.tar
+	} else {
+		// Images and videos are already compressed
+		zw, err := a.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot add %s to %s: %v", name, a.name, err)
+		}
+		w = zw
+	}
+
+	a.entryOpen = true
+	return &archiveEntryWriter{
+		a: a,
+		w: w,
+		entry: archiveIndexEntry{
+			Name:      name,
+			Size:      meta.Size,
+			MD5:       meta.MD5,
+			ModTime:   modTime,
+			ImageKey:  meta.ImageKey,
+			UploadKey: meta.UploadKey,
+		},
+	}, nil
+}
+
+// finish completes the archive and saves its index. Archives without entries are discarded
+func (a *archiveWriter) finish() error {
+	defer a.file.Close()
+	if len(a.index.Entries) == 0 {
+		log.Infof("Archive %s is empty, discarding it", a.name)
+		return nil
+	}
+
+	if a.tar != nil {
+		if err := a.tar.Close(); err != nil {
+			return fmt.Errorf("Cannot complete archive %s: %v", a.name, err)
+		}
+	}
+	if a.zst != nil {
+		if err := a.zst.Close(); err != nil {
+			return fmt.Errorf("Cannot complete archive %s: %v", a.name, err)
+		}
+	}
+	if a.zip != nil {
+		if err := a.zip.Close(); err != nil {
+			return fmt.Errorf("Cannot complete archive %s: %v", a.name, err)
+		}
+	}
+	if err := a.file.Commit(); err != nil {
+		return fmt.Errorf("Cannot complete archive %s: %v", a.name, err)
+	}
+
+	log.Infof("Saved archive %s with %d files", a.name, len(a.index.Entries))
+	return writeJSON(a.store, a.name+archiveIndexSuffix, a.index)
+}
+
+// archiveEntryWriter writes an entry of an archive. Entries can't be removed from an archive
+// once started, so a discarded entry stays in the archive but not in its index, and later runs
+// download the file again
+type archiveEntryWriter struct {
+	a       *archiveWriter
+	w       io.Writer
+	entry   archiveIndexEntry
+	written int64
+	done    bool
+}
+
+func (w *archiveEntryWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *archiveEntryWriter) Commit() error {
+	if w.done {
+		return errors.New("archive entry already closed")
+	}
+	if w.a.tar != nil && w.written != w.entry.Size {
+		w.Close()
+		return fmt.Errorf("Size of %s doesn't match: want %d, got %d", w.entry.Name, w.entry.Size, w.written)
+	}
+	w.entry.Size = w.written
+	w.done = true
+	w.a.entryOpen = false
+	w.a.index.Entries = append(w.a.index.Entries, w.entry)
+	if w.a.onEntry != nil {
+		w.a.onEntry(archivedFile{archiveIndexEntry: w.entry, archive: w.a.name})
+	}
+	return nil
+}
+
+// Close discards the entry, if not committed. Tar entries are padded with zeros to their
+// declared size, to keep the archive readable
+func (w *archiveEntryWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.a.entryOpen = false
+	if w.a.tar != nil && w.written < w.entry.Size {
+		if _, err := io.CopyN(w.a.tar, zeroReader{}, w.entry.Size-w.written); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroReader is an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,182 @@
+package smugmug
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// writeArchived saves a file with an image key to the storage
+func writeArchived(t *testing.T, s Storage, name, content string, mtime time.Time) {
+	t.Helper()
+	w, err := s.Create(name, FileMeta{Size: int64(len(content)), ImageKey: name, ModTime: mtime})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// readTar returns the entries of a tar archive, with their content and modification time
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("invalid tar archive: %v", err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		entries[h.Name] = string(b) + "@" + h.ModTime.UTC().Format(time.RFC3339)
+	}
+}
+
+func TestArchiveStoragePerAlbum(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	base := newMemStorage()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	run1 := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	s := newArchiveStorage(base, archiveTar, false, run1)
+
+	writeArchived(t, s, "album/a.jpg", "aaaaa", mtime)
+	writeArchived(t, s, "album/b.jpg", "bb", mtime)
+	if err := writeJSON(s, "album/album.json", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries := readTar(t, bytes.NewReader(base.content("album/album-20210601T100000Z.tar")))
+	if len(entries) != 2 || entries["a.jpg"] != "aaaaa@2020-01-02T03:04:05Z" || entries["b.jpg"] != "bb@2020-01-02T03:04:05Z" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	if base.content("album/album-20210601T100000Z.tar"+archiveIndexSuffix) == nil {
+		t.Fatalf("index not saved")
+	}
+	if base.content("album/album.json") == nil {
+		t.Fatalf("album metadata not saved")
+	}
+
+	// Incremental run: archived files are found in the index
+	s = newArchiveStorage(base, archiveTar, false, run1.Add(24*time.Hour))
+	fi, err := s.Stat("album/a.jpg")
+	if err != nil || !sameFile(fi, FileMeta{Size: 5}) || !fi.ModTime.Equal(mtime) {
+		t.Fatalf("unexpected info %+v (%v)", fi, err)
+	}
+	if _, err := s.Stat("album/c.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+	if err := s.Remove("album/a.jpg"); err == nil {
+		t.Fatalf("want error removing an archived file")
+	}
+
+	// Discarded entry
+	w, _ := s.Create("album/discarded.jpg", FileMeta{Size: 10, ImageKey: "d"})
+	w.Write([]byte("abc"))
+	w.Close()
+	writeArchived(t, s, "album/c.jpg", "ccc", mtime)
+	if _, err := s.Stat("album/c.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Close()
+
+	entries = readTar(t, bytes.NewReader(base.content("album/album-20210602T100000Z.tar")))
+	if len(entries) != 2 || entries["c.jpg"] != "ccc@2020-01-02T03:04:05Z" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	s = newArchiveStorage(base, archiveTar, false, run1.Add(48*time.Hour))
+	files, err := s.List("album")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	want := "a.jpg,album-20210601T100000Z.tar,album-20210601T100000Z.tar.index.json," +
+		"album-20210602T100000Z.tar,album-20210602T100000Z.tar.index.json,album.json,b.jpg,c.jpg"
+	if strings.Join(names, ",") != want {
+		t.Fatalf("unexpected files %v", names)
+	}
+	if _, err := s.Stat("album/discarded.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	// Nothing new: no archive is created
+	s.Close()
+	if base.content("album/album-20210603T100000Z.tar") != nil {
+		t.Fatalf("empty archive saved")
+	}
+}
+
+func TestArchiveStoragePerRun(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	run := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{archiveZip, archiveTarZst} {
+		base := newMemStorage()
+		s := newArchiveStorage(base, format, true, run)
+		writeArchived(t, s, "album1/x.jpg", "xx", mtime)
+		writeArchived(t, s, "album2/y.jpg", "yyy", mtime)
+		if err := s.Close(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+
+		data := base.content("smugmug-20210601T100000Z." + format)
+		entries := make(map[string]string)
+		switch format {
+		case archiveZip:
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("invalid zip archive: %v", err)
+			}
+			for _, f := range zr.File {
+				r, _ := f.Open()
+				b, _ := ioutil.ReadAll(r)
+				entries[f.Name] = string(b) + "@" + f.Modified.UTC().Format(time.RFC3339)
+			}
+		case archiveTarZst:
+			zr, err := zstd.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("invalid zstd stream: %v", err)
+			}
+			entries = readTar(t, zr)
+			zr.Close()
+		}
+		if len(entries) != 2 || entries["album1/x.jpg"] != "xx@2020-01-02T03:04:05Z" || entries["album2/y.jpg"] != "yyy@2020-01-02T03:04:05Z" {
+			t.Fatalf("%s: unexpected entries %v", format, entries)
+		}
+
+		s = newArchiveStorage(base, format, true, run.Add(time.Hour))
+		if fi, err := s.Stat("album2/y.jpg"); err != nil || fi.Size != 3 {
+			t.Fatalf("%s: unexpected info %+v (%v)", format, fi, err)
+		}
+		files, err := s.List("album1")
+		if err != nil || len(files) != 1 || files[0].Name != "x.jpg" {
+			t.Fatalf("%s: unexpected files %+v (%v)", format, files, err)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package smugmug
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted files format: the magic string and a random salt, used to derive the file key, are
+// followed by the content split in chunks encrypted with AES-256-GCM. The last chunk contains
+// the MD5 of the plaintext. The nonce of each chunk is its counter and a flag marking the last
+// chunk, so chunks can't be reordered or truncated (STREAM construction)
+const (
+	cryptMagic      = "SMGENC01"
+	cryptSaltSize   = 16
+	cryptHeaderSize = len(cryptMagic) + cryptSaltSize
+	cryptChunkSize  = 64 * 1024
+	cryptTagSize    = 16
+	cryptFinalSize  = md5.Size + cryptTagSize
+)
+
+// encryptionParamsFile is saved in the root of the backup with the parameters needed to derive
+// the key. It isn't encrypted
+const encryptionParamsFile = ".encryption.json"
+
+// namesEncoding encodes the encrypted file names, using only characters valid in any filesystem
+var namesEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// maxEncryptedNameSize is the max length of an encrypted name, the limit of most filesystems. With
+// the IV and the encoding, names up to 143 bytes can be encrypted
+const maxEncryptedNameSize = 255
+
+// EncryptionConf is the configuration of the client-side encryption
+type EncryptionConf struct {
+	KeyFile      string // Path of the file with the base64 encoded 32 bytes key
+	Passphrase   string // Passphrase the key is derived from, if KeyFile is empty
+	EncryptNames bool   // When true, also the names of the files and folders are encrypted
+}
+
+// Enabled tells if the encryption is configured
+func (cfg *EncryptionConf) Enabled() bool {
+	return cfg.KeyFile != "" || cfg.Passphrase != ""
+}
+
+func (cfg *EncryptionConf) validate() error {
+	if cfg.KeyFile != "" && cfg.Passphrase != "" {
+		return errors.New("encryption.key_file and encryption.passphrase can't be both set")
+	}
+
+	if cfg.EncryptNames && !cfg.Enabled() {
+		return errors.New("encryption.encrypt_names requires encryption.key_file or encryption.passphrase")
+	}
+
+	return nil
+}
+
+// encryptionParams is the content of the encryption parameters file
+type encryptionParams struct {
+	Version      int    `json:"version"`
+	KDF          string `json:"kdf"` // "none" with a key file, "scrypt" with a passphrase
+	Salt         []byte `json:"salt,omitempty"`
+	N            int    `json:"n,omitempty"`
+	R            int    `json:"r,omitempty"`
+	P            int    `json:"p,omitempty"`
+	Check        []byte `json:"check"` // MAC of a fixed string, to detect a wrong key
+	EncryptNames bool   `json:"encrypt_names"`
+}
+
+// cryptStorage encrypts the content, and optionally the names, of the files saved in the
+// underlying storage. Sizes returned by Stat and List are the plaintext ones
+type cryptStorage struct {
+	base         Storage
+	key          []byte // Master key, used to derive the file keys
+	nameEncKey   []byte
+	nameMacKey   []byte
+	encryptNames bool
+}
+
+func newCryptStorage(base Storage, cfg EncryptionConf) (*cryptStorage, error) {
+	var params encryptionParams
+	err := readStorageJSON(base, encryptionParamsFile, &params)
+	exists := err == nil
+	if err != nil {
+		if _, statErr := base.Stat(encryptionParamsFile); !os.IsNotExist(statErr) {
+			return nil, err
+		}
+		params = encryptionParams{Version: 1, KDF: "none", EncryptNames: cfg.EncryptNames}
+		if cfg.Passphrase != "" {
+			params.KDF = "scrypt"
+			params.Salt = make([]byte, 32)
+			if _, err := rand.Read(params.Salt); err != nil {
+				return nil, err
+			}
+			params.N, params.R, params.P = 1<<15, 8, 1
+		}
+	}
+
+	if params.KDF == "scrypt" && cfg.Passphrase == "" {
+		return nil, errors.New("The backup is encrypted with a passphrase, set encryption.passphrase")
+	}
+	if params.KDF != "scrypt" && cfg.Passphrase != "" {
+		return nil, errors.New("The backup is encrypted with a key file, set encryption.key_file")
+	}
+	if params.EncryptNames != cfg.EncryptNames {
+		return nil, fmt.Errorf("The backup has encrypt_names = %v, it can't be changed", params.EncryptNames)
+	}
+
+	var key []byte
+	if params.KDF == "scrypt" {
+		if key, err = scrypt.Key([]byte(cfg.Passphrase), params.Salt, params.N, params.R, params.P, 32); err != nil {
+			return nil, fmt.Errorf("Cannot derive the encryption key: %v", err)
+		}
+	} else if key, err = readKeyFile(cfg.KeyFile); err != nil {
+		return nil, err
+	}
+
+	check := macSum(key, "smugmug-backup key check")
+	if exists && !hmac.Equal(check, params.Check) {
+		return nil, errors.New("Wrong encryption key or passphrase")
+	}
+	if !exists {
+		params.Check = check
+		if err := writeJSON(base, encryptionParamsFile, params); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cryptStorage{
+		base:         base,
+		key:          key,
+		nameEncKey:   macSum(key, "name encryption"),
+		nameMacKey:   macSum(key, "name authentication"),
+		encryptNames: cfg.EncryptNames,
+	}, nil
+}
+
+// readKeyFile reads a base64 encoded 32 bytes key
+func readKeyFile(name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the encryption key file: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("The encryption key file must contain 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+// macSum returns the HMAC-SHA256 of data with the given key
+func macSum(key []byte, data ...string) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write([]byte(d))
+	}
+	return mac.Sum(nil)
+}
+
+// encryptName encrypts a file or folder name. The encryption is deterministic, so the same name
+// is always saved with the same encrypted name: the IV is the MAC of the name (SIV construction).
+// An error is returned if the encrypted name would be longer than maxEncryptedNameSize
+func (s *cryptStorage) encryptName(name string) (string, error) {
+	if n := namesEncoding.EncodedLen(aes.BlockSize + len(name)); n > maxEncryptedNameSize {
+		return "", fmt.Errorf("Cannot encrypt the name %q: the encrypted name would be %d bytes long, the max is %d",
+			name, n, maxEncryptedNameSize)
+	}
+	iv := macSum(s.nameMacKey, name)[:aes.BlockSize]
+	block, _ := aes.NewCipher(s.nameEncKey)
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[aes.BlockSize:], []byte(name))
+	return namesEncoding.EncodeToString(out), nil
+}
+
+// decryptName decrypts a name encrypted with encryptName
+func (s *cryptStorage) decryptName(enc string) (string, error) {
+	b, err := namesEncoding.DecodeString(enc)
+	if err != nil || len(b) < aes.BlockSize {
+		return "", fmt.Errorf("Invalid encrypted name %q", enc)
+	}
+	block, _ := aes.NewCipher(s.nameEncKey)
+	name := make([]byte, len(b)-aes.BlockSize)
+	cipher.NewCTR(block, b[:aes.BlockSize]).XORKeyStream(name, b[aes.BlockSize:])
+	if !hmac.Equal(macSum(s.nameMacKey, string(name))[:aes.BlockSize], b[:aes.BlockSize]) {
+		return "", fmt.Errorf("Invalid encrypted name %q", enc)
+	}
+	return string(name), nil
+}
+
+// path returns the name, in the underlying storage, of the named file
+func (s *cryptStorage) path(name string) (string, error) {
+	name = cleanName(name)
+	if !s.encryptNames || name == "" {
+		return name, nil
+	}
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		var err error
+		if parts[i], err = s.encryptName(p); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// fileInfo converts the info of an encrypted file to the plaintext one
+func (s *cryptStorage) fileInfo(fi FileInfo, name string) FileInfo {
+	fi.Name = name
+	if !fi.IsDir {
+		fi.Size = plaintextSize(fi.Size)
+	}
+	return fi
+}
+
+func (s *cryptStorage) Stat(name string) (FileInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi, err := s.base.Stat(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return s.fileInfo(fi, path.Base(name)), nil
+}
+
+// Open returns a reader of the decrypted content. The reader returns an error if the content
+// has been modified or if its MD5 doesn't match
+func (s *cryptStorage) Open(name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.base.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptReader(r, s.key)
+}
+
+// Create returns a writer encrypting the content. The MD5 isn't saved in the underlying storage,
+// as it would allow to recognize known files, but it's encrypted at the end of the file
+func (s *cryptStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	meta.MD5 = ""
+	if meta.Size > 0 {
+		meta.Size = encryptedSize(meta.Size)
+	}
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.base.Create(p, meta)
+	if err != nil {
+		return nil, err
+	}
+	ew, err := newEncryptWriter(w, s.key)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (s *cryptStorage) Chtimes(name string, mtime time.Time) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return s.base.Chtimes(p, mtime)
+}
+
+// List returns the decrypted names of the files. Files that aren't encrypted by this storage
+// (like the encryption parameters) are skipped
+func (s *cryptStorage) List(dir string) ([]FileInfo, error) {
+	p, err := s.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.base.List(p)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]FileInfo, 0, len(files))
+	for _, fi := range files {
+		name := fi.Name
+		if s.encryptNames {
+			if name, err = s.decryptName(fi.Name); err != nil {
+				log.Debugf("Skipping %s: %v", fi.Name, err)
+				continue
+			}
+		} else if cleanName(dir) == "" && name == encryptionParamsFile {
+			continue
+		}
+		infos = append(infos, s.fileInfo(fi, name))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *cryptStorage) Remove(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return s.base.Remove(p)
+}
+
+// Rename moves the encrypted file in the underlying storage. The file key doesn't depend on its
+// name, so the content doesn't change
+func (s *cryptStorage) Rename(oldname, newname string) error {
+	oldpath, err := s.path(oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := s.path(newname)
+	if err != nil {
+		return err
+	}
+	return renameFile(s.base, oldpath, newpath)
+}
+
+func (s *cryptStorage) MkdirAll(dir string) error {
+	p, err := s.path(dir)
+	if err != nil {
+		return err
+	}
+	return s.base.MkdirAll(p)
+}
+
+// FreeSpace returns the free space of the underlying storage, if it knows it
+func (s *cryptStorage) FreeSpace() (int64, error) {
+	return storageFreeSpace(s.base)
+}
+
+// Close closes the underlying storage
+func (s *cryptStorage) Close() error {
+	return closeStorage(s.base, false)
+}
+
+// Abort aborts the underlying storage
+func (s *cryptStorage) Abort() error {
+	return closeStorage(s.base, true)
+}
+
+// encryptedSize returns the size of the encrypted file with the given plaintext size
+func encryptedSize(size int64) int64 {
+	chunks := (size + cryptChunkSize - 1) / cryptChunkSize
+	return int64(cryptHeaderSize) + size + chunks*cryptTagSize + cryptFinalSize
+}
+
+// plaintextSize returns the plaintext size of the encrypted file with the given size
+func plaintextSize(size int64) int64 {
+	c := size - int64(cryptHeaderSize) - cryptFinalSize
+	if c <= 0 {
+		return 0
+	}
+	chunks := (c + cryptChunkSize + cryptTagSize - 1) / (cryptChunkSize + cryptTagSize)
+	return c - chunks*cryptTagSize
+}
+
+// fileCipher returns the AEAD of a file, using a key derived from the master key and the salt
+func fileCipher(key, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(macSum(key, "file", string(salt)))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given counter
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       FileWriter
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	md5     hash.Hash
+}
+
+func newEncryptWriter(w FileWriter, key []byte) (*encryptWriter, error) {
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(cryptMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, cryptChunkSize),
+		md5:  md5.New(),
+	}, nil
+}
+
+// seal encrypts and writes a chunk
+func (e *encryptWriter) seal(p []byte, last bool) error {
+	_, err := e.w.Write(e.aead.Seal(nil, chunkNonce(e.counter, last), p, nil))
+	e.counter++
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.md5.Write(p)
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		p = p[m:]
+		if len(e.buf) == cap(e.buf) {
+			if err := e.seal(e.buf, false); err != nil {
+				return 0, err
+			}
+			e.buf = e.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Commit writes the last chunks, with the MD5 of the plaintext, and commits the file
+func (e *encryptWriter) Commit() error {
+	if len(e.buf) > 0 {
+		if err := e.seal(e.buf, false); err != nil {
+			return err
+		}
+		e.buf = e.buf[:0]
+	}
+	if err := e.seal(e.md5.Sum(nil), true); err != nil {
+		return err
+	}
+	return e.w.Commit()
+}
+
+func (e *encryptWriter) Close() error {
+	return e.w.Close()
+}
+
+type decryptReader struct {
+	r       io.ReadCloser
+	br      *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	chunk   []byte // Sealed chunk buffer
+	plain   []byte // Decrypted data not read yet
+	md5     hash.Hash
+	err     error
+}
+
+func newDecryptReader(r io.ReadCloser, key []byte) (*decryptReader, error) {
+	br := bufio.NewReaderSize(r, cryptChunkSize+cryptTagSize+cryptFinalSize)
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		r.Close()
+		return nil, errors.New("Not an encrypted file")
+	}
+	aead, err := fileCipher(key, header[len(cryptMagic):])
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decryptReader{
+		r:     r,
+		br:    br,
+		aead:  aead,
+		chunk: make([]byte, cryptChunkSize+cryptTagSize),
+		md5:   md5.New(),
+	}, nil
+}
+
+func (d *decryptReader) open(sealed []byte, last bool) ([]byte, error) {
+	plain, err := d.aead.Open(nil, chunkNonce(d.counter, last), sealed, nil)
+	d.counter++
+	if err != nil {
+		return nil, errors.New("The encrypted file is corrupted or has been modified")
+	}
+	return plain, nil
+}
+
+// next decrypts the next chunk. The file ends with a short data chunk, if any, followed by the
+// final chunk with the MD5: a chunk is a full data chunk only if it's followed by at least the
+// final chunk, otherwise the remaining bytes are the last chunks
+func (d *decryptReader) next() error {
+	rest, err := d.br.Peek(len(d.chunk) + cryptFinalSize)
+	if err == nil {
+		if _, err := io.ReadFull(d.br, d.chunk); err != nil {
+			return err
+		}
+		d.plain, err = d.open(d.chunk, false)
+		return err
+	} else if err != io.EOF {
+		return err
+	}
+
+	// End of the file
+	n := len(rest)
+	if n < cryptFinalSize {
+		return errors.New("The encrypted file is truncated")
+	}
+	data, final := rest[:n-cryptFinalSize], rest[n-cryptFinalSize:]
+	if len(data) > 0 {
+		if d.plain, err = d.open(data, false); err != nil {
+			return err
+		}
+		d.md5.Write(d.plain)
+	}
+	sum, err := d.open(final, true)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, d.md5.Sum(nil)) {
+		return errors.New("MD5 of the decrypted file doesn't match")
+	}
+	return io.EOF
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+		if d.err == nil {
+			d.md5.Write(d.plain)
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.r.Close()
+}
+
+// openEncryptedBackup returns the storage of an encrypted backup, to read its files
+func openEncryptedBackup(cfg *Conf) (*cryptStorage, error) {
+	if !cfg.Encryption.Enabled() {
+		return nil, errors.New("The encryption is not configured")
+	}
+	if cfg.Archive != "" {
+		return nil, errors.New("Encrypted files saved in archives must be extracted before decrypting them")
+	}
+	var base Storage
+	if cfg.Snapshots.Enabled {
+		// Read the last snapshot, without creating a new one
+		root, err := cfg.BackupFolder()
+		if err != nil {
+			return nil, err
+		}
+		base = newLocalStorage(root)
+	} else {
+		var err error
+		if base, err = newBackendStorage(context.Background(), cfg, cfg.backends()[0]); err != nil {
+			return nil, err
+		}
+	}
+	return newCryptStorage(base, cfg.Encryption)
+}
+
+// Decrypt writes the decrypted content of the named file of an encrypted backup to w. The name
+// is the original one, relative to the backup root
+func Decrypt(cfg *Conf, name string, w io.Writer) error {
+	s, err := openEncryptedBackup(cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	r, err := s.Open(name)
+	if err != nil {
+		return fmt.Errorf("Cannot open %s: %v", name, err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("Cannot decrypt %s: %v", name, err)
+	}
+	return nil
+}
+
+// Restore decrypts the files of an encrypted backup in the given folder (the whole backup if
+// empty) to the out local folder, with their original names and modification times
+func Restore(cfg *Conf, dir, out string) error {
+	s, err := openEncryptedBackup(cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var restored, errorsCount int
+	var restoreDir func(dir string) error
+	restoreDir = func(dir string) error {
+		files, err := s.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			name := path.Join(dir, fi.Name)
+			if fi.IsDir {
+				if skipBackupDir(fi.Name) {
+					continue
+				}
+				if err := restoreDir(name); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := restoreFile(s, name, filepath.Join(out, filepath.FromSlash(name)), fi.ModTime); err != nil {
+				log.WithError(err).Errorf("Cannot restore %s", name)
+				errorsCount++
+				continue
+			}
+			restored++
+		}
+		return nil
+	}
+	if err := restoreDir(cleanName(dir)); err != nil {
+		return fmt.Errorf("Cannot read the backup: %v", err)
+	}
+
+	if errorsCount > 0 {
+		return fmt.Errorf("Restored %d files with %d errors, please check logs", restored, errorsCount)
+	}
+	log.Infof("Restored %d files to %s", restored, out)
+	return nil
+}
+
+// restoreFile decrypts the named file to dest. Partially written files are removed on errors
+func restoreFile(s Storage, name, dest string, mtime time.Time) error {
+	r, err := s.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Debugf("Restored %s", dest)
+	return os.Chtimes(dest, time.Now(), mtime)
+}
@@ -0,0 +1,221 @@
+package smugmug
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// writeKeyFile saves a key file with the given key byte repeated
+func writeKeyFile(t *testing.T, b byte) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "key")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+	if err := ioutil.WriteFile(name, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func writeFile(t *testing.T, s Storage, name string, content []byte) {
+	t.Helper()
+	w, err := s.Create(name, FileMeta{Size: int64(len(content)), ImageKey: "key"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCryptStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	base := newMemStorage()
+	s, err := newCryptStorage(base, EncryptionConf{KeyFile: writeKeyFile(t, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, size := range []int{0, 1, cryptChunkSize - 32, cryptChunkSize, cryptChunkSize + 1, 3*cryptChunkSize + 5} {
+		content := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+		writeFile(t, s, "album/image.jpg", content)
+
+		raw := base.content("album/image.jpg")
+		if int64(len(raw)) != encryptedSize(int64(size)) {
+			t.Fatalf("size %d: encrypted size: want %d, got %d", size, encryptedSize(int64(size)), len(raw))
+		}
+		if size > 16 && bytes.Contains(raw, content[:16]) {
+			t.Fatalf("size %d: content not encrypted", size)
+		}
+		fi, err := s.Stat("album/image.jpg")
+		if err != nil || fi.Size != int64(size) {
+			t.Fatalf("size %d: unexpected info %+v (%v)", size, fi, err)
+		}
+
+		r, err := s.Open("album/image.jpg")
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %v", size, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(b, content) {
+			t.Fatalf("size %d: decrypted content doesn't match (%v)", size, err)
+		}
+	}
+
+	// Modified and truncated files
+	raw := base.content("album/image.jpg")
+	for name, modified := range map[string][]byte{
+		"modified":  append(append([]byte{}, raw[:100]...), append([]byte{raw[100] ^ 1}, raw[101:]...)...),
+		"truncated": raw[:len(raw)-cryptFinalSize],
+	} {
+		base.files["album/image.jpg"].data = modified
+		r, err := s.Open("album/image.jpg")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatalf("%s: want error, got nil", name)
+		}
+	}
+
+	// Wrong key
+	if _, err := newCryptStorage(base, EncryptionConf{KeyFile: writeKeyFile(t, 2)}); err == nil {
+		t.Fatalf("want wrong key error, got nil")
+	}
+	if _, err := newCryptStorage(base, EncryptionConf{Passphrase: "secret"}); err == nil {
+		t.Fatalf("want error using a passphrase, got nil")
+	}
+}
+
+// TestCryptStorageChunkBoundaries checks the sizes whose last data chunk and final chunk together
+// are longer than a full sealed chunk
+func TestCryptStorageChunkBoundaries(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	s, err := newCryptStorage(newMemStorage(), EncryptionConf{KeyFile: writeKeyFile(t, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for n := 1; n <= 3; n++ {
+		for size := n*cryptChunkSize - cryptFinalSize; size <= n*cryptChunkSize; size++ {
+			content := bytes.Repeat([]byte{byte(size)}, size)
+			writeFile(t, s, "album/image.jpg", content)
+
+			r, err := s.Open("album/image.jpg")
+			if err != nil {
+				t.Fatalf("size %d: unexpected error: %v", size, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(b, content) {
+				t.Fatalf("size %d: decrypted content doesn't match (%v)", size, err)
+			}
+		}
+	}
+}
+
+func TestCryptStorageNames(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	base := newMemStorage()
+	cfg := EncryptionConf{Passphrase: "secret", EncryptNames: true}
+	s, err := newCryptStorage(base, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeFile(t, s, "my album/image.jpg", []byte("image"))
+	if err := writeJSON(s, "my album/album.json", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for name := range base.files {
+		if strings.Contains(name, "album") || strings.Contains(name, "image") {
+			t.Fatalf("name not encrypted: %s", name)
+		}
+	}
+
+	// Same passphrase, same names
+	s, err = newCryptStorage(base, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	files, err := s.List("")
+	if err != nil || len(files) != 1 || files[0].Name != "my album" || !files[0].IsDir {
+		t.Fatalf("unexpected files %+v (%v)", files, err)
+	}
+	files, err = s.List("my album")
+	if err != nil || len(files) != 2 || files[0].Name != "album.json" || files[1].Name != "image.jpg" || files[1].Size != 5 {
+		t.Fatalf("unexpected files %+v (%v)", files, err)
+	}
+
+	// Names too long once encrypted
+	long := strings.Repeat("a", 143)
+	writeFile(t, s, "my album/"+long, []byte("long"))
+	if fi, err := s.Stat("my album/" + long); err != nil || fi.Size != 4 {
+		t.Fatalf("unexpected info %+v (%v)", fi, err)
+	}
+	long = strings.Repeat("a", 200)
+	if _, err := s.Create("my album/"+long, FileMeta{}); err == nil || !strings.Contains(err.Error(), "Cannot encrypt the name") {
+		t.Fatalf("want name too long error, got %v", err)
+	}
+	if _, err := s.Stat(long + "/image.jpg"); err == nil {
+		t.Fatalf("want name too long error, got nil")
+	}
+
+	if _, err := newCryptStorage(base, EncryptionConf{Passphrase: "wrong", EncryptNames: true}); err == nil {
+		t.Fatalf("want wrong passphrase error, got nil")
+	}
+	if _, err := newCryptStorage(base, EncryptionConf{Passphrase: "secret"}); err == nil {
+		t.Fatalf("want error changing encrypt_names, got nil")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	cfg := &Conf{
+		Destination: dest,
+		Encryption:  EncryptionConf{KeyFile: writeKeyFile(t, 1), EncryptNames: true},
+	}
+	s, err := newCryptStorage(newLocalStorage(dest), cfg.Encryption)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFile(t, s, "album/a.jpg", []byte("first"))
+	writeFile(t, s, "album/sub/b.jpg", []byte("second"))
+	s.Chtimes("album/a.jpg", mtime)
+
+	var buf bytes.Buffer
+	if err := Decrypt(cfg, "album/sub/b.jpg", &buf); err != nil || buf.String() != "second" {
+		t.Fatalf("want second, got %q (%v)", buf.String(), err)
+	}
+
+	out := t.TempDir()
+	if err := Restore(cfg, "", out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{"album/a.jpg": "first", "album/sub/b.jpg": "second"} {
+		b, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil || string(b) != want {
+			t.Fatalf("%s: want %q, got %q (%v)", name, want, b, err)
+		}
+	}
+	if fi, _ := os.Stat(filepath.Join(out, "album", "a.jpg")); !fi.ModTime().Equal(mtime) {
+		t.Fatalf("mtime: want %v, got %v", mtime, fi.ModTime())
+	}
+}
@@ -0,0 +1,300 @@
+package smugmug
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blobsFolder is the folder, in the backup root, where the deduplicated content is saved
+const blobsFolder = ".blobs"
+
+// Deduplication modes
+const (
+	dedupHardlink = "hardlink"
+	dedupSymlink  = "symlink"
+)
+
+// linker is implemented by the storages that can save a file linking an existing content with
+// the same MD5, without downloading it again
+type linker interface {
+	// Link saves the named file as a link to the existing content described by meta. It returns
+	// false if there isn't such content
+	Link(name string, meta FileMeta) (bool, error)
+}
+
+// dedupStorage saves each image and video once in the blobs folder, named after its content
+// hash, while the album folders contain hardlinks or symlinks to the blobs. The hash is the
+// SmugMug ArchivedMD5 when known, otherwise the SHA-256 computed while downloading.
+//
+// Only the files with a SmugMug image key are deduplicated, the other ones (album metadata and
+// comments) are saved as they are
+type dedupStorage struct {
+	*localStorage
+	symlinks bool
+}
+
+func newDedupStorage(root string, symlinks bool) *dedupStorage {
+	return &dedupStorage{
+		localStorage: newLocalStorage(root),
+		symlinks:     symlinks,
+	}
+}
+
+// blobName returns the Storage name of the blob with the given hash
+func blobName(algorithm, sum string) string {
+	sum = strings.ToLower(sum)
+	return path.Join(blobsFolder, algorithm, sum[:2], sum)
+}
+
+func (s *dedupStorage) Link(name string, meta FileMeta) (bool, error) {
+	if len(meta.MD5) < 2 {
+		return false, nil
+	}
+	blob := blobName("md5", meta.MD5)
+	fi, err := s.localStorage.Stat(blob)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.Size != meta.Size {
+		log.Warnf("Blob %s has size %d instead of %d, ignoring it", blob, fi.Size, meta.Size)
+		return false, nil
+	}
+	log.Infof("Linking %s to existing %s", name, blob)
+	return true, s.link(blob, name)
+}
+
+// link replaces the named file with a link to the blob
+func (s *dedupStorage) link(blob, name string) error {
+	src, dest := s.path(blob), s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+
+	// The link is created with a temporary name and renamed, replacing the existing file
+	tmp := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".%s.tmp%s", filepath.Base(dest), nonce()))
+	if s.symlinks {
+		// Relative links keep working if the backup is moved
+		rel, err := filepath.Rel(filepath.Dir(dest), src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(rel, tmp); err != nil {
+			return err
+		}
+	} else if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Create writes the images and videos to a temporary file in the blobs folder, that is moved to
+// its blob and linked from the album folder on Commit
+func (s *dedupStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	if meta.ImageKey == "" {
+		return s.localStorage.Create(name, meta)
+	}
+
+	tmpDir := s.path(path.Join(blobsFolder, "tmp"))
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(tmpDir, "blob")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &dedupFileWriter{
+		File:   f,
+		s:      s,
+		name:   name,
+		meta:   meta,
+		md5:    md5.New(),
+		sha256: sha256.New(),
+	}, nil
+}
+
+type dedupFileWriter struct {
+	*os.File
+	s         *dedupStorage
+	name      string
+	meta      FileMeta
+	md5       hash.Hash
+	sha256    hash.Hash
+	committed bool
+}
+
+func (w *dedupFileWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	w.md5.Write(p[:n])
+	w.sha256.Write(p[:n])
+	return n, err
+}
+
+// Commit moves the content to its blob, unless a blob with the same hash already exists, and
+// links the file to it
+func (w *dedupFileWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+
+	var blob string
+	sum := hex.EncodeToString(w.md5.Sum(nil))
+	switch {
+	case strings.EqualFold(w.meta.MD5, sum):
+		blob = blobName("md5", sum)
+	case w.meta.MD5 != "":
+		log.Warnf("MD5 of %s doesn't match: want %s, got %s", w.name, w.meta.MD5, sum)
+		fallthrough
+	default:
+		blob = blobName("sha256", hex.EncodeToString(w.sha256.Sum(nil)))
+	}
+
+	dest := w.s.path(blob)
+	if _, err := os.Stat(dest); err == nil {
+		log.Debugf("%s already saved in %s", w.name, blob)
+		os.Remove(w.File.Name())
+	} else {
+		if !w.meta.ModTime.IsZero() {
+			if err := os.Chtimes(w.File.Name(), time.Now(), w.meta.ModTime); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(w.File.Name(), dest); err != nil {
+			return err
+		}
+	}
+	w.committed = true
+
+	return w.s.link(blob, w.name)
+}
+
+func (w *dedupFileWriter) Close() error {
+	if w.committed {
+		return nil
+	}
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// GCStats are the results of a blobs garbage collection
+type GCStats struct {
+	Blobs   int   // Number of blobs in the backup
+	Removed int   // Number of removed blobs
+	Freed   int64 // Size of the removed blobs
+}
+
+// GC removes the blobs of a deduplicated backup in the given destination folder that aren't
+// referenced by any album anymore. Blobs are referenced by symlinks in the album folders or,
+// when hardlinked, have more than one link. With dryRun true the blobs aren't removed
+func GC(destination string, dryRun bool) (GCStats, error) {
+	var stats GCStats
+	blobs := filepath.Join(destination, filepath.FromSlash(blobsFolder))
+
+	// Blobs referenced by symlinks
+	referenced := make(map[string]bool)
+	err := filepath.Walk(destination, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != destination && skipBackupDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		referenced[filepath.Clean(target)] = true
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("Cannot read the albums: %v", err)
+	}
+
+	err = filepath.Walk(blobs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == blobs {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if filepath.Base(filepath.Dir(p)) == "tmp" {
+			// Temporary files of an interrupted backup. Recent ones can belong to a running backup
+			if time.Since(info.ModTime()) < 24*time.Hour {
+				return nil
+			}
+			log.Debugf("Removing temporary file %s", p)
+		} else {
+			stats.Blobs++
+			if referenced[p] {
+				return nil
+			}
+			links, err := linkCount(info)
+			if err != nil {
+				return err
+			}
+			if links > 1 {
+				return nil
+			}
+			stats.Removed++
+			stats.Freed += info.Size()
+			log.Infof("Removing unreferenced blob %s", p)
+		}
+		if dryRun {
+			return nil
+		}
+		return os.Remove(p)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("Cannot clean the blobs: %v", err)
+	}
+
+	return stats, nil
+}
+
+// FormatSize formats a size in bytes in a human readable way
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,127 @@
+package smugmug
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestDedupStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	sum := md5.Sum([]byte("hello"))
+	helloMD5 := hex.EncodeToString(sum[:])
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, mode := range []string{dedupHardlink, dedupSymlink} {
+		root := t.TempDir()
+		s := newDedupStorage(root, mode == dedupSymlink)
+
+		// Two albums with the same image: the second one is linked without downloading it
+		var downloads int
+		w := &Worker{
+			cfg:   &Conf{},
+			store: s,
+			downloadFn: func(_ context.Context, _ albumImage, dest, _ string, meta FileMeta) error {
+				downloads++
+				f, err := s.Create(dest, meta)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				f.Write([]byte("hello"))
+				return f.Commit()
+			},
+		}
+		meta := FileMeta{Size: 5, MD5: helloMD5, ImageKey: "key", ModTime: mtime}
+		for _, dest := range []string{"album1/a.jpg", "album2/b.jpg"} {
+			if err := w.saveFile(context.Background(), albumImage{}, dest, "url", meta); err != nil {
+				t.Fatalf("%s: unexpected error: %v", mode, err)
+			}
+		}
+		if downloads != 1 {
+			t.Fatalf("%s: downloads: want 1, got %d", mode, downloads)
+		}
+
+		blob := filepath.Join(root, ".blobs", "md5", helloMD5[:2], helloMD5)
+		blobInfo, err := os.Stat(blob)
+		if err != nil {
+			t.Fatalf("%s: blob not saved: %v", mode, err)
+		}
+		if !blobInfo.ModTime().Equal(mtime) {
+			t.Fatalf("%s: mtime: want %v, got %v", mode, mtime, blobInfo.ModTime())
+		}
+		for _, name := range []string{"album1/a.jpg", "album2/b.jpg"} {
+			p := filepath.Join(root, filepath.FromSlash(name))
+			fi, err := os.Stat(p)
+			if err != nil || !os.SameFile(fi, blobInfo) {
+				t.Fatalf("%s: %s is not linked to the blob (%v)", mode, name, err)
+			}
+			lfi, _ := os.Lstat(p)
+			if isLink := lfi.Mode()&os.ModeSymlink != 0; isLink != (mode == dedupSymlink) {
+				t.Fatalf("%s: unexpected mode of %s: %v", mode, name, lfi.Mode())
+			}
+		}
+
+		// Unknown MD5: the blob is named after the SHA-256
+		for _, name := range []string{"album3/c.jpg", "album3/d.jpg"} {
+			f, _ := s.Create(name, FileMeta{Size: 5, ImageKey: "key"})
+			f.Write([]byte("world"))
+			if err := f.Commit(); err != nil {
+				t.Fatalf("%s: unexpected error: %v", mode, err)
+			}
+			f.Close()
+		}
+		shaBlob := filepath.Join(root, ".blobs", "sha256", "48",
+			"486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7")
+		if b, err := ioutil.ReadFile(shaBlob); err != nil || string(b) != "world" {
+			t.Fatalf("%s: sha256 blob not saved: %q (%v)", mode, b, err)
+		}
+		if files, _ := ioutil.ReadDir(filepath.Join(root, ".blobs", "tmp")); len(files) != 0 {
+			t.Fatalf("%s: temporary files not removed", mode)
+		}
+
+		// Files without image key are saved as they are
+		if err := writeJSON(s, "album1/album.json", ""); err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+		if fi, _ := os.Lstat(filepath.Join(root, "album1", "album.json")); !fi.Mode().IsRegular() {
+			t.Fatalf("%s: album.json is not a regular file", mode)
+		}
+
+		// Garbage collection
+		s.Remove("album1/a.jpg")
+		stats, err := GC(root, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+		if stats.Blobs != 2 || stats.Removed != 0 {
+			t.Fatalf("%s: unexpected stats %+v", mode, stats)
+		}
+
+		s.Remove("album2/b.jpg")
+		stats, err = GC(root, true)
+		if err != nil || stats.Removed != 1 || stats.Freed != 5 {
+			t.Fatalf("%s: unexpected stats %+v (%v)", mode, stats, err)
+		}
+		if _, err := os.Stat(blob); err != nil {
+			t.Fatalf("%s: blob removed in dry run", mode)
+		}
+		if _, err := GC(root, false); err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+		if _, err := os.Stat(blob); !os.IsNotExist(err) {
+			t.Fatalf("%s: unreferenced blob not removed", mode)
+		}
+		if _, err := os.Stat(shaBlob); err != nil {
+			t.Fatalf("%s: referenced blob removed", mode)
+		}
+	}
+}
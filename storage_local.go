@@ -0,0 +1,146 @@
+package smugmug
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// localStorage saves the backup in a folder of the local filesystem
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) *localStorage {
+	return &localStorage{root: root}
+}
+
+// path returns the local path of the named file
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(cleanName(name)))
+}
+
+func (s *localStorage) Stat(name string) (FileInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return newFileInfo(fi), nil
+}
+
+func (s *localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+// Create writes the content to a temporary file in the same folder, that is renamed to its
+// final name on Commit. This way an interrupted download never leaves a partial file
+func (s *localStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	dest := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	// TempFile creates files readable only by the owner
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &localFileWriter{File: f, dest: dest, modTime: meta.ModTime}, nil
+}
+
+func (s *localStorage) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(s.path(name), time.Now(), mtime)
+}
+
+func (s *localStorage) List(dir string) ([]FileInfo, error) {
+	files, err := ioutil.ReadDir(s.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]FileInfo, 0, len(files))
+	for _, fi := range files {
+		infos = append(infos, newFileInfo(fi))
+	}
+	return infos, nil
+}
+
+func (s *localStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *localStorage) Rename(oldname, newname string) error {
+	dest := s.path(newname)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(s.path(oldname), dest)
+}
+
+func (s *localStorage) MkdirAll(dir string) error {
+	p := s.path(dir)
+
+	// Folder exists
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+
+	log.Infof("Creating folder %s\n", p)
+	if err := os.MkdirAll(p, os.ModePerm); err != nil {
+		return fmt.Errorf("Cannot create folder: %v", err)
+	}
+
+	return nil
+}
+
+func (s *localStorage) FreeSpace() (int64, error) {
+	return freeSpace(s.root)
+}
+
+func newFileInfo(fi os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}
+}
+
+type localFileWriter struct {
+	*os.File
+	dest      string
+	modTime   time.Time
+	committed bool
+}
+
+func (w *localFileWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if !w.modTime.IsZero() {
+		if err := os.Chtimes(w.File.Name(), time.Now(), w.modTime); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(w.File.Name(), w.dest); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *localFileWriter) Close() error {
+	if w.committed {
+		return nil
+	}
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,303 @@
+package smugmug
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// multiTarget is one of the destinations of a multiStorage
+type multiTarget struct {
+	name    string
+	store   Storage // nil if the destination couldn't be opened
+	written int     // Number of files written
+	failed  int     // Number of failed operations
+	lastErr error
+}
+
+// multiStorage saves the backup to multiple destinations at once. Each file is downloaded once
+// and its content is written to all the destinations missing it.
+//
+// A failure of a destination doesn't stop the others: the failed operations are counted, logged
+// and reported as errors, but the content is still saved to the other destinations
+type multiStorage struct {
+	mu      sync.Mutex
+	targets []*multiTarget
+}
+
+// newMultiStorage returns a multiStorage writing to the given storages. A nil storage, with its
+// opening error, is accepted and reported as failed
+func newMultiStorage(names []string, stores []Storage, errs []error) (*multiStorage, error) {
+	s := &multiStorage{}
+	available := 0
+	for i, name := range names {
+		t := &multiTarget{name: name, store: stores[i]}
+		if t.store == nil {
+			log.WithError(errs[i]).Errorf("Cannot open the %s destination, skipping it", name)
+			t.failed++
+			t.lastErr = errs[i]
+		} else {
+			available++
+		}
+		s.targets = append(s.targets, t)
+	}
+	if available == 0 {
+		return nil, errors.New("Cannot open any destination")
+	}
+	return s, nil
+}
+
+// available returns the destinations that could be opened
+func (s *multiStorage) available() []*multiTarget {
+	var targets []*multiTarget
+	for _, t := range s.targets {
+		if t.store != nil {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// fail records a failed operation of a destination and returns the error, with its name
+func (s *multiStorage) fail(t *multiTarget, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.failed++
+	t.lastErr = err
+	return fmt.Errorf("%s: %v", t.name, err)
+}
+
+// each calls fn for each available destination, returning the errors of the failed ones
+func (s *multiStorage) each(fn func(Storage) error) error {
+	var errs []string
+	for _, t := range s.available() {
+		if err := fn(t.store); err != nil {
+			errs = append(errs, s.fail(t, err).Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Stat returns the info of the file if all the destinations have the same copy of it, otherwise
+// the not exist error of the first destination missing it. When the copies differ, the returned
+// info has a negative size, so that it doesn't match any file
+func (s *multiStorage) Stat(name string) (FileInfo, error) {
+	var first FileInfo
+	for i, t := range s.available() {
+		fi, err := t.store.Stat(name)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if i == 0 {
+			first = fi
+			continue
+		}
+		if !fi.IsDir && !sameFile(fi, FileMeta{Size: first.Size, MD5: first.MD5}) {
+			log.Debugf("Destinations have different copies of %s", name)
+			first.Size = -1
+			return first, nil
+		}
+		if first.MD5 == "" {
+			first.MD5 = fi.MD5
+		}
+	}
+	return first, nil
+}
+
+// Open reads the file from the first destination having it
+func (s *multiStorage) Open(name string) (io.ReadCloser, error) {
+	var firstErr error
+	for _, t := range s.available() {
+		r, err := t.store.Open(name)
+		if err == nil {
+			return r, nil
+		}
+		if firstErr == nil || os.IsNotExist(firstErr) {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Create returns a writer of the destinations that don't have the file yet
+func (s *multiStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	w := &multiFileWriter{s: s, name: name}
+	var errs []string
+	for _, t := range s.available() {
+		if fi, err := t.store.Stat(name); err == nil && meta.ImageKey != "" && sameFile(fi, meta) {
+			log.Debugf("%s already saved to %s", name, t.name)
+			continue
+		}
+		fw, err := t.store.Create(name, meta)
+		if err != nil {
+			errs = append(errs, s.fail(t, err).Error())
+			continue
+		}
+		w.writers = append(w.writers, &multiTargetWriter{target: t, w: fw})
+	}
+	if len(w.writers) == 0 && len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	w.errs = errs
+	return w, nil
+}
+
+func (s *multiStorage) Chtimes(name string, mtime time.Time) error {
+	return s.each(func(store Storage) error { return store.Chtimes(name, mtime) })
+}
+
+// List returns the files of the first available destination
+func (s *multiStorage) List(dir string) ([]FileInfo, error) {
+	return s.available()[0].store.List(dir)
+}
+
+// Remove deletes the file from all the destinations having it
+func (s *multiStorage) Remove(name string) error {
+	missing := 0
+	err := s.each(func(store Storage) error {
+		err := store.Remove(name)
+		if os.IsNotExist(err) {
+			missing++
+			return nil
+		}
+		return err
+	})
+	if err == nil && missing == len(s.available()) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func (s *multiStorage) MkdirAll(dir string) error {
+	return s.each(func(store Storage) error { return store.MkdirAll(dir) })
+}
+
+func (s *multiStorage) Rename(oldname, newname string) error {
+	return s.each(func(store Storage) error { return renameFile(store, oldname, newname) })
+}
+
+// FreeSpace returns the lowest free space of the destinations knowing it
+func (s *multiStorage) FreeSpace() (int64, error) {
+	var free int64 = -1
+	var lastErr error
+	for _, t := range s.available() {
+		n, err := storageFreeSpace(t.store)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if free < 0 || n < free {
+			free = n
+		}
+	}
+	if free < 0 {
+		return 0, lastErr
+	}
+	return free, nil
+}
+
+// Close closes the destinations and logs their status. It returns an error if any operation of
+// any destination failed
+func (s *multiStorage) Close() error {
+	return s.close(false)
+}
+
+// Abort aborts the destinations and logs their status
+func (s *multiStorage) Abort() error {
+	return s.close(true)
+}
+
+func (s *multiStorage) close(aborted bool) error {
+	var failed []string
+	for _, t := range s.targets {
+		if t.store != nil {
+			if err := closeStorage(t.store, aborted); err != nil {
+				s.fail(t, err)
+			}
+		}
+		entry := log.WithField("destination", t.name)
+		if t.failed > 0 {
+			entry.WithError(t.lastErr).Errorf("%d files saved, %d errors", t.written, t.failed)
+			failed = append(failed, t.name)
+			continue
+		}
+		entry.Infof("%d files saved", t.written)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Errors saving to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type multiTargetWriter struct {
+	target *multiTarget
+	w      FileWriter
+	failed bool
+}
+
+// multiFileWriter writes the content to the writers of multiple destinations. A destination
+// failing while writing is discarded, while the others continue
+type multiFileWriter struct {
+	s       *multiStorage
+	name    string
+	writers []*multiTargetWriter
+	errs    []string // Errors of the failed destinations
+}
+
+func (w *multiFileWriter) Write(p []byte) (int, error) {
+	ok := 0
+	for _, tw := range w.writers {
+		if tw.failed {
+			continue
+		}
+		if _, err := tw.w.Write(p); err != nil {
+			tw.failed = true
+			tw.w.Close()
+			w.errs = append(w.errs, w.s.fail(tw.target, err).Error())
+			continue
+		}
+		ok++
+	}
+	if ok == 0 && len(w.writers) > 0 {
+		return 0, errors.New(strings.Join(w.errs, "; "))
+	}
+	return len(p), nil
+}
+
+// Commit commits the file to the destinations that didn't fail. It returns an error if any
+// destination failed, even if the file has been saved to the other ones
+func (w *multiFileWriter) Commit() error {
+	for _, tw := range w.writers {
+		if tw.failed {
+			continue
+		}
+		if err := tw.w.Commit(); err != nil {
+			tw.failed = true
+			w.errs = append(w.errs, w.s.fail(tw.target, err).Error())
+			continue
+		}
+		w.s.mu.Lock()
+		tw.target.written++
+		w.s.mu.Unlock()
+	}
+	if len(w.errs) > 0 {
+		return fmt.Errorf("Cannot save %s to all the destinations: %s", w.name, strings.Join(w.errs, "; "))
+	}
+	return nil
+}
+
+func (w *multiFileWriter) Close() error {
+	for _, tw := range w.writers {
+		tw.w.Close()
+	}
+	return nil
+}
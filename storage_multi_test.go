@@ -0,0 +1,90 @@
+package smugmug
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// failingStorage is a memStorage whose writes fail
+type failingStorage struct {
+	*memStorage
+}
+
+func (s *failingStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	return &failingWriter{}, nil
+}
+
+type failingWriter struct{}
+
+func (w *failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+func (w *failingWriter) Commit() error               { return errors.New("disk full") }
+func (w *failingWriter) Close() error                { return nil }
+
+func TestMultiStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	mem1, mem2 := newMemStorage(), newMemStorage()
+	s, err := newMultiStorage(
+		[]string{"local", "s3", "sftp"},
+		[]Storage{mem1, mem2, nil},
+		[]error{nil, nil, errors.New("connection refused")},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	writeFile(t, s, "album/a.jpg", []byte("aaa"))
+	for _, mem := range []*memStorage{mem1, mem2} {
+		if string(mem.content("album/a.jpg")) != "aaa" {
+			t.Fatalf("file not saved to all the destinations")
+		}
+	}
+	if fi, err := s.Stat("album/a.jpg"); err != nil || fi.Size != 3 {
+		t.Fatalf("unexpected info %+v (%v)", fi, err)
+	}
+
+	// Different copies
+	writeFile(t, mem1, "album/b.jpg", []byte("b"))
+	writeFile(t, mem2, "album/b.jpg", []byte("bb"))
+	if fi, err := s.Stat("album/b.jpg"); err != nil || sameFile(fi, FileMeta{Size: 1}) || sameFile(fi, FileMeta{Size: 2}) {
+		t.Fatalf("unexpected info %+v (%v)", fi, err)
+	}
+
+	// Missing in one destination: it's written only there
+	writeFile(t, mem1, "album/c.jpg", []byte("ccc"))
+	if _, err := s.Stat("album/c.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+	writeFile(t, s, "album/c.jpg", []byte("ccc"))
+	if s.targets[0].written != 1 || s.targets[1].written != 2 {
+		t.Fatalf("unexpected written files %d, %d", s.targets[0].written, s.targets[1].written)
+	}
+
+	err = s.Close()
+	if err == nil || !strings.Contains(err.Error(), "sftp") || strings.Contains(err.Error(), "s3") {
+		t.Fatalf("want sftp error, got %v", err)
+	}
+
+	// A failing destination doesn't stop the others
+	mem3 := newMemStorage()
+	s, _ = newMultiStorage([]string{"local", "webdav"}, []Storage{mem3, &failingStorage{newMemStorage()}}, []error{nil, nil})
+	w, _ := s.Create("album/d.jpg", FileMeta{Size: 3, ImageKey: "d"})
+	if _, err := w.Write([]byte("ddd")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Commit(); err == nil || !strings.Contains(err.Error(), "webdav") {
+		t.Fatalf("want webdav error, got %v", err)
+	}
+	w.Close()
+	if string(mem3.content("album/d.jpg")) != "ddd" {
+		t.Fatalf("file not saved to the working destination")
+	}
+
+	if _, err := newMultiStorage([]string{"s3"}, []Storage{nil}, []error{errors.New("down")}); err == nil {
+		t.Fatalf("want error without destinations, got nil")
+	}
+}
@@ -0,0 +1,614 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minS3PartSize is the minimum size of a multipart upload part allowed by S3 (except the last one)
+const minS3PartSize = 5 * 1024 * 1024
+
+// maxS3CopySize is the maximum size of an object copied with a single request. Bigger objects are
+// copied with a multipart upload, copying a part of this size at a time
+const maxS3CopySize = 5 * 1024 * 1024 * 1024
+
+// s3AbortTimeout is the maximum duration of the abort of a multipart upload, that is requested
+// also when the run has been canceled
+const s3AbortTimeout = 30 * time.Second
+
+// Object metadata saved with the files
+const (
+	s3MetaSize      = "X-Amz-Meta-Size"
+	s3MetaMD5       = "X-Amz-Meta-Md5"
+	s3MetaImageKey  = "X-Amz-Meta-Image-Key"
+	s3MetaUploadKey = "X-Amz-Meta-Upload-Key"
+	s3MetaMtime     = "X-Amz-Meta-Mtime"
+)
+
+// S3Conf is the configuration of the S3-compatible storage
+type S3Conf struct {
+	Endpoint  string // Endpoint URL, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Region    string // Bucket region
+	Bucket    string // Bucket name
+	Prefix    string // Optional prefix of all the object keys
+	AccessKey string // Access key ID
+	SecretKey string // Secret access key
+	PathStyle bool   // When true, the bucket is in the URL path instead of the host name (required by MinIO)
+	PartSize  int64  // Size, in bytes, of the multipart upload parts
+}
+
+func (cfg *S3Conf) validate() error {
+	if cfg.Bucket == "" {
+		return errors.New("s3.bucket can't be empty")
+	}
+
+	if cfg.Region == "" {
+		return errors.New("s3.region can't be empty")
+	}
+
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return errors.New("s3.access_key and s3.secret_key can't be empty")
+	}
+
+	if cfg.PartSize != 0 && cfg.PartSize < minS3PartSize {
+		return fmt.Errorf("s3.part_size must be at least %d bytes", minS3PartSize)
+	}
+
+	return nil
+}
+
+// s3Storage saves the backup in a bucket of an S3-compatible object storage. Files are uploaded
+// with multipart uploads while they're downloaded from SmugMug, buffering a single part in memory
+type s3Storage struct {
+	cfg         S3Conf
+	client      *http.Client
+	ctx         context.Context  // Context of the requests, canceled with the run
+	now         func() time.Time // defined in struct for better testing
+	maxCopySize int64            // defined in struct for better testing
+}
+
+func newS3Storage(ctx context.Context, cfg S3Conf) *s3Storage {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.PartSize == 0 {
+		cfg.PartSize = 2 * minS3PartSize
+	}
+	cfg.Prefix = cleanName(cfg.Prefix)
+	return &s3Storage{
+		cfg:         cfg,
+		client:      &http.Client{},
+		ctx:         ctx,
+		now:         time.Now,
+		maxCopySize: maxS3CopySize,
+	}
+}
+
+// key returns the object key of the named file
+func (s *s3Storage) key(name string) string {
+	return path.Join(s.cfg.Prefix, cleanName(name))
+}
+
+// objectURL returns the URL of the object with the given key, or the bucket URL if key is empty
+func (s *s3Storage) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint: %v", err)
+	}
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	return u, nil
+}
+
+// do performs a signed request, returning an error if the response status isn't 2xx
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	s.sign(req, body, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, newS3Error(key, resp)
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Stat(name string) (FileInfo, error) {
+	resp, err := s.do(s.ctx, http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	fi := FileInfo{
+		Name: path.Base(name),
+		Size: resp.ContentLength,
+		MD5:  resp.Header.Get(s3MetaMD5),
+	}
+	if fi.ModTime, err = time.Parse(time.RFC3339, resp.Header.Get(s3MetaMtime)); err != nil {
+		fi.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	}
+	return fi, nil
+}
+
+func (s *s3Storage) Create(name string, meta FileMeta) (FileWriter, error) {
+	headers := http.Header{}
+	headers.Set(s3MetaSize, strconv.FormatInt(meta.Size, 10))
+	if meta.MD5 != "" {
+		headers.Set(s3MetaMD5, meta.MD5)
+	}
+	if meta.ImageKey != "" {
+		headers.Set(s3MetaImageKey, meta.ImageKey)
+	}
+	if meta.UploadKey != "" {
+		headers.Set(s3MetaUploadKey, meta.UploadKey)
+	}
+	if !meta.ModTime.IsZero() {
+		headers.Set(s3MetaMtime, meta.ModTime.UTC().Format(time.RFC3339))
+	}
+	return &s3Writer{
+		s:       s,
+		key:     s.key(name),
+		headers: headers,
+		buf:     bytes.NewBuffer(make([]byte, 0, s.cfg.PartSize)),
+	}, nil
+}
+
+// Chtimes saves the modification time in the object metadata. Objects can't be modified, so the
+// object is copied over itself replacing its metadata
+func (s *s3Storage) Chtimes(name string, mtime time.Time) error {
+	key := s.key(name)
+	size, meta, err := s.head(key)
+	if err != nil {
+		return err
+	}
+	meta.Set(s3MetaMtime, mtime.UTC().Format(time.RFC3339))
+	return s.copyObject(key, key, size, meta)
+}
+
+// head returns the size and the metadata headers of the object with the given key
+func (s *s3Storage) head(key string) (int64, http.Header, error) {
+	resp, err := s.do(s.ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+
+	meta := http.Header{}
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			meta[k] = v
+		}
+	}
+	return resp.ContentLength, meta, nil
+}
+
+// copyObject copies the object src, of the given size, to dest replacing its metadata. Objects up
+// to maxCopySize are copied with a single request, while S3 requires a multipart upload copying
+// their parts for the bigger ones
+func (s *s3Storage) copyObject(src, dest string, size int64, meta http.Header) error {
+	source := s3EscapePath("/" + s.cfg.Bucket + "/" + src)
+	if size <= s.maxCopySize {
+		headers := http.Header{}
+		for k, v := range meta {
+			headers[k] = v
+		}
+		headers.Set("X-Amz-Copy-Source", source)
+		headers.Set("X-Amz-Metadata-Directive", "REPLACE")
+		resp, err := s.do(s.ctx, http.MethodPut, dest, nil, headers, nil)
+		if err != nil {
+			return err
+		}
+		return drainAndClose(resp)
+	}
+
+	w := &s3Writer{s: s, key: dest, headers: meta, buf: &bytes.Buffer{}}
+	defer w.Close()
+	for start := int64(0); start < size; start += s.maxCopySize {
+		end := start + s.maxCopySize - 1
+		if end >= size {
+			end = size - 1
+		}
+		headers := http.Header{}
+		headers.Set("X-Amz-Copy-Source", source)
+		headers.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		if err := w.uploadPart(headers); err != nil {
+			return err
+		}
+	}
+	return w.Commit()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the objects and the common prefixes (the folders) with the given prefix
+func (s *s3Storage) List(dir string) ([]FileInfo, error) {
+	prefix := s.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var infos []FileInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(s.ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode S3 list response: %v", err)
+		}
+
+		for _, c := range res.Contents {
+			infos = append(infos, FileInfo{
+				Name:    strings.TrimPrefix(c.Key, prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		for _, p := range res.CommonPrefixes {
+			infos = append(infos, FileInfo{
+				Name:  strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"),
+				IsDir: true,
+			})
+		}
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+
+	if len(infos) == 0 && prefix != "" {
+		return nil, &os.PathError{Op: "list", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(s.ctx, http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Remove(name string) error {
+	resp, err := s.do(s.ctx, http.MethodDelete, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return drainAndClose(resp)
+}
+
+// Rename copies the object to the new key, keeping its metadata, and deletes the old one
+func (s *s3Storage) Rename(oldname, newname string) error {
+	size, meta, err := s.head(s.key(oldname))
+	if err != nil {
+		return err
+	}
+	if err := s.copyObject(s.key(oldname), s.key(newname), size, meta); err != nil {
+		return err
+	}
+	return s.Remove(oldname)
+}
+
+// MkdirAll does nothing, object storages don't have folders
+func (s *s3Storage) MkdirAll(dir string) error {
+	return nil
+}
+
+// s3Writer buffers the content until a part is complete. Files smaller than a part are saved with
+// a single PUT, bigger files with a multipart upload
+type s3Writer struct {
+	s         *s3Storage
+	key       string
+	headers   http.Header
+	buf       *bytes.Buffer
+	uploadID  string
+	parts     []s3CompletedPart
+	committed bool
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := int(w.s.cfg.PartSize) - w.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+		written += n
+		p = p[n:]
+
+		if int64(w.buf.Len()) >= w.s.cfg.PartSize {
+			if err := w.uploadPart(nil); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// uploadPart uploads the buffered content as a new part, starting the multipart upload if needed.
+// With the copy headers, the part is copied from an existing object instead
+func (w *s3Writer) uploadPart(copyHeaders http.Header) error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(w.s.ctx, http.MethodPost, w.key, url.Values{"uploads": {""}}, w.headers, nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Cannot decode S3 multipart upload response: %v", err)
+		}
+		w.uploadID = res.UploadID
+		log.Debugf("Started multipart upload %s for %s", w.uploadID, w.key)
+	}
+
+	partNumber := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {w.uploadID},
+	}
+	if copyHeaders != nil {
+		resp, err := w.s.do(w.s.ctx, http.MethodPut, w.key, query, copyHeaders, nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			ETag string `xml:"ETag"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Cannot decode S3 copy part response: %v", err)
+		}
+		w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: res.ETag})
+		return nil
+	}
+
+	resp, err := w.s.do(w.s.ctx, http.MethodPut, w.key, query, nil, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := drainAndClose(resp); err != nil {
+		return err
+	}
+
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+func (w *s3Writer) Commit() error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(w.s.ctx, http.MethodPut, w.key, nil, w.headers, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		w.committed = true
+		return drainAndClose(resp)
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(nil); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do(w.s.ctx, http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The complete request can fail after a 200 status, reporting the error in the body
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return fmt.Errorf("%s: cannot complete multipart upload: %s", w.key, b)
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.committed || w.uploadID == "" {
+		return nil
+	}
+	// The upload is aborted also when the run has been canceled
+	ctx, cancel := context.WithTimeout(context.Background(), s3AbortTimeout)
+	defer cancel()
+	resp, err := w.s.do(ctx, http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return drainAndClose(resp)
+}
+
+// sign adds the AWS Signature Version 4 authorization to the request. All the headers already
+// set in the request are signed
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query parameters sorted by key, as required by the signature
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, string(encode(k, false))+"="+string(encode(v, false)))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath escapes each element of the path as required by the signature
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = string(encode(part, false))
+	}
+	return strings.Join(parts, "/")
+}
+
+// newS3Error builds an error from an S3 error response. Not found errors satisfy os.IsNotExist
+func newS3Error(key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: resp.Request.Method, Path: key, Err: os.ErrNotExist}
+	}
+	var res struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if err := xml.Unmarshal(b, &res); err == nil && res.Code != "" {
+		return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, key, res.Code, res.Message)
+	}
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, key, resp.Status)
+}
+
+// drainAndClose reads the whole body of the response, so the connection can be reused
+func drainAndClose(resp *http.Response) error {
+	_, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return err
+}
@@ -0,0 +1,228 @@
+package smugmug
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPConf is the configuration of the SFTP storage
+type SFTPConf struct {
+	Host       string // Server host name
+	Port       int    // Server port, 22 if empty
+	User       string // SSH user
+	KeyFile    string // Path of the private key used to authenticate
+	KnownHosts string // Path of the known_hosts file used to verify the server key
+	Root       string // Remote folder where the backup is saved
+}
+
+func (cfg *SFTPConf) validate() error {
+	if cfg.Host == "" {
+		return errors.New("sftp.host can't be empty")
+	}
+
+	if cfg.User == "" {
+		return errors.New("sftp.user can't be empty")
+	}
+
+	if cfg.KeyFile == "" {
+		return errors.New("sftp.key_file can't be empty")
+	}
+
+	if cfg.KnownHosts == "" {
+		return errors.New("sftp.known_hosts can't be empty")
+	}
+
+	if cfg.Root == "" {
+		return errors.New("sftp.root can't be empty")
+	}
+
+	return nil
+}
+
+// sftpStorage saves the backup in a folder of a remote server, over SFTP. Files are written to
+// a temporary name and atomically renamed when complete
+type sftpStorage struct {
+	root   string
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPStorage(cfg SFTPConf) (*sftpStorage, error) {
+	key, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read SFTP key file: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse SFTP key file: %v", err)
+	}
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read SFTP known_hosts file: %v", err)
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to %s: %v", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot start SFTP session on %s: %v", addr, err)
+	}
+
+	log.Infof("Connected to SFTP server %s", addr)
+	return &sftpStorage{
+		root:   cfg.Root,
+		conn:   conn,
+		client: client,
+	}, nil
+}
+
+// path returns the remote path of the named file
+func (s *sftpStorage) path(name string) string {
+	return path.Join(s.root, cleanName(name))
+}
+
+func (s *sftpStorage) Stat(name string) (FileInfo, error) {
+	fi, err := s.client.Stat(s.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return newFileInfo(fi), nil
+}
+
+func (s *sftpStorage) Open(name string) (io.ReadCloser, error) {
+	return s.client.Open(s.path(name))
+}
+
+func (s *sftpStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	dest := s.path(name)
+	if err := s.client.MkdirAll(path.Dir(dest)); err != nil {
+		return nil, err
+	}
+	tmp := path.Join(path.Dir(dest), fmt.Sprintf(".%s.tmp%s", path.Base(dest), nonce()))
+	f, err := s.client.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFileWriter{File: f, client: s.client, dest: dest, modTime: meta.ModTime}, nil
+}
+
+func (s *sftpStorage) Chtimes(name string, mtime time.Time) error {
+	return s.client.Chtimes(s.path(name), time.Now(), mtime)
+}
+
+func (s *sftpStorage) List(dir string) ([]FileInfo, error) {
+	files, err := s.client.ReadDir(s.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]FileInfo, 0, len(files))
+	for _, fi := range files {
+		infos = append(infos, newFileInfo(fi))
+	}
+	return infos, nil
+}
+
+func (s *sftpStorage) Remove(name string) error {
+	return s.client.Remove(s.path(name))
+}
+
+func (s *sftpStorage) Rename(oldname, newname string) error {
+	dest := s.path(newname)
+	if err := s.client.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	return sftpRename(s.client, s.path(oldname), dest)
+}
+
+func (s *sftpStorage) MkdirAll(dir string) error {
+	return s.client.MkdirAll(s.path(dir))
+}
+
+// FreeSpace returns the free space of the remote folder. It requires the statvfs extension of
+// OpenSSH
+func (s *sftpStorage) FreeSpace() (int64, error) {
+	st, err := s.client.StatVFS(s.root)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail * st.Frsize), nil
+}
+
+// Close closes the SFTP session and the SSH connection
+func (s *sftpStorage) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
+
+type sftpFileWriter struct {
+	*sftp.File
+	client    *sftp.Client
+	dest      string
+	modTime   time.Time
+	committed bool
+}
+
+// sftpRename renames a remote file. The posix-rename extension is used to overwrite the existing
+// file atomically, falling back to remove and rename when the server doesn't support it
+func sftpRename(client *sftp.Client, oldpath, newpath string) error {
+	if err := client.PosixRename(oldpath, newpath); err != nil {
+		log.Debugf("posix-rename failed (%v), falling back to rename", err)
+		if err := client.Remove(newpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return client.Rename(oldpath, newpath)
+	}
+	return nil
+}
+
+// Commit renames the temporary file to its final name
+func (w *sftpFileWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	if !w.modTime.IsZero() {
+		if err := w.client.Chtimes(w.File.Name(), time.Now(), w.modTime); err != nil {
+			return err
+		}
+	}
+	if err := sftpRename(w.client, w.File.Name(), w.dest); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *sftpFileWriter) Close() error {
+	if w.committed {
+		return nil
+	}
+	w.File.Close()
+	return w.client.Remove(w.File.Name())
+}
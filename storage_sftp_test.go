@@ -0,0 +1,235 @@
+package smugmug
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/tommyblue/smugmug-backup/testutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer starts an in-process SSH server with the SFTP subsystem, accepting only the
+// given client key. It returns the server address and its host key
+func startSFTPServer(t *testing.T, clientKey ssh.PublicKey) (*net.TCPAddr, ssh.PublicKey) {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTPConn(conn, cfg)
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr), hostSigner.PublicKey()
+}
+
+func serveSFTPConn(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTPStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "backup")
+
+	// Client key and known_hosts
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(clientPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := ssh.NewPublicKey(clientPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, hostKey := startSFTPServer(t, clientPub)
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr.String())}, hostKey)
+	if err := ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := SFTPConf{
+		Host:       "127.0.0.1",
+		Port:       addr.Port,
+		User:       "backup",
+		KeyFile:    keyFile,
+		KnownHosts: knownHostsFile,
+		Root:       root,
+	}
+
+	// Unknown host key
+	wrongKnownHosts := filepath.Join(dir, "wrong_known_hosts")
+	wrongLine := knownhosts.Line([]string{knownhosts.Normalize(addr.String())}, clientPub)
+	ioutil.WriteFile(wrongKnownHosts, []byte(wrongLine+"\n"), 0600)
+	wrongCfg := cfg
+	wrongCfg.KnownHosts = wrongKnownHosts
+	if _, err := newSFTPStorage(wrongCfg); err == nil {
+		t.Fatalf("want host key error, got nil")
+	}
+
+	s, err := newSFTPStorage(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.MkdirAll("album"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, content := range []string{"first", "second version"} {
+		w, err := s.Create("album/image.jpg", FileMeta{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.Write([]byte(content))
+		if _, err := os.Stat(filepath.Join(root, "album", "image.jpg")); content == "first" && !os.IsNotExist(err) {
+			t.Fatalf("file visible before commit")
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(root, "album", "image.jpg"))
+		if err != nil || string(b) != content {
+			t.Fatalf("want %q, got %q (%v)", content, b, err)
+		}
+	}
+
+	fi, err := s.Stat("album/image.jpg")
+	if err != nil || fi.Size != int64(len("second version")) {
+		t.Fatalf("unexpected info %+v (%v)", fi, err)
+	}
+	r, err := s.Open("album/image.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "second version" {
+		t.Fatalf("want second version, got %q", b)
+	}
+	r.Close()
+	if _, err := s.Stat("album/missing.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("album/image.jpg", mtime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	local, _ := os.Stat(filepath.Join(root, "album", "image.jpg"))
+	if !local.ModTime().Equal(mtime) {
+		t.Fatalf("mtime: want %v, got %v", mtime, local.ModTime())
+	}
+
+	files, err := s.List("album")
+	if err != nil || len(files) != 1 || files[0].Name != "image.jpg" {
+		t.Fatalf("unexpected files %+v (%v)", files, err)
+	}
+
+	if err := s.Rename("album/image.jpg", "other/image.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Rename("other/image.jpg", "album/image.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, err := s.Stat("album/image.jpg"); err != nil || !fi.ModTime.Equal(mtime) {
+		t.Fatalf("unexpected info after rename %+v (%v)", fi, err)
+	}
+
+	if err := s.Remove("album/image.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "album", "image.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("file not removed")
+	}
+
+	// Discarded file
+	w, err := s.Create("album/discarded.jpg", FileMeta{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.Write([]byte("content"))
+	w.Close()
+	if files, _ := ioutil.ReadDir(filepath.Join(root, "album")); len(files) != 0 {
+		t.Fatalf("temporary file not removed")
+	}
+}
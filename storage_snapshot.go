@@ -0,0 +1,314 @@
+package smugmug
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotsFolder is the folder, in the destination, containing the snapshots
+const snapshotsFolder = "snapshots"
+
+// snapshotStampFormat is the format of the snapshot names. A snapshot being written has the
+// snapshotPartialSuffix suffix, removed when the run completes
+const (
+	snapshotStampFormat   = "20060102T150405Z"
+	snapshotPartialSuffix = ".partial"
+)
+
+// SnapshotsConf is the configuration of the snapshots of the local backend
+type SnapshotsConf struct {
+	Enabled     bool // When true, each run saves the backup in a new dated snapshot folder
+	KeepDaily   int  // Number of days for which the last snapshot is kept
+	KeepWeekly  int  // Number of weeks for which the last snapshot is kept
+	KeepMonthly int  // Number of months for which the last snapshot is kept
+}
+
+// retention tells if a retention policy is configured. Without it, all snapshots are kept
+func (c SnapshotsConf) retention() bool {
+	return c.KeepDaily > 0 || c.KeepWeekly > 0 || c.KeepMonthly > 0
+}
+
+func (c SnapshotsConf) validate() error {
+	if c.KeepDaily < 0 || c.KeepWeekly < 0 || c.KeepMonthly < 0 {
+		return errors.New("The snapshots keep_* values can't be negative")
+	}
+	return nil
+}
+
+// Snapshot is a snapshot of the backup
+type Snapshot struct {
+	Name string    // Name of the snapshot folder
+	Time time.Time // Start time of the run that created the snapshot
+}
+
+// snapshotStorage saves each run in a new snapshots/<timestamp> folder of the destination,
+// like rsnapshot. All the files of the previous snapshot are hardlinked to the new one when the
+// storage is created, like "cp -al", so unchanged files don't use additional space, while new and
+// replaced files are saved in the new snapshot only. Linking all of them keeps in the new snapshot
+// also the files that the run doesn't save, like the ones of the failed albums, so that the
+// retention policy never removes their only copy.
+//
+// The snapshot is written to a folder with the .partial suffix, renamed when the storage is
+// closed. The partial snapshot of an interrupted run is reused by the next one
+type snapshotStorage struct {
+	*localStorage
+	dir       string        // Snapshots folder
+	name      string        // Name of the new snapshot
+	prev      *localStorage // Last complete snapshot, nil if there isn't one
+	retention SnapshotsConf
+}
+
+func newSnapshotStorage(destination string, cfg SnapshotsConf, now time.Time) (*snapshotStorage, error) {
+	dir := filepath.Join(destination, snapshotsFolder)
+	name := now.UTC().Format(snapshotStampFormat)
+	s := &snapshotStorage{
+		localStorage: newLocalStorage(filepath.Join(dir, name+snapshotPartialSuffix)),
+		dir:          dir,
+		name:         name,
+		retention:    cfg,
+	}
+
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(snapshots); n > 0 {
+		last := snapshots[n-1]
+		if last.Name >= name {
+			return nil, fmt.Errorf("Snapshot %s is newer than the current time", last.Name)
+		}
+		s.prev = newLocalStorage(filepath.Join(dir, last.Name))
+	}
+
+	// Continue an interrupted run
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Cannot read the snapshots: %v", err)
+	}
+	for _, fi := range files {
+		if !fi.IsDir() || !strings.HasSuffix(fi.Name(), snapshotPartialSuffix) {
+			continue
+		}
+		log.Infof("Continuing the interrupted snapshot %s", fi.Name())
+		if err := os.Rename(filepath.Join(dir, fi.Name()), s.root); err != nil {
+			return nil, fmt.Errorf("Cannot rename the interrupted snapshot: %v", err)
+		}
+		break
+	}
+
+	if s.prev != nil {
+		if err := s.linkPrevious(); err != nil {
+			return nil, fmt.Errorf("Cannot link the previous snapshot: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// linkPrevious links all the files of the previous snapshot to the new one, except the ones
+// already in the new snapshot, saved by an interrupted run
+func (s *snapshotStorage) linkPrevious() error {
+	log.Infof("Linking the files of the previous snapshot %s", filepath.Base(s.prev.root))
+	return filepath.Walk(s.prev.root, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.prev.root, src)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(s.root, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(dest, os.ModePerm)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(src, dest)
+	})
+}
+
+// Chtimes copies the file before changing its modification time, since a file linked from the
+// previous snapshot shares it with that snapshot
+func (s *snapshotStorage) Chtimes(name string, mtime time.Time) error {
+	p := s.path(name)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(mtime) {
+		return nil
+	}
+
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	w, err := s.localStorage.Create(name, FileMeta{Size: fi.Size(), ModTime: mtime})
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// FreeSpace returns the free space of the destination, since the snapshot folder may not exist yet
+func (s *snapshotStorage) FreeSpace() (int64, error) {
+	return freeSpace(filepath.Dir(s.dir))
+}
+
+// Close completes the snapshot and removes the old ones, according to the retention policy
+func (s *snapshotStorage) Close() error {
+	if _, err := os.Stat(s.root); os.IsNotExist(err) {
+		return nil
+	}
+	dest := filepath.Join(s.dir, s.name)
+	if err := os.Rename(s.root, dest); err != nil {
+		return fmt.Errorf("Cannot complete the snapshot: %v", err)
+	}
+	log.Infof("Snapshot %s completed", s.name)
+
+	if !s.retention.retention() {
+		return nil
+	}
+	_, err := pruneSnapshots(s.dir, s.retention, false)
+	return err
+}
+
+// Abort leaves the snapshot partial, to be continued by the next run
+func (s *snapshotStorage) Abort() error {
+	log.Infof("Snapshot %s not completed", s.name)
+	return nil
+}
+
+// listSnapshots returns the complete snapshots in the given folder, from the oldest one
+func listSnapshots(dir string) ([]Snapshot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the snapshots: %v", err)
+	}
+	var snapshots []Snapshot
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		t, err := time.Parse(snapshotStampFormat, fi.Name())
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Name: fi.Name(), Time: t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// keepSnapshots returns the names of the snapshots to keep according to the retention policy:
+// the last snapshot of each of the last KeepDaily days, KeepWeekly weeks and KeepMonthly months
+// having snapshots, in UTC. The last snapshot is always kept
+func keepSnapshots(snapshots []Snapshot, cfg SnapshotsConf) map[string]bool {
+	keep := make(map[string]bool)
+	if len(snapshots) == 0 {
+		return keep
+	}
+	keep[snapshots[len(snapshots)-1].Name] = true
+
+	policies := []struct {
+		n   int
+		key func(time.Time) string
+	}{
+		{cfg.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{cfg.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{cfg.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range policies {
+		var last string
+		kept := 0
+		for i := len(snapshots) - 1; i >= 0 && kept < p.n; i-- {
+			key := p.key(snapshots[i].Time)
+			if key == last {
+				continue
+			}
+			last = key
+			keep[snapshots[i].Name] = true
+			kept++
+		}
+	}
+	return keep
+}
+
+// pruneSnapshots removes the snapshots not kept by the retention policy and returns them
+func pruneSnapshots(dir string, cfg SnapshotsConf, dryRun bool) ([]Snapshot, error) {
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	keep := keepSnapshots(snapshots, cfg)
+
+	var removed []Snapshot
+	for _, snap := range snapshots {
+		if keep[snap.Name] {
+			continue
+		}
+		removed = append(removed, snap)
+		if dryRun {
+			continue
+		}
+		log.Infof("Removing snapshot %s", snap.Name)
+		if err := os.RemoveAll(filepath.Join(dir, snap.Name)); err != nil {
+			return removed, fmt.Errorf("Cannot remove snapshot %s: %v", snap.Name, err)
+		}
+	}
+	return removed, nil
+}
+
+// Snapshots returns the complete snapshots of the backup in the given destination folder, from
+// the oldest one
+func Snapshots(destination string) ([]Snapshot, error) {
+	return listSnapshots(filepath.Join(destination, snapshotsFolder))
+}
+
+// PruneSnapshots removes the snapshots of the backup in the given destination folder that aren't
+// kept by the retention policy, and returns them. With dryRun true the snapshots aren't removed
+func PruneSnapshots(destination string, cfg SnapshotsConf, dryRun bool) ([]Snapshot, error) {
+	if !cfg.retention() {
+		return nil, errors.New("No snapshots retention policy is configured")
+	}
+	return pruneSnapshots(filepath.Join(destination, snapshotsFolder), cfg, dryRun)
+}
+
+// BackupFolder returns the local folder containing the albums of the backup: the destination or,
+// with snapshots, the last complete snapshot
+func (cfg *Conf) BackupFolder() (string, error) {
+	if !cfg.Snapshots.Enabled {
+		return cfg.Destination, nil
+	}
+	snapshots, err := Snapshots(cfg.Destination)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "", errors.New("There are no complete snapshots")
+	}
+	return filepath.Join(cfg.Destination, snapshotsFolder, snapshots[len(snapshots)-1].Name), nil
+}
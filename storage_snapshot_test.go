@@ -0,0 +1,148 @@
+package smugmug
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestSnapshotStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	run1 := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	snapshot := func(run time.Time, name string) string {
+		return filepath.Join(dest, snapshotsFolder, run.Format(snapshotStampFormat), filepath.FromSlash(name))
+	}
+
+	s, err := newSnapshotStorage(dest, SnapshotsConf{}, run1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeFile(t, s, "album/a.jpg", []byte("aaa"))
+	writeFile(t, s, "album/b.jpg", []byte("bbb"))
+	writeFile(t, s, "failed/d.jpg", []byte("ddd"))
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Second run: a.jpg is unchanged, b.jpg is replaced, d.jpg isn't checked
+	run2 := run1.Add(24 * time.Hour)
+	s, err = newSnapshotStorage(dest, SnapshotsConf{}, run2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"album/a.jpg", "album/b.jpg"} {
+		if fi, err := s.Stat(name); err != nil || fi.Size != 3 {
+			t.Fatalf("%s: unexpected info %+v (%v)", name, fi, err)
+		}
+	}
+	if _, err := s.Stat("album/c.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+	writeFile(t, s, "album/b.jpg", []byte("new b"))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("album/a.jpg", mtime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for run, want := range map[time.Time]string{run1: "bbb", run2: "new b"} {
+		if b, err := ioutil.ReadFile(snapshot(run, "album/b.jpg")); err != nil || string(b) != want {
+			t.Fatalf("%v: want %q, got %q (%v)", run, want, b, err)
+		}
+	}
+	fi1, _ := os.Stat(snapshot(run1, "failed/d.jpg"))
+	fi2, _ := os.Stat(snapshot(run2, "failed/d.jpg"))
+	if fi2 == nil || !os.SameFile(fi1, fi2) {
+		t.Fatalf("d.jpg not linked from the previous snapshot")
+	}
+	fi1, _ = os.Stat(snapshot(run1, "album/a.jpg"))
+	fi2, _ = os.Stat(snapshot(run2, "album/a.jpg"))
+	if fi1.ModTime().Equal(mtime) || !fi2.ModTime().Equal(mtime) {
+		t.Fatalf("mtime of the previous snapshot changed")
+	}
+
+	// Interrupted run, continued by the next one
+	run3 := run2.Add(24 * time.Hour)
+	s, _ = newSnapshotStorage(dest, SnapshotsConf{}, run3)
+	s.Stat("album/a.jpg")
+	writeFile(t, s, "album/c.jpg", []byte("ccc"))
+
+	run4 := run3.Add(time.Hour)
+	s, err = newSnapshotStorage(dest, SnapshotsConf{}, run4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, err := s.Stat("album/c.jpg"); err != nil || fi.Size != 3 {
+		t.Fatalf("unexpected info %+v (%v)", fi, err)
+	}
+	s.Close()
+	fi2, _ = os.Stat(snapshot(run2, "album/a.jpg"))
+	fi4, _ := os.Stat(snapshot(run4, "album/a.jpg"))
+	if !os.SameFile(fi2, fi4) {
+		t.Fatalf("a.jpg not linked from the previous snapshot")
+	}
+
+	list, err := Snapshots(dest)
+	if err != nil || len(list) != 3 || list[2].Name != "20210603T110000Z" {
+		t.Fatalf("unexpected snapshots %+v (%v)", list, err)
+	}
+	cfg := &Conf{Destination: dest, Snapshots: SnapshotsConf{Enabled: true}}
+	if root, err := cfg.BackupFolder(); err != nil || filepath.Base(root) != "20210603T110000Z" {
+		t.Fatalf("unexpected backup folder %s (%v)", root, err)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	dest := t.TempDir()
+	names := []string{
+		"20210101T100000Z", "20210115T100000Z", "20210201T100000Z", "20210301T100000Z",
+		"20210305T100000Z", "20210308T100000Z", "20210309T100000Z", "20210309T200000Z",
+		"20210310T100000Z",
+	}
+	for _, name := range append(names, "20210311T100000Z.partial", "other") {
+		os.MkdirAll(filepath.Join(dest, snapshotsFolder, name), os.ModePerm)
+	}
+
+	cfg := SnapshotsConf{KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 3}
+	removed, err := PruneSnapshots(dest, cfg, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, s := range removed {
+		got = append(got, s.Name)
+	}
+	// Kept: 20210310 and 20210309T20 (days), 20210305 (weeks), 20210201 and 20210115 (months)
+	want := "20210101T100000Z,20210301T100000Z,20210308T100000Z,20210309T100000Z"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("want %s, got %v", want, got)
+	}
+	if list, _ := Snapshots(dest); len(list) != len(names) {
+		t.Fatalf("snapshots removed in dry run")
+	}
+
+	if _, err := PruneSnapshots(dest, cfg, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if list, _ := Snapshots(dest); len(list) != 5 {
+		t.Fatalf("unexpected snapshots %+v", list)
+	}
+	if _, err := os.Stat(filepath.Join(dest, snapshotsFolder, "20210311T100000Z.partial")); err != nil {
+		t.Fatalf("partial snapshot removed")
+	}
+
+	if _, err := PruneSnapshots(dest, SnapshotsConf{}, false); err == nil {
+		t.Fatalf("want error without retention policy, got nil")
+	}
+}
@@ -0,0 +1,344 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// memStorage is an in-memory Storage, used for testing
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		files: make(map[string]*memFile),
+		dirs:  make(map[string]bool),
+	}
+}
+
+func (s *memStorage) Stat(name string) (FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = cleanName(name)
+	if f, ok := s.files[name]; ok {
+		return FileInfo{Name: path.Base(name), Size: int64(len(f.data)), ModTime: f.modTime}, nil
+	}
+	if s.dirs[name] {
+		return FileInfo{Name: path.Base(name), IsDir: true}, nil
+	}
+	return FileInfo{}, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (s *memStorage) Open(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[cleanName(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (s *memStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	return &memFileWriter{s: s, name: cleanName(name), modTime: meta.ModTime}, nil
+}
+
+func (s *memStorage) Chtimes(name string, mtime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[cleanName(name)]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	f.modTime = mtime
+	return nil
+}
+
+func (s *memStorage) List(dir string) ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir = cleanName(dir)
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
+	seen := make(map[string]bool)
+	var infos []FileInfo
+	add := func(name string, isFile bool) {
+		if !strings.HasPrefix(name, prefix) || name == dir {
+			return
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		base := strings.Split(rest, "/")[0]
+		if seen[base] {
+			return
+		}
+		seen[base] = true
+		if isFile && base == rest {
+			f := s.files[name]
+			infos = append(infos, FileInfo{Name: base, Size: int64(len(f.data)), ModTime: f.modTime})
+			return
+		}
+		infos = append(infos, FileInfo{Name: base, IsDir: true})
+	}
+	for name := range s.files {
+		add(name, true)
+	}
+	for name := range s.dirs {
+		add(name, false)
+	}
+	if len(infos) == 0 && dir != "" && !s.dirs[dir] {
+		return nil, &os.PathError{Op: "list", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *memStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = cleanName(name)
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memStorage) MkdirAll(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir = cleanName(dir); dir != "" && dir != "."; dir = path.Dir(dir) {
+		s.dirs[dir] = true
+	}
+	return nil
+}
+
+// content returns the content of the named file, or nil if it doesn't exist
+func (s *memStorage) content(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[cleanName(name)]; ok {
+		return f.data
+	}
+	return nil
+}
+
+type memFileWriter struct {
+	s       *memStorage
+	name    string
+	modTime time.Time
+	buf     bytes.Buffer
+}
+
+func (w *memFileWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memFileWriter) Commit() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	modTime := w.modTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	w.s.files[w.name] = &memFile{data: w.buf.Bytes(), modTime: modTime}
+	return nil
+}
+
+func (w *memFileWriter) Close() error {
+	return nil
+}
+
+func TestLocalStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	s := newLocalStorage(t.TempDir())
+
+	if err := s.MkdirAll("album/sub"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w, err := s.Create("album/discarded.jpg", FileMeta{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.Write([]byte("content"))
+	w.Close()
+	if _, err := s.Stat("album/discarded.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	w, err = s.Create("album/file.jpg", FileMeta{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Close()
+	w.Write([]byte("content"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fi, err := s.Stat("album/file.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Size != 7 {
+		t.Fatalf("size: want 7, got %d", fi.Size)
+	}
+	r, err := s.Open("album/file.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "content" {
+		t.Fatalf("want content, got %q", b)
+	}
+	r.Close()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("album/file.jpg", mtime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files, err := s.List("album")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 2 || files[0].Name != "file.jpg" || !files[0].ModTime.Equal(mtime) || !files[1].IsDir {
+		t.Fatalf("unexpected files %+v", files)
+	}
+
+	if err := s.Remove("album/file.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Stat("album/file.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image content"))
+	}))
+	defer srv.Close()
+
+	store := newMemStorage()
+	h := newHTTPHandler("key", "secret", "token", "secret", store)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := h.download(context.Background(), albumImage{AlbumPath: "/album"}, "album/image.jpg", srv.URL+"/image.jpg", FileMeta{Size: 13, ModTime: mtime}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(store.content("album/image.jpg")) != "image content" {
+		t.Fatalf("unexpected content %q", store.content("album/image.jpg"))
+	}
+	if fi, _ := store.Stat("album/image.jpg"); !fi.ModTime.Equal(mtime) {
+		t.Fatalf("mtime: want %v, got %v", mtime, fi.ModTime)
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	store := newMemStorage()
+	var calls int
+	w := &Worker{
+		cfg:   &Conf{UseMetadataTimes: true},
+		store: store,
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, meta FileMeta) error {
+			calls++
+			f, _ := store.Create(dest, meta)
+			f.Write(bytes.Repeat([]byte("a"), int(meta.Size)))
+			return f.Commit()
+		},
+	}
+	image := albumImage{DateTimeOriginal: "2020-01-02T03:04:05Z"}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := w.saveFile(context.Background(), image, "album/image.jpg", "url", FileMeta{Size: 13}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, _ := store.Stat("album/image.jpg"); !fi.ModTime.Equal(mtime) {
+		t.Fatalf("mtime: want %v, got %v", mtime, fi.ModTime)
+	}
+
+	// Same size: the file is skipped
+	if err := w.saveFile(context.Background(), image, "album/image.jpg", "url", FileMeta{Size: 13}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("calls: want 1, got %d", calls)
+	}
+
+	// Different size: the file is downloaded again
+	if err := w.saveFile(context.Background(), image, "album/image.jpg", "url", FileMeta{Size: 10}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("calls: want 2, got %d", calls)
+	}
+}
+
+func TestRunMemStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	store := newMemStorage()
+	tmpl, _ := buildFilenameTemplate("{{.ImageKey}}")
+	w := &Worker{
+		cfg: &Conf{AlbumMetadata: true},
+		req: &mockHandler{
+			username:       testUsername,
+			userAlbumsURI:  userAlbumsURI,
+			albumURLPath:   "/" + albumURLPath,
+			albumImagesURI: albumImagesURI,
+		},
+		store: store,
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, _ FileMeta) error {
+			return writeJSON(store, dest, "")
+		},
+		filenameTmpl: tmpl,
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files, err := store.List(albumURLPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "abc123,abc124,album.json" {
+		t.Fatalf("unexpected files %v", names)
+	}
+
+	if !bytes.Contains(store.content(path.Join(albumURLPath, "album.json")), []byte(`"abc124"`)) {
+		t.Fatalf("unexpected album metadata %s", store.content(path.Join(albumURLPath, "album.json")))
+	}
+}
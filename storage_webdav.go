@@ -0,0 +1,384 @@
+package smugmug
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// propfindBody asks for the properties used to build a FileInfo
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// WebDAVConf is the configuration of the WebDAV storage
+type WebDAVConf struct {
+	URL      string // URL of the folder where the backup is saved
+	User     string // User name, for basic authentication
+	Password string // Password, for basic authentication
+	SetMtime bool   // When true, modification times are set with the X-OC-Mtime header (Nextcloud and ownCloud)
+}
+
+func (cfg *WebDAVConf) validate() error {
+	if cfg.URL == "" {
+		return errors.New("webdav.url can't be empty")
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webdav.url %q is not a valid http(s) URL", cfg.URL)
+	}
+
+	return nil
+}
+
+// webdavStorage saves the backup in a collection of a WebDAV server. Files are uploaded to a
+// temporary name while they're downloaded from SmugMug, then moved to their final name
+type webdavStorage struct {
+	cfg    WebDAVConf
+	base   *url.URL
+	client *http.Client
+
+	mu   sync.Mutex
+	dirs map[string]bool // Collections known to exist
+}
+
+func newWebDAVStorage(cfg WebDAVConf) (*webdavStorage, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WebDAV URL: %v", err)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return &webdavStorage{
+		cfg:    cfg,
+		base:   base,
+		client: &http.Client{},
+		dirs:   map[string]bool{"": true},
+	}, nil
+}
+
+// url returns the URL of the named file. Collection URLs end with a slash
+func (s *webdavStorage) url(name string, collection bool) string {
+	u := *s.base
+	u.Path = path.Join(s.base.Path, cleanName(name))
+	if collection {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// do performs an authenticated request, returning an error if the response status isn't 2xx
+func (s *webdavStorage) do(method, rawURL string, body io.Reader, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.doRequest(req, headers)
+}
+
+func (s *webdavStorage) doRequest(req *http.Request, headers http.Header) (*http.Response, error) {
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if s.cfg.User != "" || s.cfg.Password != "" {
+		req.SetBasicAuth(s.cfg.User, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		drainAndClose(resp)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: req.Method, Path: req.URL.Path, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns the info of the named file and, with depth 1, of its children. The first
+// element is the file itself
+func (s *webdavStorage) propfind(name string, depth int) ([]FileInfo, error) {
+	resp, err := s.do("PROPFIND", s.url(name, false), strings.NewReader(propfindBody), http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp)
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("Cannot decode PROPFIND response for %s: %v", name, err)
+	}
+
+	self := path.Join(s.base.Path, cleanName(name))
+	var infos []FileInfo
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid href %q in PROPFIND response: %v", r.Href, err)
+		}
+		p := path.Clean(href.Path)
+		fi := FileInfo{Name: path.Base(p)}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			fi.Size = ps.Prop.ContentLength
+			fi.IsDir = ps.Prop.ResourceType.Collection != nil
+			fi.ModTime, _ = http.ParseTime(ps.Prop.LastModified)
+		}
+		if p == self {
+			infos = append([]FileInfo{fi}, infos...)
+			continue
+		}
+		infos = append(infos, fi)
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("Empty PROPFIND response for %s", name)
+	}
+	return infos, nil
+}
+
+func (s *webdavStorage) Stat(name string) (FileInfo, error) {
+	infos, err := s.propfind(name, 0)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return infos[0], nil
+}
+
+func (s *webdavStorage) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.url(name, false), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Create starts a streaming PUT of a temporary file, moved to its final name on Commit
+func (s *webdavStorage) Create(name string, meta FileMeta) (FileWriter, error) {
+	name = cleanName(name)
+	if err := s.MkdirAll(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	tmp := path.Join(path.Dir(name), fmt.Sprintf(".%s.tmp%s", path.Base(name), nonce()))
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPut, s.url(tmp, false), pr)
+	if err != nil {
+		return nil, err
+	}
+	// The body is sent chunked: the size reported by SmugMug is checked on Commit instead, since
+	// a wrong ContentLength makes the transport fail with an unclear error
+	headers := http.Header{}
+	if s.cfg.SetMtime && !meta.ModTime.IsZero() {
+		headers.Set("X-OC-Mtime", strconv.FormatInt(meta.ModTime.Unix(), 10))
+	}
+
+	w := &webdavFileWriter{
+		s:    s,
+		pw:   pw,
+		tmp:  tmp,
+		dest: name,
+		size: meta.Size,
+		done: make(chan error, 1),
+	}
+	go func() {
+		resp, err := s.doRequest(req, headers)
+		if err == nil {
+			if headers.Get("X-OC-Mtime") != "" && resp.Header.Get("X-OC-Mtime") != "accepted" {
+				log.Debugf("WebDAV server ignored the modification time of %s", name)
+			}
+			drainAndClose(resp)
+		}
+		// Unblock the writer if the server stopped reading the body
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// Chtimes sets the modification time with a PROPPATCH of the lastmodified property, supported by
+// Nextcloud and ownCloud. It does nothing unless webdav.set_mtime is enabled
+func (s *webdavStorage) Chtimes(name string, mtime time.Time) error {
+	if !s.cfg.SetMtime {
+		log.Debugf("Modification times not enabled on WebDAV, skipping %s", name)
+		return nil
+	}
+
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<d:propertyupdate xmlns:d="DAV:"><d:set><d:prop><d:lastmodified>%d</d:lastmodified></d:prop></d:set></d:propertyupdate>`, mtime.Unix())
+	resp, err := s.do("PROPPATCH", s.url(name, false), strings.NewReader(body), http.Header{
+		"Content-Type": {"application/xml; charset=utf-8"},
+	})
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp)
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("Cannot decode PROPPATCH response for %s: %v", name, err)
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				return fmt.Errorf("Cannot set modification time of %s: %s", name, ps.Status)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *webdavStorage) List(dir string) ([]FileInfo, error) {
+	infos, err := s.propfind(dir, 1)
+	if err != nil {
+		return nil, err
+	}
+	return infos[1:], nil
+}
+
+func (s *webdavStorage) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.url(name, false), nil, nil)
+	if err != nil {
+		return err
+	}
+	return drainAndClose(resp)
+}
+
+func (s *webdavStorage) Rename(oldname, newname string) error {
+	newname = cleanName(newname)
+	if err := s.MkdirAll(path.Dir(newname)); err != nil {
+		return err
+	}
+	resp, err := s.do("MOVE", s.url(oldname, false), nil, http.Header{
+		"Destination": {s.url(newname, false)},
+		"Overwrite":   {"T"},
+	})
+	if err != nil {
+		return err
+	}
+	return drainAndClose(resp)
+}
+
+// MkdirAll creates the missing collections with MKCOL, one level at a time
+func (s *webdavStorage) MkdirAll(dir string) error {
+	dir = cleanName(dir)
+	if dir == "." {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current string
+	for _, part := range strings.Split(dir, "/") {
+		current = path.Join(current, part)
+		if s.dirs[current] {
+			continue
+		}
+		resp, err := s.do("MKCOL", s.url(current, true), nil, nil)
+		if err == nil {
+			log.Infof("Creating folder %s\n", current)
+			drainAndClose(resp)
+		} else if fi, statErr := s.Stat(current); statErr != nil || !fi.IsDir {
+			// MKCOL fails with 405 if the collection already exists
+			return fmt.Errorf("Cannot create folder: %v", err)
+		}
+		s.dirs[current] = true
+	}
+	return nil
+}
+
+type webdavFileWriter struct {
+	s         *webdavStorage
+	pw        *io.PipeWriter
+	tmp       string
+	dest      string
+	size      int64 // Expected size, 0 if unknown
+	written   int64
+	done      chan error // Result of the PUT request
+	finished  bool
+	committed bool
+}
+
+func (w *webdavFileWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// wait ends the PUT request body and waits for the response
+func (w *webdavFileWriter) wait(bodyErr error) error {
+	if w.finished {
+		return errors.New("upload already finished")
+	}
+	w.finished = true
+	w.pw.CloseWithError(bodyErr)
+	return <-w.done
+}
+
+// Commit completes the upload and moves the temporary file to its final name
+func (w *webdavFileWriter) Commit() error {
+	if w.size > 0 && w.written != w.size {
+		return fmt.Errorf("%d bytes written, the expected size is %d", w.written, w.size)
+	}
+	if err := w.wait(nil); err != nil {
+		return err
+	}
+	resp, err := w.s.do("MOVE", w.s.url(w.tmp, false), nil, http.Header{
+		"Destination": {w.s.url(w.dest, false)},
+		"Overwrite":   {"T"},
+	})
+	if err != nil {
+		w.s.Remove(w.tmp)
+		return err
+	}
+	w.committed = true
+	return drainAndClose(resp)
+}
+
+// Close aborts the upload, if still in progress, and removes the temporary file
+func (w *webdavFileWriter) Close() error {
+	if w.committed {
+		return nil
+	}
+	if !w.finished {
+		w.wait(errors.New("upload discarded"))
+	}
+	if err := w.s.Remove(w.tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
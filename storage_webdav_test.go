@@ -0,0 +1,203 @@
+package smugmug
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+	"golang.org/x/net/webdav"
+)
+
+var lastModifiedRe = regexp.MustCompile(`<d:lastmodified>(\d+)</d:lastmodified>`)
+
+// newWebDAVServer starts a WebDAV server backed by the given folder, emulating the Nextcloud
+// support for modification times (X-OC-Mtime on PUT and lastmodified PROPPATCH)
+func newWebDAVServer(t *testing.T, root string) *httptest.Server {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	// Serve a request at a time, so that a discarded upload is handled before the removal of its
+	// temporary file
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if user, pass, ok := r.BasicAuth(); !ok || user != "backup" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		local := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(r.URL.Path, "/dav")))
+
+		switch {
+		case r.Method == http.MethodPut && r.Header.Get("X-OC-Mtime") != "":
+			rec := httptest.NewRecorder()
+			dav.ServeHTTP(rec, r)
+			mtime, _ := strconv.ParseInt(r.Header.Get("X-OC-Mtime"), 10, 64)
+			os.Chtimes(local, time.Now(), time.Unix(mtime, 0))
+			w.Header().Set("X-OC-Mtime", "accepted")
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+		case r.Method == "PROPPATCH":
+			body, _ := ioutil.ReadAll(r.Body)
+			m := lastModifiedRe.FindSubmatch(body)
+			if m == nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			mtime, _ := strconv.ParseInt(string(m[1]), 10, 64)
+			if err := os.Chtimes(local, time.Now(), time.Unix(mtime, 0)); err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+			fmt.Fprintf(w, `<d:multistatus xmlns:d="DAV:"><d:response><d:href>%s</d:href><d:propstat>`+
+				`<d:prop><d:lastmodified/></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`, r.URL.Path)
+		default:
+			dav.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	root := t.TempDir()
+	srv := newWebDAVServer(t, root)
+
+	cfg := WebDAVConf{URL: srv.URL + "/dav/backup", User: "backup", Password: "secret", SetMtime: true}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	os.Mkdir(filepath.Join(root, "backup"), 0755)
+
+	// Wrong credentials
+	wrong, _ := newWebDAVStorage(WebDAVConf{URL: cfg.URL, User: "backup", Password: "wrong"})
+	if err := wrong.MkdirAll("album"); err == nil {
+		t.Fatalf("want authentication error, got nil")
+	}
+
+	s, _ := newWebDAVStorage(cfg)
+	if err := s.MkdirAll("my album/sub"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Existing collections
+	s2, _ := newWebDAVStorage(cfg)
+	if err := s2.MkdirAll("my album/sub"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := s.Stat("my album/missing.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, content := range []string{"first", "second version"} {
+		w, err := s.Create("my album/image 1.jpg", FileMeta{Size: int64(len(content)), ModTime: mtime})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.Write([]byte(content))
+		if err := w.Commit(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(root, "backup", "my album", "image 1.jpg"))
+		if err != nil || string(b) != content {
+			t.Fatalf("want %q, got %q (%v)", content, b, err)
+		}
+	}
+
+	fi, err := s.Stat("my album/image 1.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Size != int64(len("second version")) || fi.IsDir || !fi.ModTime.Equal(mtime) {
+		t.Fatalf("unexpected info %+v", fi)
+	}
+	r, err := s.Open("my album/image 1.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "second version" {
+		t.Fatalf("want second version, got %q", b)
+	}
+	r.Close()
+
+	mtime = time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("my album/image 1.jpg", mtime); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, _ := s.Stat("my album/image 1.jpg"); !fi.ModTime.Equal(mtime) {
+		t.Fatalf("mtime: want %v, got %v", mtime, fi.ModTime)
+	}
+
+	files, err := s.List("my album")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("unexpected files %+v", files)
+	}
+	for _, f := range files {
+		if (f.Name == "sub") != f.IsDir || (f.Name != "sub" && f.Name != "image 1.jpg") {
+			t.Fatalf("unexpected files %+v", files)
+		}
+	}
+
+	if err := s.Rename("my album/image 1.jpg", "other album/image 1.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Stat("my album/image 1.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+	if err := s.Rename("other album/image 1.jpg", "my album/image 1.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Remove("my album/image 1.jpg"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Stat("my album/image 1.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	// Discarded file
+	w, err := s.Create("my album/discarded.jpg", FileMeta{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.Write([]byte("content"))
+	w.Close()
+	if files, _ := ioutil.ReadDir(filepath.Join(root, "backup", "my album")); len(files) != 1 {
+		t.Fatalf("temporary file not removed: %d files", len(files))
+	}
+
+	// Content shorter than the expected size
+	w, err = s.Create("my album/short.jpg", FileMeta{Size: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w.Write([]byte("content"))
+	if err := w.Commit(); err == nil || !strings.Contains(err.Error(), "the expected size is 10") {
+		t.Fatalf("want size error, got %v", err)
+	}
+	w.Close()
+	if _, err := s.Stat("my album/short.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+}
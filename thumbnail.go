@@ -0,0 +1,107 @@
+package smugmug
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif" // Register the GIF decoder
+	"image/jpeg"
+	_ "image/png" // Register the PNG decoder
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// thumbnailSize is the max width and height, in pixels, of the generated thumbnails
+const thumbnailSize = 320
+
+// makeThumbnail creates a JPEG thumbnail of the image in src, saving it to dest. The thumbnail
+// isn't generated again if dest is newer than src. It's written to a temporary file and renamed,
+// so that it's never read partially
+func makeThumbnail(src, dest string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if destInfo, err := os.Stat(dest); err == nil && !destInfo.ModTime().Before(srcInfo.ModTime()) {
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("Cannot decode %s: %v", src, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(out, resize(img, thumbnailSize), &jpeg.Options{Quality: 80})
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		// TempFile creates files readable only by the owner
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return nil
+}
+
+// resize scales the image to fit in a square of the given size, keeping the aspect ratio. Each
+// pixel is the average of a 4x4 grid of samples from the source image
+func resize(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	const samples = 4
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var r, g, bl, a uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					px := b.Min.X + (x*samples+sx)*w/(dw*samples)
+					py := b.Min.Y + (y*samples+sy)*h/(dh*samples)
+					cr, cg, cb, ca := src.At(px, py).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+				}
+			}
+			n := uint32(samples * samples)
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,182 @@
+package smugmug
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// versionsFolder is the folder, in the backup root, where the previous versions of the replaced
+// files are saved
+const versionsFolder = ".versions"
+
+// versionStampFormat is the format of the timestamp appended to the versions names
+const versionStampFormat = "20060102T150405Z"
+
+// VersionsConf is the configuration of the previous versions of the replaced files
+type VersionsConf struct {
+	Enabled    bool  // When true, replaced files are moved to the versions folder
+	MaxPerFile int   // Maximum number of versions kept for each file, 0 for no limit
+	MaxBytes   int64 // Maximum total size of the versions, 0 for no limit
+}
+
+func (c VersionsConf) validate() error {
+	if c.MaxPerFile < 0 || c.MaxBytes < 0 {
+		return errors.New("The versions max_per_file and max_bytes values can't be negative")
+	}
+	return nil
+}
+
+// fileVersion is a previous version of a file
+type fileVersion struct {
+	name string // Storage name of the version
+	file string // Storage name of the replaced file
+	time time.Time
+	size int64
+}
+
+// versionName returns the name of the version of the named file, replaced at the given time
+func versionName(name string, t time.Time) string {
+	return path.Join(versionsFolder, cleanName(name)+"."+t.UTC().Format(versionStampFormat))
+}
+
+// parseVersionName returns the name of the replaced file and the replacement time of a version
+func parseVersionName(name string) (string, time.Time, error) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 || !strings.HasPrefix(name, versionsFolder+"/") {
+		return "", time.Time{}, fmt.Errorf("%s is not a version", name)
+	}
+	t, err := time.Parse(versionStampFormat, name[i+1:])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%s is not a version", name)
+	}
+	return strings.TrimPrefix(name[:i], versionsFolder+"/"), t, nil
+}
+
+// versionKeeper moves the files that are going to be replaced to the versions folder, as
+// .versions/<album>/<name>.<timestamp>, removing the oldest versions when the limits are exceeded
+type versionKeeper struct {
+	store    Storage
+	cfg      VersionsConf
+	loaded   bool
+	versions []fileVersion // All the versions, from the oldest one
+}
+
+func newVersionKeeper(store Storage, cfg VersionsConf) *versionKeeper {
+	return &versionKeeper{store: store, cfg: cfg}
+}
+
+// load reads the existing versions, the first time it's called
+func (k *versionKeeper) load() error {
+	if k.loaded {
+		return nil
+	}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		files, err := k.store.List(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, fi := range files {
+			name := path.Join(dir, fi.Name)
+			if fi.IsDir {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			file, t, err := parseVersionName(name)
+			if err != nil {
+				log.Debugf("Skipping %v", err)
+				continue
+			}
+			k.versions = append(k.versions, fileVersion{name: name, file: file, time: t, size: fi.Size})
+		}
+		return nil
+	}
+	if err := walk(versionsFolder); err != nil {
+		return fmt.Errorf("Cannot read the versions: %v", err)
+	}
+	sort.SliceStable(k.versions, func(i, j int) bool { return k.versions[i].time.Before(k.versions[j].time) })
+	k.loaded = true
+	return nil
+}
+
+// keep moves the existing named file, described by fi, to the versions folder and removes the
+// versions exceeding the limits
+func (k *versionKeeper) keep(name string, fi FileInfo, now time.Time) error {
+	if err := k.load(); err != nil {
+		return err
+	}
+	v := fileVersion{
+		name: versionName(name, now),
+		file: cleanName(name),
+		time: now.UTC().Truncate(time.Second),
+		size: fi.Size,
+	}
+	log.Infof("Moving the previous version of %s to %s", name, v.name)
+	if err := renameFile(k.store, name, v.name); err != nil {
+		return fmt.Errorf("Cannot save the previous version of %s: %v", name, err)
+	}
+	k.versions = append(k.versions, v)
+	return k.prune(v.file)
+}
+
+// prune removes the oldest versions of the given file exceeding the maximum number of versions,
+// then the oldest versions of any file until their total size is within the limit
+func (k *versionKeeper) prune(file string) error {
+	remove := make(map[string]bool)
+	if k.cfg.MaxPerFile > 0 {
+		count := 0
+		for i := len(k.versions) - 1; i >= 0; i-- {
+			if k.versions[i].file != file {
+				continue
+			}
+			if count++; count > k.cfg.MaxPerFile {
+				remove[k.versions[i].name] = true
+			}
+		}
+	}
+	if k.cfg.MaxBytes > 0 {
+		var total int64
+		for _, v := range k.versions {
+			if !remove[v.name] {
+				total += v.size
+			}
+		}
+		for _, v := range k.versions {
+			if total <= k.cfg.MaxBytes {
+				break
+			}
+			if !remove[v.name] {
+				remove[v.name] = true
+				total -= v.size
+			}
+		}
+	}
+
+	versions := k.versions[:0]
+	var err error
+	for _, v := range k.versions {
+		if !remove[v.name] {
+			versions = append(versions, v)
+			continue
+		}
+		log.Infof("Removing old version %s", v.name)
+		if rmErr := k.store.Remove(v.name); rmErr != nil && !os.IsNotExist(rmErr) {
+			versions = append(versions, v)
+			err = fmt.Errorf("Cannot remove the old version %s: %v", v.name, rmErr)
+		}
+	}
+	k.versions = versions
+	return err
+}
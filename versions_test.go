@@ -0,0 +1,87 @@
+package smugmug
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestVersionKeeper(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	s := newMemStorage()
+	t1 := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	k := newVersionKeeper(s, VersionsConf{Enabled: true, MaxPerFile: 2})
+	for i, content := range []string{"v1", "v2", "v3"} {
+		writeFile(t, s, "album/a.jpg", []byte(content))
+		fi, _ := s.Stat("album/a.jpg")
+		if err := k.keep("album/a.jpg", fi, t1.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := s.Stat("album/a.jpg"); err == nil {
+			t.Fatalf("file not moved")
+		}
+	}
+	files, err := s.List(".versions/album")
+	if err != nil || len(files) != 2 || files[0].Name != "a.jpg.20210601T110000Z" || files[1].Name != "a.jpg.20210601T120000Z" {
+		t.Fatalf("unexpected versions %+v (%v)", files, err)
+	}
+	if got := string(s.content(".versions/album/a.jpg.20210601T120000Z")); got != "v3" {
+		t.Fatalf("want v3, got %q", got)
+	}
+
+	// Total size limit, with the existing versions loaded from the storage
+	k = newVersionKeeper(s, VersionsConf{Enabled: true, MaxBytes: 5})
+	writeFile(t, s, "album/b.jpg", []byte("bbbb"))
+	fi, _ := s.Stat("album/b.jpg")
+	if err := k.keep("album/b.jpg", fi, t1.Add(24*time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	files, err = s.List(".versions/album")
+	if err != nil || len(files) != 1 || files[0].Name != "b.jpg.20210602T100000Z" {
+		t.Fatalf("unexpected versions %+v (%v)", files, err)
+	}
+}
+
+func TestSaveFileVersions(t *testing.T) {
+	defer testutil.LessLogging()()
+
+	root := t.TempDir()
+	s := newLocalStorage(root)
+	writeFile(t, s, "album/a.jpg", []byte("old!"))
+
+	w := &Worker{
+		cfg:      &Conf{},
+		store:    s,
+		versions: newVersionKeeper(s, VersionsConf{Enabled: true}),
+		downloadFn: func(_ context.Context, _ albumImage, dest, _ string, meta FileMeta) error {
+			writeFile(t, s, dest, []byte("new"))
+			return nil
+		},
+	}
+	if err := w.saveFile(context.Background(), albumImage{}, "album/a.jpg", "url", FileMeta{Size: 3}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(root, "album", "a.jpg")); string(b) != "new" {
+		t.Fatalf("want new, got %q", b)
+	}
+	versions, _ := filepath.Glob(filepath.Join(root, ".versions", "album", "a.jpg.*"))
+	if len(versions) != 1 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	if b, _ := ioutil.ReadFile(versions[0]); string(b) != "old!" {
+		t.Fatalf("want old!, got %q", b)
+	}
+
+	// Same file: nothing to do
+	if err := w.saveFile(context.Background(), albumImage{}, "album/a.jpg", "url", FileMeta{Size: 3}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if versions, _ := filepath.Glob(filepath.Join(root, ".versions", "album", "*")); len(versions) != 1 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+}